@@ -0,0 +1,465 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Scopes disponibles para las API keys
+const (
+	ScopeLinesRead    = "lines:read"
+	ScopeLinesWrite   = "lines:write"
+	ScopeMessagesSend = "messages:send"
+	ScopeStatsRead    = "stats:read"
+	ScopeKeysAdmin    = "keys:admin"
+	ScopeAll          = "*"
+)
+
+var validScopes = map[string]bool{
+	ScopeLinesRead:    true,
+	ScopeLinesWrite:   true,
+	ScopeMessagesSend: true,
+	ScopeStatsRead:    true,
+	ScopeKeysAdmin:    true,
+	ScopeAll:          true,
+}
+
+type APIKey struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	LineIDs    []string   `json:"line_ids,omitempty"` // Vacío = todas las líneas
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Secreto para usar la API mientras no exista ninguna key; sin él la API
+// queda cerrada hasta que se configure
+var bootstrapToken = os.Getenv("WHATSGO_BOOTSTRAP_TOKEN")
+
+type contextKey string
+
+const apiKeyContextKey contextKey = "api_key"
+
+// Verificar si la key tiene el scope indicado
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope || s == ScopeAll {
+			return true
+		}
+	}
+	return false
+}
+
+// Verificar si la key puede operar sobre la línea indicada
+func (k *APIKey) CanAccessLine(lineID string) bool {
+	if len(k.LineIDs) == 0 {
+		return true
+	}
+	for _, id := range k.LineIDs {
+		if id == lineID {
+			return true
+		}
+	}
+	return false
+}
+
+// Verificar si la key abarca todas las líneas de otra: una key restringida
+// solo abarca keys restringidas a un subconjunto de sus líneas
+func (k *APIKey) CoversKey(other *APIKey) bool {
+	if len(k.LineIDs) == 0 {
+		return true
+	}
+	if len(other.LineIDs) == 0 {
+		return false
+	}
+	for _, id := range other.LineIDs {
+		if !k.CanAccessLine(id) {
+			return false
+		}
+	}
+	return true
+}
+
+// Generar una nueva key en texto plano ("wg_" + 64 caracteres hex)
+func generateAPIKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "wg_" + hex.EncodeToString(b), nil
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Separar una lista guardada como texto separado por comas
+func splitList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	var result []string
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			result = append(result, part)
+		}
+	}
+	return result
+}
+
+func scanAPIKey(scanner interface{ Scan(...interface{}) error }) (*APIKey, error) {
+	var key APIKey
+	var scopes, lineIDs string
+	var lastUsed, revoked sql.NullTime
+
+	err := scanner.Scan(&key.ID, &key.Name, &key.Prefix, &scopes, &lineIDs, &key.CreatedAt, &lastUsed, &revoked)
+	if err != nil {
+		return nil, err
+	}
+
+	key.Scopes = splitList(scopes)
+	key.LineIDs = splitList(lineIDs)
+	if lastUsed.Valid {
+		key.LastUsedAt = &lastUsed.Time
+	}
+	if revoked.Valid {
+		key.RevokedAt = &revoked.Time
+	}
+	return &key, nil
+}
+
+// Buscar una key activa por su valor en texto plano
+func findAPIKey(plain string) (*APIKey, error) {
+	row := configDB.QueryRow(`
+		SELECT id, name, prefix, scopes, line_ids, created_at, last_used_at, revoked_at
+		FROM api_keys
+		WHERE key_hash = ? AND revoked_at IS NULL
+	`, hashAPIKey(plain))
+	return scanAPIKey(row)
+}
+
+// Contar keys activas; sin keys solo se accede con el token de bootstrap
+func countActiveAPIKeys() (int, error) {
+	var count int
+	err := configDB.QueryRow("SELECT COUNT(*) FROM api_keys WHERE revoked_at IS NULL").Scan(&count)
+	return count, err
+}
+
+// Extraer la key de X-API-Key, de Authorization: Bearer o, solo para los
+// streams SSE (EventSource no permite cabeceras), del parámetro api_key
+func apiKeyFromRequest(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(auth[len("Bearer "):])
+	}
+	if strings.HasSuffix(r.URL.Path, "/events") {
+		return r.URL.Query().Get("api_key")
+	}
+	return ""
+}
+
+// Middleware de autenticación para el subrouter /api
+func apiKeyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count, err := countActiveAPIKeys()
+		if err != nil {
+			log.Printf("Error al contar API keys: %v", err)
+			http.Error(w, "Error interno", http.StatusInternalServerError)
+			return
+		}
+
+		plain := apiKeyFromRequest(r)
+
+		// Modo bootstrap: sin keys creadas se accede con WHATSGO_BOOTSTRAP_TOKEN
+		// para poder crear la primera
+		if count == 0 {
+			if bootstrapToken == "" {
+				http.Error(w, "No hay API keys: configure WHATSGO_BOOTSTRAP_TOKEN para crear la primera", http.StatusUnauthorized)
+				return
+			}
+			if subtle.ConstantTimeCompare([]byte(plain), []byte(bootstrapToken)) != 1 {
+				http.Error(w, "Token de bootstrap requerido", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if plain == "" {
+			http.Error(w, "API key requerida", http.StatusUnauthorized)
+			return
+		}
+
+		key, err := findAPIKey(plain)
+		if err == sql.ErrNoRows {
+			http.Error(w, "API key inválida", http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			log.Printf("Error al validar API key: %v", err)
+			http.Error(w, "Error interno", http.StatusInternalServerError)
+			return
+		}
+
+		go configDB.Exec("UPDATE api_keys SET last_used_at = CURRENT_TIMESTAMP WHERE id = ?", key.ID)
+
+		ctx := context.WithValue(r.Context(), apiKeyContextKey, key)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Obtener la key autenticada; nil en modo bootstrap
+func apiKeyFromContext(r *http.Request) *APIKey {
+	key, _ := r.Context().Value(apiKeyContextKey).(*APIKey)
+	return key
+}
+
+// Exigir un scope a la API key autenticada
+func requireScope(scope string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if key := apiKeyFromContext(r); key != nil && !key.HasScope(scope) {
+			http.Error(w, fmt.Sprintf("La API key no tiene el scope %s", scope), http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// Exigir un scope y acceso a la línea {id} de la ruta
+func requireLineScope(scope string, handler http.HandlerFunc) http.HandlerFunc {
+	return requireScope(scope, func(w http.ResponseWriter, r *http.Request) {
+		if !canAccessLine(r, mux.Vars(r)["id"]) {
+			http.Error(w, "La API key no tiene acceso a esta línea", http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	})
+}
+
+// Verificar acceso a una línea que no viene en la ruta (p.ej. en el cuerpo)
+func canAccessLine(r *http.Request, lineID string) bool {
+	key := apiKeyFromContext(r)
+	return key == nil || key.CanAccessLine(lineID)
+}
+
+// Crear API key
+func createAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name    string   `json:"name"`
+		Scopes  []string `json:"scopes"`
+		LineIDs []string `json:"line_ids"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Name == "" {
+		http.Error(w, "El nombre es requerido", http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Scopes) == 0 {
+		http.Error(w, "Se requiere al menos un scope", http.StatusBadRequest)
+		return
+	}
+
+	for _, scope := range req.Scopes {
+		if !validScopes[scope] {
+			http.Error(w, fmt.Sprintf("Scope inválido: %s", scope), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Una key no puede dar scopes que no tiene; "*" solo lo da otra key con "*"
+	creator := apiKeyFromContext(r)
+	if creator != nil {
+		for _, scope := range req.Scopes {
+			if !creator.HasScope(scope) {
+				http.Error(w, fmt.Sprintf("La API key no tiene el scope %s", scope), http.StatusForbidden)
+				return
+			}
+		}
+	}
+
+	// Una key restringida no puede crear keys con más acceso que ella
+	if creator != nil && len(creator.LineIDs) > 0 {
+		if len(req.LineIDs) == 0 {
+			http.Error(w, "La nueva key debe restringirse a líneas permitidas", http.StatusForbidden)
+			return
+		}
+		for _, id := range req.LineIDs {
+			if !creator.CanAccessLine(id) {
+				http.Error(w, fmt.Sprintf("Sin acceso a la línea %s", id), http.StatusForbidden)
+				return
+			}
+		}
+	}
+
+	plain, err := generateAPIKey()
+	if err != nil {
+		http.Error(w, "Error al generar API key", http.StatusInternalServerError)
+		return
+	}
+
+	key := APIKey{
+		ID:        fmt.Sprintf("key_%d", time.Now().UnixNano()),
+		Name:      req.Name,
+		Prefix:    plain[:11],
+		Scopes:    req.Scopes,
+		LineIDs:   req.LineIDs,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	_, err = configDB.Exec(`
+		INSERT INTO api_keys (id, name, key_hash, prefix, scopes, line_ids, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, key.ID, key.Name, hashAPIKey(plain), key.Prefix,
+		strings.Join(key.Scopes, ","), strings.Join(key.LineIDs, ","), key.CreatedAt)
+	if err != nil {
+		log.Printf("Error al guardar API key: %v", err)
+		http.Error(w, "Error al guardar API key", http.StatusInternalServerError)
+		return
+	}
+
+	// La key en texto plano solo se devuelve al crearla
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"key":     plain,
+		"api_key": key,
+	})
+}
+
+// Listar API keys
+func getAPIKeys(w http.ResponseWriter, r *http.Request) {
+	rows, err := configDB.Query(`
+		SELECT id, name, prefix, scopes, line_ids, created_at, last_used_at, revoked_at
+		FROM api_keys
+		ORDER BY created_at DESC
+	`)
+	if err != nil {
+		http.Error(w, "Error al obtener API keys", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	// Una key restringida solo ve las keys de sus líneas
+	caller := apiKeyFromContext(r)
+
+	result := []*APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			log.Printf("Error al leer API key: %v", err)
+			continue
+		}
+		if caller != nil && !caller.CoversKey(key) {
+			continue
+		}
+		result = append(result, key)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// Revocar API key
+func revokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	keyID := mux.Vars(r)["key_id"]
+
+	// Una key restringida solo puede revocar keys de sus líneas; las demás
+	// se tratan como inexistentes
+	if caller := apiKeyFromContext(r); caller != nil {
+		key, err := scanAPIKey(configDB.QueryRow(`
+			SELECT id, name, prefix, scopes, line_ids, created_at, last_used_at, revoked_at
+			FROM api_keys
+			WHERE id = ?
+		`, keyID))
+		if err == sql.ErrNoRows || (err == nil && !caller.CoversKey(key)) {
+			http.Error(w, "API key no encontrada", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Error al revocar API key", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Sin una key de administración para todas las líneas nadie podría volver
+	// a gestionar todas las keys
+	lastAdmin, err := isLastAdminKey(keyID)
+	if err != nil {
+		http.Error(w, "Error al revocar API key", http.StatusInternalServerError)
+		return
+	}
+	if lastAdmin {
+		http.Error(w, "No se puede revocar la última API key con keys:admin para todas las líneas", http.StatusConflict)
+		return
+	}
+
+	res, err := configDB.Exec("UPDATE api_keys SET revoked_at = CURRENT_TIMESTAMP WHERE id = ? AND revoked_at IS NULL", keyID)
+	if err != nil {
+		http.Error(w, "Error al revocar API key", http.StatusInternalServerError)
+		return
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "API key no encontrada", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "API key revocada"})
+}
+
+// Indica si keyID tiene keys:admin y no queda otra key activa con ese scope
+// para todas las líneas. Las keys restringidas no cuentan: no pueden
+// gestionar las keys de otras líneas ni crear keys sin restricción
+func isLastAdminKey(keyID string) (bool, error) {
+	rows, err := configDB.Query(`
+		SELECT id, name, prefix, scopes, line_ids, created_at, last_used_at, revoked_at
+		FROM api_keys
+		WHERE revoked_at IS NULL
+	`)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	isAdmin, otherAdmins := false, 0
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return false, err
+		}
+		if !key.HasScope(ScopeKeysAdmin) {
+			continue
+		}
+		if key.ID == keyID {
+			isAdmin = true
+		} else if len(key.LineIDs) == 0 {
+			otherAdmins++
+		}
+	}
+	return isAdmin && otherAdmins == 0, rows.Err()
+}
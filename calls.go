@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Llamada registrada en call_logs
+type CallLog struct {
+	ID        int64     `json:"id"`
+	LineID    string    `json:"line_id"`
+	CallID    string    `json:"call_id"`
+	Caller    string    `json:"caller"`
+	IsVideo   bool      `json:"is_video"`
+	IsGroup   bool      `json:"is_group"`
+	Rejected  bool      `json:"rejected"`
+	Error     string    `json:"error,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Procesar una llamada entrante: rechazarla si la línea no permite
+// llamadas, responder con el mensaje configurado, registrarla y notificarla
+func handleCallOffer(line *Line, evt *events.CallOffer) {
+	data := buildCallEventData(evt)
+
+	var rejectErr error
+	if !line.Config.AllowCalls {
+		rejectErr = line.Client.RejectCall(context.Background(), evt.From, evt.CallID)
+		if rejectErr != nil {
+			log.Printf("Error al rechazar llamada %s en línea %s: %v", evt.CallID, line.ID, rejectErr)
+		} else {
+			data.Rejected = true
+			log.Printf("Llamada %s de %s rechazada en línea %s", evt.CallID, evt.From, line.ID)
+		}
+	}
+
+	// Avisar al llamante por texto; en llamadas de grupo no se responde
+	if data.Rejected && !data.IsGroup && line.Config.CallRejectMsg != "" {
+		text := line.Config.CallRejectMsg
+		_, err := line.Client.SendMessage(context.Background(), evt.From.ToNonAD(), &waProto.Message{
+			Conversation: &text,
+		})
+		if err != nil {
+			log.Printf("Error al enviar mensaje de llamada rechazada en línea %s: %v", line.ID, err)
+		}
+	}
+
+	errText := ""
+	if rejectErr != nil {
+		errText = rejectErr.Error()
+	}
+	_, err := configDB.Exec(`
+		INSERT INTO call_logs (line_id, call_id, caller, is_video, is_group, rejected, error)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, line.ID, data.CallID, data.From, data.IsVideo, data.IsGroup, data.Rejected, nullIfEmpty(errText))
+	if err != nil {
+		log.Printf("Error al registrar llamada: %v", err)
+	}
+
+	emitWebhookEvent(line, EventCallOffer, data)
+}
+
+// Listar las llamadas recibidas por una línea
+func getLineCalls(w http.ResponseWriter, r *http.Request) {
+	lineID := mux.Vars(r)["id"]
+
+	limit := 50
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= 500 {
+		limit = l
+	}
+
+	query := `
+		SELECT id, line_id, call_id, caller, is_video, is_group, rejected, COALESCE(error, ''), timestamp
+		FROM call_logs
+		WHERE line_id = ?
+	`
+	args := []interface{}{lineID}
+
+	if rejected := r.URL.Query().Get("rejected"); rejected != "" {
+		query += " AND rejected = ?"
+		args = append(args, rejected == "true")
+	}
+
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := configDB.Query(query, args...)
+	if err != nil {
+		log.Printf("Error al obtener llamadas: %v", err)
+		http.Error(w, "Error al obtener llamadas", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	result := []CallLog{}
+	for rows.Next() {
+		var c CallLog
+		if err := rows.Scan(&c.ID, &c.LineID, &c.CallID, &c.Caller, &c.IsVideo, &c.IsGroup,
+			&c.Rejected, &c.Error, &c.Timestamp); err != nil {
+			log.Printf("Error al leer llamada: %v", err)
+			continue
+		}
+		result = append(result, c)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// Estadísticas de llamadas para el período y línea indicados
+func getCallStats(days int, lineID string) map[string]interface{} {
+	whereClause := "WHERE timestamp >= datetime('now', ?)"
+	args := []interface{}{periodModifier(days)}
+	if lineID != "" {
+		whereClause += " AND line_id = ?"
+		args = append(args, lineID)
+	}
+
+	var total, rejected, video int
+	err := configDB.QueryRow(`
+	SELECT
+		COUNT(*),
+		COALESCE(SUM(CASE WHEN rejected THEN 1 ELSE 0 END), 0),
+		COALESCE(SUM(CASE WHEN is_video THEN 1 ELSE 0 END), 0)
+	FROM call_logs
+	`+whereClause, args...).Scan(&total, &rejected, &video)
+	if err != nil {
+		log.Printf("Error getting call stats: %v", err)
+	}
+
+	callsPerDay := []map[string]interface{}{}
+	rows, err := configDB.Query(`
+	SELECT
+		DATE(timestamp) as date,
+		COUNT(*) as total,
+		SUM(CASE WHEN rejected THEN 1 ELSE 0 END) as rejected
+	FROM call_logs
+	`+whereClause+`
+	GROUP BY DATE(timestamp)
+	ORDER BY date ASC
+	`, args...)
+	if err != nil {
+		log.Printf("Error getting calls per day: %v", err)
+	} else {
+		defer rows.Close()
+		for rows.Next() {
+			var date string
+			var dayTotal, dayRejected int
+			if err := rows.Scan(&date, &dayTotal, &dayRejected); err == nil {
+				callsPerDay = append(callsPerDay, map[string]interface{}{
+					"date":     date,
+					"total":    dayTotal,
+					"rejected": dayRejected,
+				})
+			}
+		}
+	}
+
+	return map[string]interface{}{
+		"total":    total,
+		"rejected": rejected,
+		"voice":    total - video,
+		"video":    video,
+		"per_day":  callsPerDay,
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/store"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+// MessagingClient abstrae el transporte de WhatsApp que usa cada línea.
+// La implementación real envuelve *whatsmeow.Client; FakeClient permite
+// ejecutar la API completa sin un teléfono vinculado.
+type MessagingClient interface {
+	Connect() error
+	Disconnect()
+	IsConnected() bool
+	SendMessage(ctx context.Context, to types.JID, message *waProto.Message, extra ...whatsmeow.SendRequestExtra) (whatsmeow.SendResponse, error)
+	Upload(ctx context.Context, plaintext []byte, mediaType whatsmeow.MediaType) (whatsmeow.UploadResponse, error)
+	UploadReader(ctx context.Context, plaintext io.Reader, tempFile io.ReadWriteSeeker, mediaType whatsmeow.MediaType) (whatsmeow.UploadResponse, error)
+	Download(ctx context.Context, msg whatsmeow.DownloadableMessage) ([]byte, error)
+	MarkRead(ctx context.Context, ids []types.MessageID, timestamp time.Time, chat, sender types.JID, receiptTypeExtra ...types.ReceiptType) error
+	SendPresence(ctx context.Context, state types.Presence) error
+	SendChatPresence(ctx context.Context, jid types.JID, state types.ChatPresence, media types.ChatPresenceMedia) error
+	GetQRChannel(ctx context.Context) (<-chan whatsmeow.QRChannelItem, error)
+	PairPhone(ctx context.Context, phone string, showPushNotification bool, clientType whatsmeow.PairClientType, clientDisplayName string) (string, error)
+	AddEventHandler(handler whatsmeow.EventHandler) uint32
+	RejectCall(ctx context.Context, callFrom types.JID, callID string) error
+	BuildReaction(chat, sender types.JID, id types.MessageID, reaction string) *waProto.Message
+	BuildEdit(chat types.JID, id types.MessageID, newContent *waProto.Message) *waProto.Message
+	BuildRevoke(chat, sender types.JID, id types.MessageID) *waProto.Message
+	BuildPollCreation(name string, optionNames []string, selectableOptionCount int) *waProto.Message
+	DecryptPollVote(ctx context.Context, vote *events.Message) (*waProto.PollVoteMessage, error)
+	GetGroupInfo(ctx context.Context, jid types.JID) (*types.GroupInfo, error)
+	StoreID() *types.JID
+}
+
+// whatsmeowClient adapta *whatsmeow.Client a MessagingClient
+type whatsmeowClient struct {
+	*whatsmeow.Client
+}
+
+func (c *whatsmeowClient) StoreID() *types.JID {
+	return c.Store.ID
+}
+
+// Transporte usado para crear clientes: "whatsmeow" (por defecto) o "fake"
+var transport = os.Getenv("WHATSGO_TRANSPORT")
+
+// Crear cliente de mensajería para una línea según el transporte configurado
+func newMessagingClient(deviceStore *store.Device, lineID string) MessagingClient {
+	if transport == "fake" {
+		return NewFakeClient(deviceStore.ID)
+	}
+
+	clientLog := waLog.Stdout("Client-"+lineID, "INFO", true)
+	return &whatsmeowClient{whatsmeow.NewClient(deviceStore, clientLog)}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Tipos de evento publicados en el bus interno y transmitidos por SSE
+const (
+	BusLineStatus      = "line.status"
+	BusLineQR          = "line.qr"
+	BusLinePairingCode = "line.pairing_code"
+	BusLinePaired      = "line.paired"
+	BusLineQRTimeout   = "line.qr_timeout"
+	BusMessageReceived = "message.received"
+	BusChatUpdated     = "chat.updated"
+)
+
+const (
+	// Eventos pendientes por suscriptor; si se llena se descartan
+	busSubscriberBuffer = 64
+	// Intervalo de comentarios keep-alive en los streams SSE
+	sseHeartbeatInterval = 25 * time.Second
+)
+
+// Evento del bus interno
+type BusEvent struct {
+	ID        uint64      `json:"id,omitempty"`
+	Type      string      `json:"type"`
+	LineID    string      `json:"line_id"`
+	Timestamp time.Time   `json:"timestamp"`
+	Data      interface{} `json:"data"`
+}
+
+type busSubscriber struct {
+	ch     chan BusEvent
+	filter func(lineID string) bool
+}
+
+// EventBus reparte los eventos de las líneas entre los suscriptores
+// (streams SSE). Publish nunca bloquea: un suscriptor lento pierde eventos.
+type EventBus struct {
+	mu          sync.Mutex
+	nextID      uint64
+	subscribers map[*busSubscriber]struct{}
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{subscribers: make(map[*busSubscriber]struct{})}
+}
+
+var eventBus = NewEventBus()
+
+// Suscribirse a los eventos de las líneas que acepta filter (nil = todas).
+// La función devuelta cancela la suscripción.
+func (b *EventBus) Subscribe(filter func(lineID string) bool) (<-chan BusEvent, func()) {
+	sub := &busSubscriber{ch: make(chan BusEvent, busSubscriberBuffer), filter: filter}
+
+	b.mu.Lock()
+	b.subscribers[sub] = struct{}{}
+	b.mu.Unlock()
+
+	return sub.ch, func() {
+		b.mu.Lock()
+		delete(b.subscribers, sub)
+		b.mu.Unlock()
+	}
+}
+
+func (b *EventBus) Publish(eventType, lineID string, data interface{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.nextID++
+	evt := BusEvent{
+		ID:        b.nextID,
+		Type:      eventType,
+		LineID:    lineID,
+		Timestamp: time.Now().UTC(),
+		Data:      data,
+	}
+
+	for sub := range b.subscribers {
+		if sub.filter != nil && !sub.filter(lineID) {
+			continue
+		}
+		select {
+		case sub.ch <- evt:
+		default:
+			log.Printf("Suscriptor de eventos lento, evento %s descartado", eventType)
+		}
+	}
+}
+
+func lineStatusData(line *Line) map[string]interface{} {
+	return map[string]interface{}{
+		"status":    line.Status,
+		"available": line.Available,
+		"active":    line.Active,
+	}
+}
+
+// Publicar el estado actual de una línea
+func publishLineStatus(line *Line) {
+	eventBus.Publish(BusLineStatus, line.ID, lineStatusData(line))
+}
+
+// Stream SSE con los eventos de todas las líneas accesibles por la key
+func streamEvents(w http.ResponseWriter, r *http.Request) {
+	serveEventStream(w, r, func(lineID string) bool {
+		return canAccessLine(r, lineID)
+	}, nil)
+}
+
+// Stream SSE con los eventos de una línea. Empieza con su estado actual y,
+// si está esperando vinculación, el último código QR.
+func streamLineEvents(w http.ResponseWriter, r *http.Request) {
+	lineID := mux.Vars(r)["id"]
+
+	linesMutex.RLock()
+	line, exists := lines[lineID]
+	linesMutex.RUnlock()
+
+	if !exists {
+		http.Error(w, "Línea no encontrada", http.StatusNotFound)
+		return
+	}
+
+	initial := []BusEvent{{
+		Type:      BusLineStatus,
+		LineID:    line.ID,
+		Timestamp: time.Now().UTC(),
+		Data:      lineStatusData(line),
+	}}
+	if line.Status == "qr_pending" && line.QRCode != "" {
+		initial = append(initial, BusEvent{
+			Type:      BusLineQR,
+			LineID:    line.ID,
+			Timestamp: time.Now().UTC(),
+			Data:      map[string]interface{}{"qr_code": line.QRCode},
+		})
+	}
+
+	serveEventStream(w, r, func(id string) bool {
+		return id == lineID
+	}, initial)
+}
+
+// Transmitir eventos del bus como Server-Sent Events hasta que el cliente
+// se desconecte
+func serveEventStream(w http.ResponseWriter, r *http.Request, filter func(lineID string) bool, initial []BusEvent) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming no soportado", http.StatusInternalServerError)
+		return
+	}
+
+	events, unsubscribe := eventBus.Subscribe(filter)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	for _, evt := range initial {
+		writeSSE(w, evt)
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case evt := <-events:
+			if err := writeSSE(w, evt); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func writeSSE(w http.ResponseWriter, evt BusEvent) error {
+	data, err := json.Marshal(evt)
+	if err != nil {
+		return err
+	}
+	if evt.ID > 0 {
+		fmt.Fprintf(w, "id: %d\n", evt.ID)
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", evt.Type, data)
+	return err
+}
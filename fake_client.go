@@ -0,0 +1,550 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	waBinary "go.mau.fi/whatsmeow/binary"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// FakeSentMessage registra un mensaje enviado a través de FakeClient
+type FakeSentMessage struct {
+	ID      types.MessageID
+	To      types.JID
+	Message *waProto.Message
+	Time    time.Time
+}
+
+// FakeChatPresence registra un estado de chat (escribiendo, grabando,
+// pausa) enviado a través de FakeClient
+type FakeChatPresence struct {
+	To    types.JID
+	State types.ChatPresence
+	Media types.ChatPresenceMedia
+	Time  time.Time
+}
+
+// FakeClient es un transporte en memoria totalmente programable. No abre
+// ninguna conexión: registra lo que la aplicación envía y permite emitir
+// eventos de WhatsApp (conexión, mensajes, recibos, cierre de sesión) para
+// probar la API de extremo a extremo.
+type FakeClient struct {
+	mu        sync.Mutex
+	id        *types.JID
+	connected bool
+	handlers  map[uint32]whatsmeow.EventHandler
+	nextID    uint32
+	qrChan    chan whatsmeow.QRChannelItem
+	sent      []FakeSentMessage
+	uploads   [][]byte
+	presence  []types.Presence
+	chatState []FakeChatPresence
+	readIDs   []types.MessageID
+	rejected  []string
+	pairPhone string
+	pollVotes map[types.MessageID]*waProto.PollVoteMessage
+
+	// Contenido de la media descargable, por DirectPath
+	Media map[string][]byte
+
+	// Grupos conocidos, devueltos por GetGroupInfo
+	Groups map[types.JID]*types.GroupInfo
+
+	// Si no es nil, SendMessage y Upload devuelven este error
+	SendError   error
+	UploadError error
+}
+
+// Crear un cliente falso; id puede ser nil para simular una sesión nueva
+func NewFakeClient(id *types.JID) *FakeClient {
+	return &FakeClient{
+		id:       id,
+		handlers: make(map[uint32]whatsmeow.EventHandler),
+	}
+}
+
+func (c *FakeClient) Connect() error {
+	c.mu.Lock()
+	c.connected = true
+	paired := c.id != nil
+	c.mu.Unlock()
+
+	// Una sesión existente se conecta de inmediato, como en whatsmeow
+	if paired {
+		go c.Emit(&events.Connected{})
+	}
+	return nil
+}
+
+func (c *FakeClient) Disconnect() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.connected = false
+}
+
+func (c *FakeClient) IsConnected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.connected
+}
+
+func (c *FakeClient) SendMessage(ctx context.Context, to types.JID, message *waProto.Message, extra ...whatsmeow.SendRequestExtra) (whatsmeow.SendResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.SendError != nil {
+		return whatsmeow.SendResponse{}, c.SendError
+	}
+	if !c.connected {
+		return whatsmeow.SendResponse{}, whatsmeow.ErrNotConnected
+	}
+
+	msgID := types.MessageID(fakeMessageID())
+	if len(extra) > 0 && extra[0].ID != "" {
+		msgID = extra[0].ID
+	}
+
+	now := time.Now()
+	c.sent = append(c.sent, FakeSentMessage{ID: msgID, To: to, Message: message, Time: now})
+
+	resp := whatsmeow.SendResponse{ID: msgID, Timestamp: now}
+	if c.id != nil {
+		resp.Sender = *c.id
+	}
+	return resp, nil
+}
+
+func (c *FakeClient) Upload(ctx context.Context, plaintext []byte, mediaType whatsmeow.MediaType) (whatsmeow.UploadResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.UploadError != nil {
+		return whatsmeow.UploadResponse{}, c.UploadError
+	}
+
+	c.uploads = append(c.uploads, plaintext)
+
+	fileSHA := sha256.Sum256(plaintext)
+	mediaKey := make([]byte, 32)
+	rand.Read(mediaKey)
+	path := fmt.Sprintf("/fake/%s/%s", mediaType, hex.EncodeToString(fileSHA[:8]))
+
+	return whatsmeow.UploadResponse{
+		URL:           "https://fake.whatsgo.local" + path,
+		DirectPath:    path,
+		MediaKey:      mediaKey,
+		FileEncSHA256: fileSHA[:],
+		FileSHA256:    fileSHA[:],
+		FileLength:    uint64(len(plaintext)),
+	}, nil
+}
+
+func (c *FakeClient) UploadReader(ctx context.Context, plaintext io.Reader, tempFile io.ReadWriteSeeker, mediaType whatsmeow.MediaType) (whatsmeow.UploadResponse, error) {
+	data, err := io.ReadAll(plaintext)
+	if err != nil {
+		return whatsmeow.UploadResponse{}, err
+	}
+	return c.Upload(ctx, data, mediaType)
+}
+
+func (c *FakeClient) Download(ctx context.Context, msg whatsmeow.DownloadableMessage) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if data, ok := c.Media[msg.GetDirectPath()]; ok {
+		return data, nil
+	}
+	return nil, whatsmeow.ErrMediaDownloadFailedWith404
+}
+
+func (c *FakeClient) MarkRead(ctx context.Context, ids []types.MessageID, timestamp time.Time, chat, sender types.JID, receiptTypeExtra ...types.ReceiptType) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readIDs = append(c.readIDs, ids...)
+	return nil
+}
+
+func (c *FakeClient) SendPresence(ctx context.Context, state types.Presence) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.presence = append(c.presence, state)
+	return nil
+}
+
+func (c *FakeClient) SendChatPresence(ctx context.Context, jid types.JID, state types.ChatPresence, media types.ChatPresenceMedia) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.chatState = append(c.chatState, FakeChatPresence{To: jid, State: state, Media: media, Time: time.Now()})
+	return nil
+}
+
+func (c *FakeClient) GetQRChannel(ctx context.Context) (<-chan whatsmeow.QRChannelItem, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.id != nil {
+		return nil, whatsmeow.ErrQRStoreContainsID
+	}
+	c.qrChan = make(chan whatsmeow.QRChannelItem, 8)
+	return c.qrChan, nil
+}
+
+func (c *FakeClient) PairPhone(ctx context.Context, phone string, showPushNotification bool, clientType whatsmeow.PairClientType, clientDisplayName string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(phone) <= 6 {
+		return "", whatsmeow.ErrPhoneNumberTooShort
+	} else if strings.HasPrefix(phone, "0") {
+		return "", whatsmeow.ErrPhoneNumberIsNotInternational
+	}
+	if c.qrChan == nil {
+		return "", whatsmeow.ErrNotConnected
+	}
+
+	c.pairPhone = phone
+	code := fakeMessageID()[4:12]
+	return code[:4] + "-" + code[4:], nil
+}
+
+func (c *FakeClient) AddEventHandler(handler whatsmeow.EventHandler) uint32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nextID++
+	c.handlers[c.nextID] = handler
+	return c.nextID
+}
+
+func (c *FakeClient) RejectCall(ctx context.Context, callFrom types.JID, callID string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rejected = append(c.rejected, callID)
+	return nil
+}
+
+func (c *FakeClient) GetGroupInfo(ctx context.Context, jid types.JID) (*types.GroupInfo, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if info, ok := c.Groups[jid]; ok {
+		return info, nil
+	}
+	return nil, whatsmeow.ErrGroupNotFound
+}
+
+// Los mensajes de reacción, edición y eliminación se construyen igual que
+// en whatsmeow, sin depender de una sesión real
+
+func (c *FakeClient) buildMessageKey(chat, sender types.JID, id types.MessageID) *waProto.MessageKey {
+	fromMe := true
+	remoteJID := chat.String()
+	key := &waProto.MessageKey{FromMe: &fromMe, ID: &id, RemoteJID: &remoteJID}
+
+	own := c.StoreID()
+	if !sender.IsEmpty() && (own == nil || sender.User != own.User) {
+		fromMe = false
+		if chat.Server != types.DefaultUserServer {
+			participant := sender.ToNonAD().String()
+			key.Participant = &participant
+		}
+	}
+	return key
+}
+
+func (c *FakeClient) BuildReaction(chat, sender types.JID, id types.MessageID, reaction string) *waProto.Message {
+	timestamp := time.Now().UnixMilli()
+	return &waProto.Message{
+		ReactionMessage: &waProto.ReactionMessage{
+			Key:               c.buildMessageKey(chat, sender, id),
+			Text:              &reaction,
+			SenderTimestampMS: &timestamp,
+		},
+	}
+}
+
+func (c *FakeClient) BuildEdit(chat types.JID, id types.MessageID, newContent *waProto.Message) *waProto.Message {
+	editType := waProto.ProtocolMessage_MESSAGE_EDIT
+	timestamp := time.Now().UnixMilli()
+	return &waProto.Message{
+		EditedMessage: &waProto.FutureProofMessage{
+			Message: &waProto.Message{
+				ProtocolMessage: &waProto.ProtocolMessage{
+					Key:           c.buildMessageKey(chat, types.EmptyJID, id),
+					Type:          &editType,
+					EditedMessage: newContent,
+					TimestampMS:   &timestamp,
+				},
+			},
+		},
+	}
+}
+
+func (c *FakeClient) BuildRevoke(chat, sender types.JID, id types.MessageID) *waProto.Message {
+	revokeType := waProto.ProtocolMessage_REVOKE
+	return &waProto.Message{
+		ProtocolMessage: &waProto.ProtocolMessage{
+			Type: &revokeType,
+			Key:  c.buildMessageKey(chat, sender, id),
+		},
+	}
+}
+
+func (c *FakeClient) BuildPollCreation(name string, optionNames []string, selectableOptionCount int) *waProto.Message {
+	if selectableOptionCount < 0 || selectableOptionCount > len(optionNames) {
+		selectableOptionCount = 0
+	}
+	options := make([]*waProto.PollCreationMessage_Option, len(optionNames))
+	for i := range optionNames {
+		options[i] = &waProto.PollCreationMessage_Option{OptionName: &optionNames[i]}
+	}
+	selectable := uint32(selectableOptionCount)
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return &waProto.Message{
+		PollCreationMessage: &waProto.PollCreationMessage{
+			Name:                   &name,
+			Options:                options,
+			SelectableOptionsCount: &selectable,
+		},
+		MessageContextInfo: &waProto.MessageContextInfo{MessageSecret: secret},
+	}
+}
+
+// Los votos no van cifrados: se devuelve el voto registrado por EmitPollVote
+func (c *FakeClient) DecryptPollVote(ctx context.Context, vote *events.Message) (*waProto.PollVoteMessage, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	decrypted, ok := c.pollVotes[vote.Info.ID]
+	if !ok {
+		return nil, fmt.Errorf("voto %s desconocido", vote.Info.ID)
+	}
+	return decrypted, nil
+}
+
+func (c *FakeClient) StoreID() *types.JID {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.id
+}
+
+// Scripting
+
+// Emit entrega un evento arbitrario a todos los handlers registrados
+func (c *FakeClient) Emit(evt interface{}) {
+	c.mu.Lock()
+	handlers := make([]whatsmeow.EventHandler, 0, len(c.handlers))
+	for _, h := range c.handlers {
+		handlers = append(handlers, h)
+	}
+	c.mu.Unlock()
+
+	for _, h := range handlers {
+		h(evt)
+	}
+}
+
+// EmitQR envía un nuevo código por el canal QR abierto
+func (c *FakeClient) EmitQR(code string) {
+	c.mu.Lock()
+	qrChan := c.qrChan
+	c.mu.Unlock()
+
+	if qrChan != nil {
+		qrChan <- whatsmeow.QRChannelItem{Event: whatsmeow.QRChannelEventCode, Code: code, Timeout: 20 * time.Second}
+	}
+}
+
+// Pair simula el escaneo del QR: asigna el JID, cierra el canal QR y emite Connected
+func (c *FakeClient) Pair(jid types.JID) {
+	c.mu.Lock()
+	c.id = &jid
+	qrChan := c.qrChan
+	c.qrChan = nil
+	c.mu.Unlock()
+
+	if qrChan != nil {
+		qrChan <- whatsmeow.QRChannelSuccess
+		close(qrChan)
+	}
+	c.Emit(&events.Connected{})
+}
+
+// EmitConnected emite events.Connected
+func (c *FakeClient) EmitConnected() {
+	c.Emit(&events.Connected{})
+}
+
+// EmitLoggedOut emite events.LoggedOut y olvida la sesión
+func (c *FakeClient) EmitLoggedOut() {
+	c.mu.Lock()
+	c.id = nil
+	c.connected = false
+	c.mu.Unlock()
+
+	c.Emit(&events.LoggedOut{OnConnect: false, Reason: events.ConnectFailureLoggedOut})
+}
+
+// EmitMessage emite un mensaje entrante de texto y lo devuelve para inspección
+func (c *FakeClient) EmitMessage(sender, chat types.JID, text string) *events.Message {
+	return c.EmitRawMessage(sender, chat, &waProto.Message{Conversation: &text})
+}
+
+// EmitRawMessage emite un mensaje entrante con contenido arbitrario
+func (c *FakeClient) EmitRawMessage(sender, chat types.JID, message *waProto.Message) *events.Message {
+	evt := &events.Message{
+		Info: types.MessageInfo{
+			MessageSource: types.MessageSource{
+				Chat:    chat,
+				Sender:  sender,
+				IsGroup: chat.Server == types.GroupServer,
+			},
+			ID:        types.MessageID(fakeMessageID()),
+			Timestamp: time.Now(),
+		},
+		RawMessage: message,
+	}
+	evt.UnwrapRaw()
+	c.Emit(evt)
+	return evt
+}
+
+// EmitPollVote emite un voto entrante para la encuesta pollID con las
+// opciones elegidas; sin opciones equivale a retirar el voto
+func (c *FakeClient) EmitPollVote(voter, chat types.JID, pollID types.MessageID, options []string) *events.Message {
+	vote := &waProto.PollVoteMessage{}
+	for _, option := range options {
+		hash := sha256.Sum256([]byte(option))
+		vote.SelectedOptions = append(vote.SelectedOptions, hash[:])
+	}
+
+	id := types.MessageID(fakeMessageID())
+	c.mu.Lock()
+	if c.pollVotes == nil {
+		c.pollVotes = make(map[types.MessageID]*waProto.PollVoteMessage)
+	}
+	c.pollVotes[id] = vote
+	c.mu.Unlock()
+
+	pollJID := chat.String()
+	evt := &events.Message{
+		Info: types.MessageInfo{
+			MessageSource: types.MessageSource{
+				Chat:    chat,
+				Sender:  voter,
+				IsGroup: chat.Server == types.GroupServer,
+			},
+			ID:        id,
+			Timestamp: time.Now(),
+		},
+		Message: &waProto.Message{
+			PollUpdateMessage: &waProto.PollUpdateMessage{
+				PollCreationMessageKey: &waProto.MessageKey{ID: &pollID, RemoteJID: &pollJID},
+				Vote:                   &waProto.PollEncValue{},
+			},
+		},
+	}
+	c.Emit(evt)
+	return evt
+}
+
+// EmitReceipt emite un recibo para los mensajes indicados
+func (c *FakeClient) EmitReceipt(chat, sender types.JID, receiptType types.ReceiptType, ids ...types.MessageID) {
+	c.Emit(&events.Receipt{
+		MessageSource: types.MessageSource{
+			Chat:    chat,
+			Sender:  sender,
+			IsGroup: chat.Server == types.GroupServer,
+		},
+		MessageIDs: ids,
+		Timestamp:  time.Now(),
+		Type:       receiptType,
+	})
+}
+
+// EmitCallOffer emite una llamada entrante de voz o video y devuelve su ID
+func (c *FakeClient) EmitCallOffer(from types.JID, video bool) string {
+	callID := fakeMessageID()[4:]
+	offer := waBinary.Node{Tag: "offer", Attrs: waBinary.Attrs{"call-id": callID}}
+	if video {
+		offer.Content = []waBinary.Node{{Tag: "video"}}
+	}
+
+	c.Emit(&events.CallOffer{
+		BasicCallMeta: types.BasicCallMeta{
+			From:        from,
+			Timestamp:   time.Now(),
+			CallCreator: from,
+			CallID:      callID,
+		},
+		CallRemoteMeta: types.CallRemoteMeta{RemotePlatform: "android"},
+		Data:           &offer,
+	})
+	return callID
+}
+
+// Sent devuelve una copia de los mensajes enviados hasta ahora
+func (c *FakeClient) Sent() []FakeSentMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]FakeSentMessage(nil), c.sent...)
+}
+
+// Uploads devuelve una copia de los archivos subidos hasta ahora
+func (c *FakeClient) Uploads() [][]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([][]byte(nil), c.uploads...)
+}
+
+// Presences devuelve los estados de presencia enviados hasta ahora
+func (c *FakeClient) Presences() []types.Presence {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]types.Presence(nil), c.presence...)
+}
+
+// ChatPresences devuelve los estados de chat enviados hasta ahora
+func (c *FakeClient) ChatPresences() []FakeChatPresence {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]FakeChatPresence(nil), c.chatState...)
+}
+
+// RejectedCalls devuelve los IDs de llamadas rechazadas
+func (c *FakeClient) RejectedCalls() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.rejected...)
+}
+
+// PairingPhone devuelve el teléfono usado en la última llamada a PairPhone
+func (c *FakeClient) PairingPhone() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.pairPhone
+}
+
+// ReadIDs devuelve los IDs de mensajes marcados como leídos
+func (c *FakeClient) ReadIDs() []types.MessageID {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]types.MessageID(nil), c.readIDs...)
+}
+
+// Generar un ID de mensaje con el mismo formato que usa WhatsApp
+func fakeMessageID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return "3EB0" + strings.ToUpper(hex.EncodeToString(b))
+}
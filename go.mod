@@ -5,11 +5,13 @@ go 1.24.0
 toolchain go1.24.10
 
 require (
+	github.com/HugoSmits86/nativewebp v0.9.3
 	github.com/gorilla/mux v1.8.1
 	github.com/mattn/go-sqlite3 v1.14.32
 	github.com/rs/cors v1.11.1
 	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	go.mau.fi/whatsmeow v0.0.0-20251110110826-a121e2b9cd1e
+	golang.org/x/image v0.32.0
 	google.golang.org/protobuf v1.36.10
 )
 
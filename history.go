@@ -0,0 +1,244 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultHistoryPageSize = 50
+	maxHistoryPageSize     = 200
+)
+
+// Mensaje guardado en message_logs
+type StoredMessage struct {
+	LineID    string `json:"line_id"`
+	Direction string `json:"direction"` // "sent" o "received"
+	MessageID string `json:"message_id"`
+	Chat      string `json:"chat"`
+	Sender    string `json:"sender"`
+	Type      string `json:"type"`
+	Text      string `json:"text,omitempty"`
+	QuotedID  string `json:"quoted_id,omitempty"`
+	MediaID   string `json:"media_id,omitempty"`
+	MediaURL  string `json:"media_url,omitempty"`
+	IsGroup   bool   `json:"is_group"`
+	*DeliveryInfo
+	EditedAt  *time.Time `json:"edited_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"` // Eliminado para todos; el texto se borra
+	Reactions []Reaction `json:"reactions,omitempty"`
+	Timestamp time.Time  `json:"timestamp"`
+
+	cursor int64 // id de fila, usado para paginar
+}
+
+// Resumen de una conversación
+type ChatSummary struct {
+	Chat          string        `json:"chat"`
+	IsGroup       bool          `json:"is_group"`
+	MessageCount  int           `json:"message_count"`
+	UnreadCount   int           `json:"unread_count"`
+	AssignedTo    string        `json:"assigned_to"`
+	Status        string        `json:"status"` // "open" o "closed"
+	LastMessage   StoredMessage `json:"last_message"`
+	LastMessageAt time.Time     `json:"last_message_at"`
+}
+
+// Leer el tamaño de página y el cursor (id de fila exclusivo) de la consulta
+func historyPage(r *http.Request) (int, int64) {
+	limit := defaultHistoryPageSize
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= maxHistoryPageSize {
+		limit = l
+	}
+	cursor, _ := strconv.ParseInt(r.URL.Query().Get("cursor"), 10, 64)
+	return limit, cursor
+}
+
+const storedMessageColumns = `
+	id, line_id, direction, COALESCE(message_id, ''), COALESCE(chat_jid, ''), COALESCE(sender, ''),
+	message_type, COALESCE(message_text, ''), COALESCE(quoted_id, ''), COALESCE(media_id, ''),
+	is_group, COALESCE(status, ''), delivered_at, read_at, played_at, edited_at, revoked_at, timestamp
+`
+
+func scanStoredMessage(scanner interface{ Scan(...interface{}) error }) (StoredMessage, error) {
+	var m StoredMessage
+	var status string
+	var deliveredAt, readAt, playedAt, editedAt, revokedAt sql.NullTime
+
+	err := scanner.Scan(&m.cursor, &m.LineID, &m.Direction, &m.MessageID, &m.Chat, &m.Sender,
+		&m.Type, &m.Text, &m.QuotedID, &m.MediaID, &m.IsGroup, &status, &deliveredAt, &readAt, &playedAt,
+		&editedAt, &revokedAt, &m.Timestamp)
+	if err != nil {
+		return m, err
+	}
+
+	if editedAt.Valid {
+		m.EditedAt = &editedAt.Time
+	}
+	if revokedAt.Valid {
+		m.RevokedAt = &revokedAt.Time
+	}
+
+	if m.MediaID != "" {
+		m.MediaURL = mediaURL(m.MediaID)
+	}
+	if m.Direction == "sent" && status != "" {
+		m.DeliveryInfo = &DeliveryInfo{Status: status}
+		if deliveredAt.Valid {
+			m.DeliveredAt = &deliveredAt.Time
+		}
+		if readAt.Valid {
+			m.ReadAt = &readAt.Time
+		}
+		if playedAt.Valid {
+			m.PlayedAt = &playedAt.Time
+		}
+	}
+	return m, nil
+}
+
+// Listar las conversaciones de una línea, la más reciente primero, con su
+// estado en la bandeja. Filtros: status=open|closed, assigned_to=<agente>
+func getLineChats(w http.ResponseWriter, r *http.Request) {
+	lineID := mux.Vars(r)["id"]
+	limit, cursor := historyPage(r)
+
+	query := `
+		SELECT ` + storedMessageColumns + `, c.message_count, c.unread_count, c.assigned_to, c.chat_status
+		FROM (
+			SELECT
+				MAX(ml.id) AS last_id,
+				COUNT(*) AS message_count,
+				SUM(CASE WHEN ml.direction = 'received' AND ml.id > COALESCE(s.last_read_id, 0) THEN 1 ELSE 0 END) AS unread_count,
+				COALESCE(s.assigned_to, '') AS assigned_to,
+				COALESCE(s.status, 'open') AS chat_status
+			FROM message_logs ml
+			LEFT JOIN chat_states s ON s.line_id = ml.line_id AND s.chat_jid = ml.chat_jid
+			WHERE ml.line_id = ? AND ml.chat_jid IS NOT NULL AND ml.chat_jid != ''
+			GROUP BY ml.chat_jid
+		) c
+		JOIN message_logs m ON m.id = c.last_id
+		WHERE 1 = 1
+	`
+	args := []interface{}{lineID}
+	if cursor > 0 {
+		query += " AND c.last_id < ?"
+		args = append(args, cursor)
+	}
+	if status := r.URL.Query().Get("status"); status != "" {
+		query += " AND c.chat_status = ?"
+		args = append(args, status)
+	}
+	if assignedTo, ok := r.URL.Query()["assigned_to"]; ok {
+		query += " AND c.assigned_to = ?"
+		args = append(args, assignedTo[0])
+	}
+	query += " ORDER BY c.last_id DESC LIMIT ?"
+	args = append(args, limit+1)
+
+	rows, err := configDB.Query(query, args...)
+	if err != nil {
+		log.Printf("Error al obtener conversaciones: %v", err)
+		http.Error(w, "Error al obtener conversaciones", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	chats := []ChatSummary{}
+	for rows.Next() {
+		var chat ChatSummary
+		last, err := scanStoredMessage(scannerWithExtra{rows, []interface{}{
+			&chat.MessageCount, &chat.UnreadCount, &chat.AssignedTo, &chat.Status,
+		}})
+		if err != nil {
+			log.Printf("Error al leer conversación: %v", err)
+			continue
+		}
+		chat.Chat = last.Chat
+		chat.IsGroup = last.IsGroup
+		chat.LastMessage = last
+		chat.LastMessageAt = last.Timestamp
+		chats = append(chats, chat)
+	}
+
+	response := map[string]interface{}{"chats": chats}
+	if len(chats) > limit {
+		response["chats"] = chats[:limit]
+		response["next_cursor"] = strconv.FormatInt(chats[limit-1].LastMessage.cursor, 10)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// Listar los mensajes de una conversación, el más reciente primero
+func getChatMessages(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	lineID := vars["id"]
+	limit, cursor := historyPage(r)
+
+	chat, err := parseJID(vars["jid"])
+	if err != nil {
+		http.Error(w, "Chat inválido", http.StatusBadRequest)
+		return
+	}
+
+	query := "SELECT " + storedMessageColumns + " FROM message_logs WHERE line_id = ? AND chat_jid = ?"
+	args := []interface{}{lineID, chat.String()}
+	if cursor > 0 {
+		query += " AND id < ?"
+		args = append(args, cursor)
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit+1)
+
+	rows, err := configDB.Query(query, args...)
+	if err != nil {
+		log.Printf("Error al obtener mensajes: %v", err)
+		http.Error(w, "Error al obtener mensajes", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	messages := []StoredMessage{}
+	for rows.Next() {
+		m, err := scanStoredMessage(rows)
+		if err != nil {
+			log.Printf("Error al leer mensaje: %v", err)
+			continue
+		}
+		messages = append(messages, m)
+	}
+
+	if err := loadReactions(lineID, messages); err != nil {
+		log.Printf("Error al obtener reacciones: %v", err)
+	}
+
+	response := map[string]interface{}{
+		"chat":     chat.String(),
+		"messages": messages,
+	}
+	if len(messages) > limit {
+		response["messages"] = messages[:limit]
+		response["next_cursor"] = strconv.FormatInt(messages[limit-1].cursor, 10)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// Adapta una fila con columnas adicionales al final a scanStoredMessage
+type scannerWithExtra struct {
+	rows  *sql.Rows
+	extra []interface{}
+}
+
+func (s scannerWithExtra) Scan(dest ...interface{}) error {
+	return s.rows.Scan(append(dest, s.extra...)...)
+}
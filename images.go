@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	_ "image/png" // Para decodificar PNG
+	"log"
+
+	xdraw "golang.org/x/image/draw"
+)
+
+const (
+	// WhatsApp recomienda imágenes de máximo 1280x1280
+	imageMaxDimension = 1280
+	// Tamaño de la miniatura JPEG embebida en el mensaje
+	thumbnailMaxDimension = 72
+	thumbnailQuality      = 60
+)
+
+// Imagen lista para enviar: JPEG, dimensiones y miniatura
+type ProcessedImage struct {
+	Data      []byte
+	Width     int
+	Height    int
+	Thumbnail []byte
+}
+
+// Procesar imagen para WhatsApp: corregir la orientación EXIF, aplanar la
+// transparencia sobre blanco, reducirla si es muy grande y convertirla a
+// JPEG con su miniatura
+func processImageForWhatsApp(imageBytes []byte) (*ProcessedImage, error) {
+	img, format, err := decodeOrientedImage(imageBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	log.Printf("Imagen detectada: formato=%s, dimensiones=%dx%d, tamaño=%d bytes", format, width, height, len(imageBytes))
+
+	var finalImg image.Image = flattenOnWhite(img)
+	if width > imageMaxDimension || height > imageMaxDimension {
+		newWidth, newHeight := fitDimensions(width, height, imageMaxDimension)
+		log.Printf("Redimensionando imagen: %dx%d -> %dx%d", width, height, newWidth, newHeight)
+		finalImg = resizeImage(finalImg, newWidth, newHeight)
+	}
+
+	// Si el archivo original es muy grande, reducir calidad
+	quality := 75
+	if len(imageBytes) > 500000 { // > 500KB
+		quality = 60
+	} else if len(imageBytes) > 200000 { // > 200KB
+		quality = 70
+	}
+
+	processedBytes, err := encodeJPEG(finalImg, quality)
+	if err != nil {
+		return nil, fmt.Errorf("error al convertir imagen a JPEG: %v", err)
+	}
+	log.Printf("Imagen procesada: %d bytes -> %d bytes (JPEG calidad=%d)", len(imageBytes), len(processedBytes), quality)
+
+	// Si todavía es muy grande, reducir calidad aún más
+	if len(processedBytes) > 300000 {
+		log.Printf("Imagen aún muy grande, reduciendo calidad a 50")
+		processedBytes, err = encodeJPEG(finalImg, 50)
+		if err != nil {
+			return nil, fmt.Errorf("error al recomprimir imagen: %v", err)
+		}
+		log.Printf("Imagen recomprimida: %d bytes (JPEG calidad=50)", len(processedBytes))
+	}
+
+	thumbnail, err := jpegThumbnail(finalImg)
+	if err != nil {
+		return nil, fmt.Errorf("error al generar miniatura: %v", err)
+	}
+
+	finalBounds := finalImg.Bounds()
+	return &ProcessedImage{
+		Data:      processedBytes,
+		Width:     finalBounds.Dx(),
+		Height:    finalBounds.Dy(),
+		Thumbnail: thumbnail,
+	}, nil
+}
+
+// Generar la miniatura JPEG de una imagen en cualquier formato soportado,
+// p.ej. la que se adjunta a un video
+func thumbnailFromBytes(imageBytes []byte) ([]byte, error) {
+	img, _, err := decodeOrientedImage(imageBytes)
+	if err != nil {
+		return nil, err
+	}
+	return jpegThumbnail(flattenOnWhite(img))
+}
+
+// Miniatura JPEG pequeña para la vista previa del mensaje
+func jpegThumbnail(img image.Image) ([]byte, error) {
+	bounds := img.Bounds()
+	width, height := fitDimensions(bounds.Dx(), bounds.Dy(), thumbnailMaxDimension)
+	return encodeJPEG(resizeImage(img, width, height), thumbnailQuality)
+}
+
+func encodeJPEG(img image.Image, quality int) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Dimensiones que caben en maxDimension manteniendo la proporción; las
+// imágenes más pequeñas no se agrandan
+func fitDimensions(width, height, maxDimension int) (int, int) {
+	if width <= maxDimension && height <= maxDimension {
+		return width, height
+	}
+	if width > height {
+		return maxDimension, max(1, height*maxDimension/width)
+	}
+	return max(1, width*maxDimension/height), maxDimension
+}
+
+// Redimensionar con Catmull-Rom, que conserva la nitidez al reducir
+func resizeImage(img image.Image, width, height int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	scaleInto(dst, dst.Bounds(), img)
+	return dst
+}
+
+// Escalar img para ocupar rect dentro de dst. Con un destino NRGBA se
+// conserva el canal alfa sin premultiplicar
+func scaleInto(dst draw.Image, rect image.Rectangle, img image.Image) {
+	xdraw.CatmullRom.Scale(dst, rect, img, img.Bounds(), draw.Src, nil)
+}
+
+// Componer la imagen sobre fondo blanco: JPEG no admite transparencia y
+// las zonas transparentes de un PNG se verían negras
+func flattenOnWhite(img image.Image) *image.RGBA {
+	bounds := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Bounds(), img, bounds.Min, draw.Over)
+	return dst
+}
+
+// Decodificar una imagen aplicando la orientación EXIF de las fotos JPEG
+func decodeOrientedImage(imageBytes []byte) (image.Image, string, error) {
+	img, format, err := image.Decode(bytes.NewReader(imageBytes))
+	if err != nil {
+		return nil, "", fmt.Errorf("error al decodificar imagen: %v", err)
+	}
+	if format == "jpeg" {
+		if orientation := exifOrientation(imageBytes); orientation > 1 {
+			img = applyOrientation(img, orientation)
+		}
+	}
+	return img, format, nil
+}
+
+// Leer la etiqueta Orientation (0x0112) del bloque EXIF de un JPEG; 1 si
+// no existe
+func exifOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+
+	// Recorrer los segmentos hasta el APP1 con EXIF
+	pos := 2
+	for pos+4 <= len(data) && data[pos] == 0xFF {
+		marker := data[pos+1]
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if marker == 0xDA || length < 2 || pos+2+length > len(data) {
+			break // Comienzo de la imagen o segmento inválido
+		}
+		segment := data[pos+4 : pos+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+		pos += 2 + length
+	}
+	return 1
+}
+
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if orientation := int(order.Uint16(tiff[entry+8:])); orientation >= 1 && orientation <= 8 {
+				return orientation
+			}
+			break
+		}
+	}
+	return 1
+}
+
+// Rotar y/o reflejar la imagen según la orientación EXIF (2 a 8)
+func applyOrientation(img image.Image, orientation int) image.Image {
+	bounds := img.Bounds()
+	src := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+
+	width, height := bounds.Dx(), bounds.Dy()
+	dstWidth, dstHeight := width, height
+	if orientation >= 5 {
+		// 5 a 8 rotan 90°: se intercambian ancho y alto
+		dstWidth, dstHeight = height, width
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // Reflejo horizontal
+				dx, dy = width-1-x, y
+			case 3: // 180°
+				dx, dy = width-1-x, height-1-y
+			case 4: // Reflejo vertical
+				dx, dy = x, height-1-y
+			case 5: // Transpuesta
+				dx, dy = y, x
+			case 6: // 90° horario
+				dx, dy = height-1-y, x
+			case 7: // Transversa
+				dx, dy = height-1-y, width-1-x
+			case 8: // 90° antihorario
+				dx, dy = y, width-1-x
+			default:
+				dx, dy = x, y
+			}
+			copy(dst.Pix[dst.PixOffset(dx, dy):dst.PixOffset(dx, dy)+4], src.Pix[src.PixOffset(x, y):src.PixOffset(x, y)+4])
+		}
+	}
+	return dst
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Estados de una conversación en la bandeja compartida
+const (
+	ChatStatusOpen   = "open"
+	ChatStatusClosed = "closed"
+)
+
+// Estado de bandeja de una conversación, guardado en chat_states
+type ChatState struct {
+	LineID     string `json:"line_id"`
+	Chat       string `json:"chat"`
+	AssignedTo string `json:"assigned_to"`
+	Status     string `json:"status"`
+}
+
+// Registrar actividad en una conversación: un mensaje entrante reabre el
+// chat si estaba cerrado, y en ambos sentidos se avisa a la bandeja
+func chatActivity(msg StoredMessage) {
+	if msg.Direction == "received" {
+		_, err := configDB.Exec(`
+			UPDATE chat_states SET status = ?, updated_at = CURRENT_TIMESTAMP
+			WHERE line_id = ? AND chat_jid = ? AND status = ?
+		`, ChatStatusOpen, msg.LineID, msg.Chat, ChatStatusClosed)
+		if err != nil {
+			log.Printf("Error al reabrir chat %s: %v", msg.Chat, err)
+		}
+	}
+
+	eventBus.Publish(BusChatUpdated, msg.LineID, map[string]string{
+		"chat":       msg.Chat,
+		"message_id": msg.MessageID,
+		"direction":  msg.Direction,
+	})
+}
+
+// Obtener el estado de bandeja de un chat; abierto y sin asignar si no existe
+func getChatState(lineID, chat string) (ChatState, error) {
+	state := ChatState{LineID: lineID, Chat: chat, Status: ChatStatusOpen}
+	err := configDB.QueryRow(`
+		SELECT COALESCE(assigned_to, ''), status FROM chat_states WHERE line_id = ? AND chat_jid = ?
+	`, lineID, chat).Scan(&state.AssignedTo, &state.Status)
+	if err != nil && err != sql.ErrNoRows {
+		return state, err
+	}
+	return state, nil
+}
+
+// Asignar un chat a un agente y/o cambiar su estado
+func updateChatState(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	lineID := vars["id"]
+
+	chat, err := parseJID(vars["jid"])
+	if err != nil {
+		http.Error(w, "Chat inválido", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		AssignedTo *string `json:"assigned_to"`
+		Status     *string `json:"status"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Status != nil && *req.Status != ChatStatusOpen && *req.Status != ChatStatusClosed {
+		http.Error(w, "Status debe ser 'open' o 'closed'", http.StatusBadRequest)
+		return
+	}
+
+	state, err := getChatState(lineID, chat.String())
+	if err != nil {
+		log.Printf("Error al obtener estado de chat: %v", err)
+		http.Error(w, "Error al obtener chat", http.StatusInternalServerError)
+		return
+	}
+
+	if req.AssignedTo != nil {
+		state.AssignedTo = strings.TrimSpace(*req.AssignedTo)
+	}
+	if req.Status != nil {
+		state.Status = *req.Status
+	}
+
+	_, err = configDB.Exec(`
+		INSERT INTO chat_states (line_id, chat_jid, assigned_to, status, updated_at)
+		VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(line_id, chat_jid) DO UPDATE SET
+			assigned_to = excluded.assigned_to,
+			status = excluded.status,
+			updated_at = excluded.updated_at
+	`, lineID, state.Chat, state.AssignedTo, state.Status)
+	if err != nil {
+		log.Printf("Error al guardar estado de chat: %v", err)
+		http.Error(w, "Error al actualizar chat", http.StatusInternalServerError)
+		return
+	}
+
+	eventBus.Publish(BusChatUpdated, lineID, map[string]string{
+		"chat":        state.Chat,
+		"assigned_to": state.AssignedTo,
+		"status":      state.Status,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
+
+// Marcar como leídos todos los mensajes de un chat en la bandeja
+func markChatRead(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	lineID := vars["id"]
+
+	chat, err := parseJID(vars["jid"])
+	if err != nil {
+		http.Error(w, "Chat inválido", http.StatusBadRequest)
+		return
+	}
+
+	_, err = configDB.Exec(`
+		INSERT INTO chat_states (line_id, chat_jid, status, last_read_id, updated_at)
+		SELECT ?, ?, ?, MAX(id), CURRENT_TIMESTAMP
+		FROM message_logs WHERE line_id = ? AND chat_jid = ?
+		ON CONFLICT(line_id, chat_jid) DO UPDATE SET
+			last_read_id = excluded.last_read_id,
+			updated_at = excluded.updated_at
+	`, lineID, chat.String(), ChatStatusOpen, lineID, chat.String())
+	if err != nil {
+		log.Printf("Error al marcar chat como leído: %v", err)
+		http.Error(w, "Error al marcar chat como leído", http.StatusInternalServerError)
+		return
+	}
+
+	eventBus.Publish(BusChatUpdated, lineID, map[string]interface{}{
+		"chat":   chat.String(),
+		"unread": 0,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"chat":   chat.String(),
+		"unread": 0,
+	})
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Estrategias de selección de línea para send-auto
+const (
+	StrategyLeastRecent    = "least_recent"     // La que lleva más tiempo sin usarse
+	StrategyRoundRobin     = "round_robin"      // Por turnos, en orden de ID
+	StrategyLeastUsedToday = "least_used_today" // La que menos mensajes ha enviado hoy
+	StrategyWeighted       = "weighted"         // Proporcional a la capacidad de cada línea
+	StrategyRandom         = "random"           // Al azar
+	StrategySticky         = "sticky"           // La última línea que habló con el destinatario
+)
+
+// Elige una línea entre las candidatas (conectadas, activas y accesibles)
+// para enviar la solicitud. Devuelve nil si ninguna sirve
+type LineSelector interface {
+	Select(candidates []*Line, req MessageRequest) *Line
+}
+
+var lineSelectors = map[string]LineSelector{
+	StrategyLeastRecent:    leastRecentSelector{},
+	StrategyRoundRobin:     &roundRobinSelector{},
+	StrategyLeastUsedToday: leastUsedTodaySelector{},
+	StrategyWeighted:       &weightedSelector{current: make(map[string]int)},
+	StrategyRandom:         randomSelector{},
+	StrategySticky:         stickySelector{fallback: leastRecentSelector{}},
+}
+
+// Estrategia usada cuando la solicitud no indica ninguna
+var defaultLineStrategy = envOrDefault("WHATSGO_LINE_STRATEGY", StrategyLeastRecent)
+
+// Obtener el selector de una estrategia; vacío = la estrategia por defecto
+func lineSelectorFor(strategy string) (LineSelector, error) {
+	if strategy == "" {
+		strategy = defaultLineStrategy
+	}
+	selector, ok := lineSelectors[strategy]
+	if !ok {
+		return nil, fmt.Errorf("Estrategia desconocida: %s", strategy)
+	}
+	return selector, nil
+}
+
+// Validar WHATSGO_LINE_STRATEGY al arrancar; si no existe se usa la de por defecto
+func initLineStrategy() {
+	if _, ok := lineSelectors[defaultLineStrategy]; !ok {
+		log.Printf("WHATSGO_LINE_STRATEGY desconocida (%s), usando %s", defaultLineStrategy, StrategyLeastRecent)
+		defaultLineStrategy = StrategyLeastRecent
+	}
+	log.Printf("Estrategia de selección de línea: %s", defaultLineStrategy)
+}
+
+// La línea usada hace más tiempo
+type leastRecentSelector struct{}
+
+func (leastRecentSelector) Select(candidates []*Line, req MessageRequest) *Line {
+	var selected *Line
+	for _, line := range candidates {
+		if selected == nil || line.LastUsed.Before(selected.LastUsed) {
+			selected = line
+		}
+	}
+	return selected
+}
+
+// Por turnos. Las candidatas se ordenan por ID para que el turno no dependa
+// del orden del mapa de líneas
+type roundRobinSelector struct {
+	mu   sync.Mutex
+	next uint64
+}
+
+func (s *roundRobinSelector) Select(candidates []*Line, req MessageRequest) *Line {
+	if len(candidates) == 0 {
+		return nil
+	}
+	sorted := sortedByID(candidates)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	line := sorted[s.next%uint64(len(sorted))]
+	s.next++
+	return line
+}
+
+// La línea con menos mensajes enviados desde el comienzo del día (hora
+// local), contados como en el límite diario; a igualdad, la usada hace más
+// tiempo
+type leastUsedTodaySelector struct{}
+
+func (leastUsedTodaySelector) Select(candidates []*Line, req MessageRequest) *Line {
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	counts, err := messagesSentToday(candidates)
+	if err != nil {
+		log.Printf("Error al contar envíos del día: %v", err)
+		return leastRecentSelector{}.Select(candidates, req)
+	}
+
+	var selected *Line
+	for _, line := range candidates {
+		if selected == nil || counts[line.ID] < counts[selected.ID] ||
+			(counts[line.ID] == counts[selected.ID] && line.LastUsed.Before(selected.LastUsed)) {
+			selected = line
+		}
+	}
+	return selected
+}
+
+// Mensajes enviados hoy por línea. Se cuentan por sent_at, como sentSince,
+// para coincidir con el límite diario
+func messagesSentToday(candidates []*Line) (map[string]int, error) {
+	placeholders := make([]string, len(candidates))
+	args := []interface{}{QueueStatusSent, startOfToday().UTC()}
+	for i, line := range candidates {
+		placeholders[i] = "?"
+		args = append(args, line.ID)
+	}
+
+	rows, err := configDB.Query(`
+		SELECT line_id, COUNT(*) FROM outbound_queue
+		WHERE status = ? AND sent_at >= ? AND line_id IN (`+strings.Join(placeholders, ",")+`)
+		GROUP BY line_id
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var lineID string
+		var count int
+		if err := rows.Scan(&lineID, &count); err != nil {
+			return nil, err
+		}
+		counts[lineID] = count
+	}
+	return counts, rows.Err()
+}
+
+// Round-robin ponderado suave (como el de nginx): cada línea recibe una
+// parte de los envíos proporcional a su capacidad, sin ráfagas seguidas
+// por la misma línea
+type weightedSelector struct {
+	mu      sync.Mutex
+	current map[string]int
+}
+
+func (s *weightedSelector) Select(candidates []*Line, req MessageRequest) *Line {
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var selected *Line
+	total := 0
+	current := make(map[string]int, len(candidates))
+	for _, line := range sortedByID(candidates) {
+		weight := lineCapacity(line)
+		total += weight
+		current[line.ID] = s.current[line.ID] + weight
+		if selected == nil || current[line.ID] > current[selected.ID] {
+			selected = line
+		}
+	}
+	current[selected.ID] -= total
+
+	// Solo se conserva el estado de las candidatas: las líneas borradas o
+	// desconectadas no acumulan entradas ni ventaja para cuando vuelvan
+	s.current = current
+	return selected
+}
+
+// Capacidad configurada de la línea; 0 o negativa cuenta como 1
+func lineCapacity(line *Line) int {
+	if line.Config.Capacity < 1 {
+		return 1
+	}
+	return line.Config.Capacity
+}
+
+type randomSelector struct{}
+
+func (randomSelector) Select(candidates []*Line, req MessageRequest) *Line {
+	if len(candidates) == 0 {
+		return nil
+	}
+	return candidates[rand.Intn(len(candidates))]
+}
+
+// La línea que intercambió el último mensaje con el destinatario, si está
+// entre las candidatas; si no, se usa la estrategia de respaldo
+type stickySelector struct {
+	fallback LineSelector
+}
+
+func (s stickySelector) Select(candidates []*Line, req MessageRequest) *Line {
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	if recipient, err := parseJID(req.To); err == nil {
+		placeholders := make([]string, len(candidates))
+		args := []interface{}{recipient.String()}
+		byID := make(map[string]*Line, len(candidates))
+		for i, line := range candidates {
+			placeholders[i] = "?"
+			args = append(args, line.ID)
+			byID[line.ID] = line
+		}
+
+		var lineID string
+		err := configDB.QueryRow(`
+			SELECT line_id FROM message_logs
+			WHERE chat_jid = ? AND line_id IN (`+strings.Join(placeholders, ",")+`)
+			ORDER BY id DESC LIMIT 1
+		`, args...).Scan(&lineID)
+		if err == nil {
+			return byID[lineID]
+		}
+	}
+
+	return s.fallback.Select(candidates, req)
+}
+
+func sortedByID(candidates []*Line) []*Line {
+	sorted := append([]*Line(nil), candidates...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID < sorted[j].ID })
+	return sorted
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Base de datos de configuración en memoria, propia de cada test
+func setupSelectorDB(t *testing.T) {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", "file:"+t.Name()+"?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatalf("Error al abrir base de datos: %v", err)
+	}
+	db.SetMaxOpenConns(1)
+
+	previous := configDB
+	configDB = db
+	t.Cleanup(func() {
+		db.Close()
+		configDB = previous
+	})
+
+	if err := initConfigDatabase(); err != nil {
+		t.Fatalf("Error al inicializar base de datos: %v", err)
+	}
+}
+
+func testLines(ids ...string) []*Line {
+	lines := make([]*Line, len(ids))
+	for i, id := range ids {
+		lines[i] = &Line{ID: id}
+	}
+	return lines
+}
+
+// Registrar n envíos de la línea en la cola de salida
+func queueSends(t *testing.T, lineID string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		_, err := configDB.Exec(`
+			INSERT INTO outbound_queue (id, line_id, recipient, request, status, created_at, sent_at)
+			VALUES (?, ?, '5491100000000', '{}', ?, ?, ?)
+		`, fmt.Sprintf("%s_%d", lineID, i), lineID, QueueStatusSent, time.Now().UTC(), time.Now().UTC())
+		if err != nil {
+			t.Fatalf("Error al encolar envío: %v", err)
+		}
+	}
+}
+
+func TestRoundRobinSelectorOrder(t *testing.T) {
+	selector := &roundRobinSelector{}
+	// El orden de las candidatas no importa: el turno sigue el orden de ID
+	candidates := testLines("line_c", "line_a", "line_b")
+
+	want := []string{"line_a", "line_b", "line_c", "line_a", "line_b", "line_c"}
+	for i, id := range want {
+		if got := selector.Select(candidates, MessageRequest{}); got.ID != id {
+			t.Fatalf("Envío %d: se eligió %s, se esperaba %s", i, got.ID, id)
+		}
+	}
+
+	if got := selector.Select(nil, MessageRequest{}); got != nil {
+		t.Fatalf("Sin candidatas se eligió %s", got.ID)
+	}
+}
+
+func TestWeightedSelectorDistribution(t *testing.T) {
+	selector := &weightedSelector{current: make(map[string]int)}
+	candidates := testLines("line_a", "line_b", "line_c")
+	candidates[0].Config.Capacity = 3
+	candidates[1].Config.Capacity = 1
+	candidates[2].Config.Capacity = 0 // Cuenta como 1
+
+	counts := make(map[string]int)
+	var sequence []string
+	for i := 0; i < 50; i++ {
+		line := selector.Select(candidates, MessageRequest{})
+		counts[line.ID]++
+		sequence = append(sequence, line.ID)
+	}
+
+	want := map[string]int{"line_a": 30, "line_b": 10, "line_c": 10}
+	for id, n := range want {
+		if counts[id] != n {
+			t.Errorf("%s: %d envíos, se esperaban %d", id, counts[id], n)
+		}
+	}
+
+	// Suave: la línea de mayor capacidad no envía más de dos veces seguidas
+	for i := 2; i < len(sequence); i++ {
+		if sequence[i] == sequence[i-1] && sequence[i] == sequence[i-2] {
+			t.Fatalf("Ráfaga de %s en los envíos %d-%d: %v", sequence[i], i-2, i, sequence[:10])
+		}
+	}
+
+	// Las líneas que dejan de ser candidatas no conservan estado
+	selector.Select(candidates[:1], MessageRequest{})
+	if len(selector.current) != 1 {
+		t.Fatalf("Estado de %d líneas, se esperaba solo el de line_a: %v", len(selector.current), selector.current)
+	}
+}
+
+func TestLeastUsedTodaySelectorTieBreak(t *testing.T) {
+	setupSelectorDB(t)
+
+	now := time.Now()
+	candidates := testLines("line_a", "line_b", "line_c")
+	candidates[0].LastUsed = now.Add(-3 * time.Minute)
+	candidates[1].LastUsed = now.Add(-2 * time.Minute)
+	candidates[2].LastUsed = now.Add(-1 * time.Minute)
+
+	queueSends(t, "line_a", 2)
+	queueSends(t, "line_b", 1)
+	queueSends(t, "line_c", 1)
+
+	// Los mensajes que aún no salieron no cuentan, como en el límite diario
+	_, err := configDB.Exec(`
+		INSERT INTO outbound_queue (id, line_id, recipient, request, status, created_at)
+		VALUES ('line_b_queued', 'line_b', '5491100000000', '{}', ?, ?)
+	`, QueueStatusQueued, now.UTC())
+	if err != nil {
+		t.Fatalf("Error al encolar envío: %v", err)
+	}
+
+	// line_b y line_c empatan con un envío: gana la usada hace más tiempo
+	if got := (leastUsedTodaySelector{}).Select(candidates, MessageRequest{}); got.ID != "line_b" {
+		t.Fatalf("Se eligió %s, se esperaba line_b", got.ID)
+	}
+
+	// Una línea sin envíos hoy gana aunque se haya usado hace poco
+	candidates = append(candidates, &Line{ID: "line_d", LastUsed: now})
+	if got := (leastUsedTodaySelector{}).Select(candidates, MessageRequest{}); got.ID != "line_d" {
+		t.Fatalf("Se eligió %s, se esperaba line_d", got.ID)
+	}
+}
+
+func TestStickySelector(t *testing.T) {
+	setupSelectorDB(t)
+
+	now := time.Now()
+	candidates := testLines("line_a", "line_b")
+	candidates[0].LastUsed = now
+	candidates[1].LastUsed = now.Add(-time.Hour)
+
+	for _, msg := range []StoredMessage{
+		{LineID: "line_b", Direction: "received", MessageID: "m1", Chat: "5491111111111@s.whatsapp.net", Sender: "5491111111111@s.whatsapp.net", Type: "text"},
+		{LineID: "line_a", Direction: "sent", MessageID: "m2", Chat: "5491111111111@s.whatsapp.net", Sender: "5491999999999@s.whatsapp.net", Type: "text"},
+		{LineID: "line_x", Direction: "sent", MessageID: "m3", Chat: "5492222222222@s.whatsapp.net", Sender: "5491999999999@s.whatsapp.net", Type: "text"},
+	} {
+		if err := logMessage(msg); err != nil {
+			t.Fatalf("Error al registrar mensaje: %v", err)
+		}
+	}
+
+	selector := stickySelector{fallback: leastRecentSelector{}}
+
+	// La última línea que habló con el destinatario
+	if got := selector.Select(candidates, MessageRequest{To: "5491111111111"}); got.ID != "line_a" {
+		t.Fatalf("Se eligió %s, se esperaba line_a", got.ID)
+	}
+
+	// Si esa línea no está entre las candidatas se usa la anterior
+	if got := selector.Select(candidates[1:], MessageRequest{To: "5491111111111"}); got.ID != "line_b" {
+		t.Fatalf("Se eligió %s, se esperaba line_b", got.ID)
+	}
+
+	// Sin historial con las candidatas, la de respaldo (least_recent)
+	if got := selector.Select(candidates, MessageRequest{To: "5492222222222"}); got.ID != "line_b" {
+		t.Fatalf("Se eligió %s, se esperaba line_b (respaldo)", got.ID)
+	}
+	if got := selector.Select(candidates, MessageRequest{To: "5493333333333"}); got.ID != "line_b" {
+		t.Fatalf("Se eligió %s, se esperaba line_b (respaldo)", got.ID)
+	}
+}
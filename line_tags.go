@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// Pool y etiquetas de una línea. Los campos omitidos no se modifican
+type LineTagsRequest struct {
+	Pool *string   `json:"pool,omitempty"`
+	Tags *[]string `json:"tags,omitempty"`
+}
+
+// Longitud máxima de una etiqueta o nombre de pool
+const maxTagLength = 64
+
+// Normalizar una etiqueta o nombre de pool: sin espacios a los lados y en
+// minúsculas. Solo se admiten letras, números y "-", "_", ":" y "."; las
+// comas, en particular, separan las etiquetas en la DB
+func normalizeTag(tag string) (string, error) {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if utf8.RuneCountInString(tag) > maxTagLength {
+		return "", fmt.Errorf("Etiqueta demasiado larga (máximo %d caracteres): %s", maxTagLength, tag)
+	}
+	if !validTag(tag) {
+		return "", fmt.Errorf("Etiqueta inválida: %s (solo letras, números, \"-\", \"_\", \":\" y \".\")", tag)
+	}
+	return tag, nil
+}
+
+func validTag(tag string) bool {
+	for _, c := range tag {
+		if !unicode.IsLetter(c) && !unicode.IsDigit(c) && !strings.ContainsRune("-_:.", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// Normalizar una lista de etiquetas descartando vacías y repetidas
+func normalizeTags(tags []string) ([]string, error) {
+	result := []string{}
+	seen := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		tag, err := normalizeTag(tag)
+		if err != nil {
+			return nil, err
+		}
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		result = append(result, tag)
+	}
+	return result, nil
+}
+
+// Aplicar pool y etiquetas a una línea
+func applyLineTags(line *Line, req LineTagsRequest) error {
+	if req.Pool != nil {
+		pool, err := normalizeTag(*req.Pool)
+		if err != nil {
+			return err
+		}
+		line.Pool = pool
+	}
+	if req.Tags != nil {
+		tags, err := normalizeTags(*req.Tags)
+		if err != nil {
+			return err
+		}
+		line.Tags = tags
+	}
+	return nil
+}
+
+// Normalizar los filtros de pool y etiquetas de una consulta, con las
+// mismas reglas que al asignarlos
+func normalizeTagFilter(pool string, tags []string) (string, []string, error) {
+	pool, err := normalizeTag(pool)
+	if err != nil {
+		return "", nil, err
+	}
+	tags, err = normalizeTags(tags)
+	if err != nil {
+		return "", nil, err
+	}
+	return pool, tags, nil
+}
+
+// Indica si la línea pertenece al pool y tiene todas las etiquetas pedidas,
+// ya normalizados. Un pool vacío y una lista vacía no filtran
+func lineMatches(line *Line, pool string, tags []string) bool {
+	if pool != "" && line.Pool != pool {
+		return false
+	}
+	for _, tag := range tags {
+		found := false
+		for _, lineTag := range line.Tags {
+			if lineTag == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Cambiar el pool y/o las etiquetas de una línea
+func setLineTags(w http.ResponseWriter, r *http.Request) {
+	lineID := mux.Vars(r)["id"]
+
+	var req LineTagsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	linesMutex.Lock()
+	defer linesMutex.Unlock()
+
+	line, exists := lines[lineID]
+	if !exists {
+		http.Error(w, "Línea no encontrada", http.StatusNotFound)
+		return
+	}
+
+	if err := applyLineTags(line, req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := saveLineToDB(line); err != nil {
+		log.Printf("Error al guardar línea en DB: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Etiquetas actualizadas",
+		"pool":    line.Pool,
+		"tags":    line.Tags,
+	})
+}
@@ -1,18 +1,18 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"database/sql"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"image"
-	"image/jpeg"
-	_ "image/png" // Para decodificar PNG
+	"io"
 	"log"
+	"math"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -36,42 +36,85 @@ type LineConfig struct {
 	AutoMarkRead    bool   `json:"auto_mark_read"`
 	AlwaysOnline    bool   `json:"always_online"`
 	AutoReplyMsg    string `json:"auto_reply_msg"`
+	CallRejectMsg   string `json:"call_reject_msg"` // Texto enviado al rechazar una llamada
+	Capacity        int    `json:"capacity"`        // Peso de la línea en la estrategia "weighted"
+	SimulateTyping  bool   `json:"simulate_typing"` // Mostrar "escribiendo..." antes de cada envío
 }
 
 type Line struct {
-	ID         string            `json:"id"`
-	Name       string            `json:"name"`
-	Status     string            `json:"status"` // "disconnected", "qr_pending", "connected"
-	QRCode     string            `json:"qr_code,omitempty"`
-	Client     *whatsmeow.Client `json:"-"`
-	WebhookURL string            `json:"webhook_url,omitempty"`
-	Available  bool              `json:"available"`
-	LastUsed   time.Time         `json:"last_used"`
-	Config     LineConfig        `json:"config"`
-	Active     bool              `json:"active"` // Si la línea está activa o pausada
+	ID         string          `json:"id"`
+	Name       string          `json:"name"`
+	Status     string          `json:"status"` // "disconnected", "qr_pending", "pair_pending", "connected"
+	QRCode     string          `json:"qr_code,omitempty"`
+	Client     MessagingClient `json:"-"`
+	WebhookURL string          `json:"webhook_url,omitempty"`
+	Available  bool            `json:"available"`
+	LastUsed   time.Time       `json:"last_used"`
+	Config     LineConfig      `json:"config"`
+	Active     bool            `json:"active"` // Si la línea está activa o pausada
+
+	// Agrupación para send-auto: pool (p.ej. un departamento) y etiquetas libres
+	Pool string   `json:"pool,omitempty"`
+	Tags []string `json:"tags,omitempty"`
+
+	// Límites y ritmo de envío
+	Limits RateLimits `json:"limits"`
+	// Calentamiento del número; nil = sin calentamiento
+	Warmup *LineWarmup `json:"warmup,omitempty"`
+
+	// Código de vinculación por teléfono mientras status es "pair_pending"
+	PairingCode string `json:"pairing_code,omitempty"`
+
+	// Entrega de webhooks; el secreto de firma nunca se serializa
+	WebhookSecret      string `json:"-"`
+	WebhookTimeout     int    `json:"webhook_timeout,omitempty"`      // Segundos por intento
+	WebhookMaxAttempts int    `json:"webhook_max_attempts,omitempty"` // Intentos antes de descartar
+	// Eventos a los que está suscrito el webhook; vacío = todos
+	WebhookEvents []string `json:"webhook_events,omitempty"`
+
+	queueNotify chan struct{}      // Despierta a los workers de envío
+	stopWorkers context.CancelFunc // Detiene los workers de envío
 }
 
 type MessageRequest struct {
-	From      string `json:"from,omitempty"`
-	To        string `json:"to"`
-	Message   string `json:"message"`
-	MediaType string `json:"media_type,omitempty"` // "text", "image", "audio", "voice", "document", "video"
-	MediaData string `json:"media_data,omitempty"` // Base64 encoded media
-	FileName  string `json:"file_name,omitempty"`  // Nombre del archivo
-	Caption   string `json:"caption,omitempty"`    // Caption para media
-	MimeType  string `json:"mime_type,omitempty"`  // MIME type del archivo
-}
-
-type WebhookPayload struct {
-	From    string `json:"from"`
-	To      string `json:"to"`
-	Message string `json:"message"`
-	LineID  string `json:"line_id"`
+	From      string        `json:"from,omitempty"`
+	To        string        `json:"to"`
+	Message   string        `json:"message"`
+	MediaType string        `json:"media_type,omitempty"` // "text", "image", "sticker", "audio", "voice", "document", "video", "location", "contact", "poll"
+	MediaData string        `json:"media_data,omitempty"` // Base64 encoded media
+	MediaURL  string        `json:"media_url,omitempty"`  // URL desde la que el servidor descarga el archivo
+	Thumbnail string        `json:"thumbnail,omitempty"`  // Imagen base64 para la vista previa de un video
+	FileName  string        `json:"file_name,omitempty"`  // Nombre del archivo
+	Caption   string        `json:"caption,omitempty"`    // Caption para media
+	MimeType  string        `json:"mime_type,omitempty"`  // MIME type del archivo
+	Async     bool          `json:"async,omitempty"`      // Responder 202 al encolar sin esperar el envío
+	ReplyTo   *ReplyTo      `json:"reply_to,omitempty"`   // Mensaje citado
+	Mentions  []string      `json:"mentions,omitempty"`   // Números mencionados con @
+	Location  *LocationData `json:"location,omitempty"`   // Para media_type "location"
+	Contacts  []ContactCard `json:"contacts,omitempty"`   // Para media_type "contact"
+	Poll      *PollRequest  `json:"poll,omitempty"`       // Para media_type "poll"
+	Strategy  string        `json:"strategy,omitempty"`   // Selección de línea en send-auto
+	Pool      string        `json:"pool,omitempty"`       // send-auto: solo líneas de este pool
+	Tags      []string      `json:"tags,omitempty"`       // send-auto: solo líneas con todas estas etiquetas
+	OnLimit   string        `json:"on_limit,omitempty"`   // "queue" o "reject" si la línea superó sus límites
+	// Simular escritura antes del envío; nil = según la configuración de la línea
+	SimulateTyping *bool `json:"simulate_typing,omitempty"`
+
+	// Archivo temporal con la media recibida por media_url o multipart
+	mediaFile string
+	// MIME type sugerido por el origen del archivo, si el contenido no lo revela
+	mimeHint string
 }
 
 type WebhookConfig struct {
-	LineID string `json:"line_id"`
-	URL    string `json:"url"`
+	LineID           string `json:"line_id"`
+	URL              string `json:"url"`
+	Secret           string `json:"secret,omitempty"`            // Vacío = conservar o generar uno
+	RegenerateSecret bool   `json:"regenerate_secret,omitempty"` // Generar un secreto nuevo
+	Timeout          int    `json:"timeout,omitempty"`           // Segundos por intento
+	MaxAttempts      int    `json:"max_attempts,omitempty"`
+	// Eventos suscritos (p.ej. "message.*", "call.offer"); nil = conservar, vacío = todos
+	Events *[]string `json:"events,omitempty"`
 }
 
 var (
@@ -88,7 +131,7 @@ func main() {
 
 	// Inicializar base de datos de configuración
 	var err error
-	configDB, err = sql.Open("sqlite3", "./sessions/config.db")
+	configDB, err = sql.Open("sqlite3", "./sessions/config.db?_busy_timeout=5000&_journal_mode=WAL")
 	if err != nil {
 		log.Fatalf("Error al abrir base de datos de configuración: %v", err)
 	}
@@ -100,6 +143,21 @@ func main() {
 		log.Fatalf("Error al inicializar base de datos: %v", err)
 	}
 
+	// Recuperar envíos interrumpidos por un reinicio
+	err = recoverOutboundQueue()
+	if err != nil {
+		log.Printf("Advertencia al recuperar cola de envío: %v", err)
+	}
+
+	// Eliminar periódicamente la media recibida y las entregas de webhooks
+	// que superaron la retención
+	startMediaRetention()
+	startWebhookRetention()
+
+	// Estrategia por defecto de send-auto
+	initLineStrategy()
+	initWarmupProfile()
+
 	// Inicializar contenedor de base de datos de WhatsApp
 	dbLog := waLog.Stdout("Database", "INFO", true)
 	container, err = sqlstore.New(context.Background(), "sqlite3", "file:./sessions/whatsapp.db?_foreign_keys=on", dbLog)
@@ -113,39 +171,79 @@ func main() {
 		log.Printf("Advertencia al cargar líneas: %v", err)
 	}
 
+	// Retomar los reintentos de webhooks interrumpidos por un reinicio
+	err = recoverWebhookDeliveries()
+	if err != nil {
+		log.Printf("Advertencia al recuperar entregas de webhook: %v", err)
+	}
+
+	handler := newRouter()
+
+	port := "12021"
+	log.Printf("Servidor iniciado en http://localhost:%s", port)
+	log.Fatal(http.ListenAndServe(":"+port, handler))
+}
+
+// Construir el router HTTP con la API, los archivos estáticos y CORS
+func newRouter() http.Handler {
 	router := mux.NewRouter()
 
 	// API Endpoints
 	api := router.PathPrefix("/api").Subrouter()
-	api.HandleFunc("/lines", createLine).Methods("POST")
-	api.HandleFunc("/lines", getLines).Methods("GET")
-	api.HandleFunc("/lines/{id}", getLine).Methods("GET")
-	api.HandleFunc("/lines/{id}/qr", getQRCode).Methods("GET")
-	api.HandleFunc("/lines/{id}", deleteLine).Methods("DELETE")
-	api.HandleFunc("/lines/{id}/webhook", setWebhook).Methods("POST")
-	api.HandleFunc("/lines/{id}/config", updateLineConfig).Methods("PUT")
-	api.HandleFunc("/lines/{id}/toggle", toggleLineActive).Methods("POST")
-	api.HandleFunc("/lines/{id}/reconnect", reconnectLine).Methods("POST")
-	api.HandleFunc("/messages/send", sendMessage).Methods("POST")
-	api.HandleFunc("/messages/send-auto", sendMessageAuto).Methods("POST")
-	api.HandleFunc("/stats", getStats).Methods("GET")
+	api.Use(apiKeyMiddleware)
+	api.HandleFunc("/keys", requireScope(ScopeKeysAdmin, createAPIKey)).Methods("POST")
+	api.HandleFunc("/keys", requireScope(ScopeKeysAdmin, getAPIKeys)).Methods("GET")
+	api.HandleFunc("/keys/{key_id}", requireScope(ScopeKeysAdmin, revokeAPIKey)).Methods("DELETE")
+	api.HandleFunc("/lines", requireScope(ScopeLinesWrite, createLine)).Methods("POST")
+	api.HandleFunc("/lines", requireScope(ScopeLinesRead, getLines)).Methods("GET")
+	api.HandleFunc("/lines/{id}", requireLineScope(ScopeLinesRead, getLine)).Methods("GET")
+	api.HandleFunc("/lines/{id}/qr", requireLineScope(ScopeLinesRead, getQRCode)).Methods("GET")
+	api.HandleFunc("/lines/{id}/pair-phone", requireLineScope(ScopeLinesWrite, pairPhone)).Methods("POST")
+	api.HandleFunc("/lines/{id}", requireLineScope(ScopeLinesWrite, deleteLine)).Methods("DELETE")
+	api.HandleFunc("/lines/{id}/webhook", requireLineScope(ScopeLinesWrite, setWebhook)).Methods("POST")
+	api.HandleFunc("/lines/{id}/chats", requireLineScope(ScopeLinesRead, getLineChats)).Methods("GET")
+	api.HandleFunc("/lines/{id}/chats/{jid}", requireLineScope(ScopeLinesWrite, updateChatState)).Methods("PUT")
+	api.HandleFunc("/lines/{id}/chats/{jid}/messages", requireLineScope(ScopeLinesRead, getChatMessages)).Methods("GET")
+	api.HandleFunc("/lines/{id}/chats/{jid}/read", requireLineScope(ScopeLinesWrite, markChatRead)).Methods("POST")
+	api.HandleFunc("/lines/{id}/calls", requireLineScope(ScopeLinesRead, getLineCalls)).Methods("GET")
+	api.HandleFunc("/lines/{id}/webhook/deliveries", requireLineScope(ScopeLinesRead, getWebhookDeliveries)).Methods("GET")
+	api.HandleFunc("/lines/{id}/webhook/deliveries/{delivery_id}/redeliver", requireLineScope(ScopeLinesWrite, redeliverWebhook)).Methods("POST")
+	api.HandleFunc("/lines/{id}/config", requireLineScope(ScopeLinesWrite, updateLineConfig)).Methods("PUT")
+	api.HandleFunc("/lines/{id}/tags", requireLineScope(ScopeLinesWrite, setLineTags)).Methods("PUT")
+	api.HandleFunc("/lines/{id}/limits", requireLineScope(ScopeLinesRead, getLineLimits)).Methods("GET")
+	api.HandleFunc("/lines/{id}/limits", requireLineScope(ScopeLinesWrite, setLineLimits)).Methods("PUT")
+	api.HandleFunc("/lines/{id}/warmup", requireLineScope(ScopeLinesWrite, setLineWarmup)).Methods("PUT")
+	api.HandleFunc("/lines/{id}/toggle", requireLineScope(ScopeLinesWrite, toggleLineActive)).Methods("POST")
+	api.HandleFunc("/lines/{id}/reconnect", requireLineScope(ScopeLinesWrite, reconnectLine)).Methods("POST")
+	api.HandleFunc("/messages/send", requireScope(ScopeMessagesSend, sendMessage)).Methods("POST")
+	api.HandleFunc("/messages/send-auto", requireScope(ScopeMessagesSend, sendMessageAuto)).Methods("POST")
+	api.HandleFunc("/messages/{id}", requireScope(ScopeMessagesSend, getMessageStatus)).Methods("GET")
+	api.HandleFunc("/messages/{id}", requireScope(ScopeMessagesSend, editMessage)).Methods("PUT")
+	api.HandleFunc("/messages/{id}", requireScope(ScopeMessagesSend, revokeMessage)).Methods("DELETE")
+	api.HandleFunc("/messages/{id}/react", requireScope(ScopeMessagesSend, reactToMessage)).Methods("POST")
+	api.HandleFunc("/media/{id}", requireScope(ScopeLinesRead, getMedia)).Methods("GET")
+	api.HandleFunc("/polls/{id}/results", requireScope(ScopeLinesRead, getPollResults)).Methods("GET")
+	api.HandleFunc("/events", requireScope(ScopeLinesRead, streamEvents)).Methods("GET")
+	api.HandleFunc("/lines/{id}/events", requireLineScope(ScopeLinesRead, streamLineEvents)).Methods("GET")
+	api.HandleFunc("/stats", requireScope(ScopeStatsRead, getStats)).Methods("GET")
 
 	// Servir archivos estáticos
 	router.PathPrefix("/").Handler(http.FileServer(http.Dir("./public")))
 
-	// CORS
+	// CORS: la autenticación viaja en cabeceras, no en cookies, así que no
+	// se permiten credenciales. Los orígenes se restringen con WHATSGO_CORS_ORIGINS.
+	allowedOrigins := []string{"*"}
+	if origins := splitList(os.Getenv("WHATSGO_CORS_ORIGINS")); len(origins) > 0 {
+		allowedOrigins = origins
+	}
 	c := cors.New(cors.Options{
-		AllowedOrigins:   []string{"*"},
-		AllowedMethods:   []string{"GET", "POST", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"*"},
-		AllowCredentials: true,
+		AllowedOrigins:   allowedOrigins,
+		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"Content-Type", "Authorization", "X-API-Key"},
+		AllowCredentials: false,
 	})
 
-	handler := c.Handler(router)
-
-	port := "12021"
-	log.Printf("Servidor iniciado en http://localhost:%s", port)
-	log.Fatal(http.ListenAndServe(":"+port, handler))
+	return c.Handler(router)
 }
 
 // Inicializar base de datos de configuración
@@ -182,33 +280,267 @@ func initConfigDatabase() error {
 	CREATE INDEX IF NOT EXISTS idx_message_logs_line_id ON message_logs(line_id);
 	CREATE INDEX IF NOT EXISTS idx_message_logs_timestamp ON message_logs(timestamp);
 	CREATE INDEX IF NOT EXISTS idx_message_logs_direction ON message_logs(direction);
+
+	CREATE TABLE IF NOT EXISTS outbound_queue (
+		id TEXT PRIMARY KEY,
+		line_id TEXT NOT NULL,
+		recipient TEXT NOT NULL,
+		media_type TEXT,
+		request TEXT NOT NULL, -- MessageRequest serializado en JSON
+		status TEXT NOT NULL, -- 'queued', 'sending', 'sent' o 'failed'
+		attempts INTEGER DEFAULT 0,
+		max_attempts INTEGER DEFAULT 5,
+		last_error TEXT,
+		next_attempt_at TIMESTAMP,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		sent_at TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_outbound_queue_pending ON outbound_queue(line_id, status, next_attempt_at);
+	CREATE INDEX IF NOT EXISTS idx_outbound_queue_sent ON outbound_queue(line_id, sent_at);
+
+	CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		delivery_id TEXT NOT NULL, -- agrupa los intentos de un mismo evento
+		line_id TEXT NOT NULL,
+		event TEXT NOT NULL,
+		url TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		attempt INTEGER NOT NULL,
+		status_code INTEGER,
+		error TEXT,
+		response_body TEXT,
+		duration_ms INTEGER,
+		success BOOLEAN DEFAULT 0,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_line_id ON webhook_deliveries(line_id, id);
+	CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_delivery_id ON webhook_deliveries(delivery_id);
+
+	CREATE TABLE IF NOT EXISTS media_files (
+		id TEXT PRIMARY KEY,
+		line_id TEXT NOT NULL,
+		message_id TEXT,
+		mime_type TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		sha256 TEXT NOT NULL,
+		file_name TEXT,
+		location TEXT NOT NULL, -- ruta dentro del MediaStore
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_media_files_created_at ON media_files(created_at);
+
+	CREATE TABLE IF NOT EXISTS call_logs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		line_id TEXT NOT NULL,
+		call_id TEXT NOT NULL,
+		caller TEXT NOT NULL,
+		is_video BOOLEAN DEFAULT 0,
+		is_group BOOLEAN DEFAULT 0,
+		rejected BOOLEAN DEFAULT 0,
+		error TEXT, -- error al rechazar la llamada, si lo hubo
+		timestamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_call_logs_line_id ON call_logs(line_id, timestamp);
+
+	CREATE TABLE IF NOT EXISTS chat_states (
+		line_id TEXT NOT NULL,
+		chat_jid TEXT NOT NULL,
+		assigned_to TEXT DEFAULT '', -- agente a cargo; vacío = sin asignar
+		status TEXT NOT NULL DEFAULT 'open', -- 'open' o 'closed'
+		last_read_id INTEGER, -- último message_logs.id leído en la bandeja
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (line_id, chat_jid)
+	);
+
+	CREATE TABLE IF NOT EXISTS message_reactions (
+		line_id TEXT NOT NULL,
+		message_id TEXT NOT NULL, -- mensaje al que se reacciona
+		sender TEXT NOT NULL,
+		emoji TEXT NOT NULL,
+		timestamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (line_id, message_id, sender)
+	);
+
+	CREATE TABLE IF NOT EXISTS polls (
+		line_id TEXT NOT NULL,
+		message_id TEXT NOT NULL, -- ID de WhatsApp del mensaje de la encuesta
+		chat_jid TEXT NOT NULL,
+		question TEXT NOT NULL,
+		options TEXT NOT NULL, -- JSON con los nombres de las opciones
+		selectable_count INTEGER DEFAULT 0,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (line_id, message_id)
+	);
+
+	CREATE TABLE IF NOT EXISTS poll_votes (
+		line_id TEXT NOT NULL,
+		poll_id TEXT NOT NULL,
+		voter TEXT NOT NULL,
+		options TEXT NOT NULL, -- JSON con las opciones elegidas; [] = voto retirado
+		timestamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (line_id, poll_id, voter)
+	);
+
+	CREATE TABLE IF NOT EXISTS line_limits (
+		line_id TEXT PRIMARY KEY,
+		per_minute INTEGER DEFAULT 0, -- 0 = sin límite
+		per_hour INTEGER DEFAULT 0,
+		per_day INTEGER DEFAULT 0,
+		new_contacts_per_day INTEGER DEFAULT 0,
+		min_delay_ms INTEGER DEFAULT 0, -- pausa aleatoria entre envíos
+		max_delay_ms INTEGER DEFAULT 0,
+		on_limit TEXT DEFAULT '', -- 'queue' o 'reject'
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS api_keys (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		key_hash TEXT NOT NULL UNIQUE, -- SHA-256 de la key; nunca se guarda en texto plano
+		prefix TEXT NOT NULL,
+		scopes TEXT NOT NULL, -- separados por comas
+		line_ids TEXT DEFAULT '', -- separados por comas; vacío = todas las líneas
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		last_used_at TIMESTAMP,
+		revoked_at TIMESTAMP
+	);
 	`
 	_, err := configDB.Exec(createTableSQL)
+	if err != nil {
+		return err
+	}
+
+	return migrateConfigDatabase()
+}
+
+// Agregar columnas nuevas a tablas creadas por versiones anteriores
+func migrateConfigDatabase() error {
+	migrations := []struct {
+		table, column, definition string
+	}{
+		{"message_logs", "message_id", "TEXT"},
+		{"message_logs", "status", "TEXT"},
+		{"message_logs", "delivered_at", "TIMESTAMP"},
+		{"message_logs", "read_at", "TIMESTAMP"},
+		{"message_logs", "played_at", "TIMESTAMP"},
+		{"outbound_queue", "whatsapp_id", "TEXT"},
+		{"outbound_queue", "media_file", "TEXT"},
+		{"message_logs", "media_id", "TEXT"},
+		{"message_logs", "chat_jid", "TEXT"},
+		{"message_logs", "sender", "TEXT"},
+		{"message_logs", "quoted_id", "TEXT"},
+		{"message_logs", "edited_at", "TIMESTAMP"},
+		{"message_logs", "revoked_at", "TIMESTAMP"},
+		{"lines", "webhook_secret", "TEXT DEFAULT ''"},
+		{"lines", "webhook_timeout", "INTEGER DEFAULT 10"},
+		{"lines", "webhook_max_attempts", "INTEGER DEFAULT 5"},
+		{"lines", "webhook_events", "TEXT DEFAULT ''"},
+		{"lines", "call_reject_msg", "TEXT DEFAULT ''"},
+		{"lines", "capacity", "INTEGER DEFAULT 1"},
+		{"lines", "pool", "TEXT DEFAULT ''"},
+		{"lines", "tags", "TEXT DEFAULT ''"},
+		{"lines", "simulate_typing", "BOOLEAN DEFAULT 0"},
+		{"lines", "warmup_profile", "TEXT DEFAULT ''"},
+		{"lines", "warmup_limits", "TEXT DEFAULT ''"},
+		{"lines", "warmup_started_at", "TIMESTAMP"},
+		{"webhook_deliveries", "next_attempt_at", "TIMESTAMP"},
+	}
+
+	for _, m := range migrations {
+		if err := addColumnIfMissing(m.table, m.column, m.definition); err != nil {
+			return fmt.Errorf("error al migrar %s.%s: %v", m.table, m.column, err)
+		}
+	}
+
+	_, err := configDB.Exec("CREATE INDEX IF NOT EXISTS idx_message_logs_message_id ON message_logs(line_id, message_id)")
+	if err != nil {
+		return err
+	}
+
+	_, err = configDB.Exec("CREATE INDEX IF NOT EXISTS idx_message_logs_chat ON message_logs(line_id, chat_jid, id)")
+	if err != nil {
+		return err
+	}
+
+	// Completar chat y remitente de mensajes registrados antes de guardarlos
+	_, err = configDB.Exec(`
+		UPDATE message_logs SET
+			chat_jid = CASE
+				WHEN direction = 'received' OR instr(to_number, '@') > 0 THEN to_number
+				ELSE to_number || '@s.whatsapp.net'
+			END,
+			sender = from_number
+		WHERE chat_jid IS NULL
+	`)
+	return err
+}
+
+func addColumnIfMissing(table, column, definition string) error {
+	rows, err := configDB.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = configDB.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
 	return err
 }
 
 // Guardar línea en base de datos
 func saveLineToDB(line *Line) error {
 	jid := ""
-	if line.Client != nil && line.Client.Store.ID != nil {
-		jid = line.Client.Store.ID.String()
+	if line.Client != nil && line.Client.StoreID() != nil {
+		jid = line.Client.StoreID().String()
 	}
 
 	query := `
 	INSERT OR REPLACE INTO lines 
-	(id, name, webhook_url, allow_calls, respond_to_groups, auto_mark_read, always_online, auto_reply_msg, active, jid, updated_at)
-	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+	(id, name, webhook_url, webhook_secret, webhook_timeout, webhook_max_attempts, webhook_events, allow_calls, respond_to_groups, auto_mark_read, always_online, auto_reply_msg, call_reject_msg, capacity, simulate_typing, pool, tags,
+	 warmup_profile, warmup_limits, warmup_started_at, active, jid, updated_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
 	`
 
+	warmupProfile, warmupLimits, warmupStartedAt := warmupToColumns(line.Warmup)
+
 	_, err := configDB.Exec(query,
 		line.ID,
 		line.Name,
 		line.WebhookURL,
+		line.WebhookSecret,
+		line.WebhookTimeout,
+		line.WebhookMaxAttempts,
+		strings.Join(line.WebhookEvents, ","),
 		line.Config.AllowCalls,
 		line.Config.RespondToGroups,
 		line.Config.AutoMarkRead,
 		line.Config.AlwaysOnline,
 		line.Config.AutoReplyMsg,
+		line.Config.CallRejectMsg,
+		line.Config.Capacity,
+		line.Config.SimulateTyping,
+		line.Pool,
+		strings.Join(line.Tags, ","),
+		warmupProfile,
+		warmupLimits,
+		warmupStartedAt,
 		line.Active,
 		jid,
 	)
@@ -219,14 +551,19 @@ func saveLineToDB(line *Line) error {
 // Eliminar línea de base de datos
 func deleteLineFromDB(lineID string) error {
 	_, err := configDB.Exec("DELETE FROM lines WHERE id = ?", lineID)
+	if err != nil {
+		return err
+	}
+	_, err = configDB.Exec("DELETE FROM line_limits WHERE line_id = ?", lineID)
 	return err
 }
 
 // Cargar líneas existentes desde la base de datos
 func loadExistingLines() error {
 	rows, err := configDB.Query(`
-		SELECT id, name, webhook_url, allow_calls, respond_to_groups, 
-		       auto_mark_read, always_online, auto_reply_msg, active, jid
+		SELECT id, name, webhook_url, webhook_secret, webhook_timeout, webhook_max_attempts, webhook_events,
+		       allow_calls, respond_to_groups, auto_mark_read, always_online, auto_reply_msg, call_reject_msg, capacity, simulate_typing, pool, tags,
+		       warmup_profile, warmup_limits, warmup_started_at, active, jid
 		FROM lines
 	`)
 	if err != nil {
@@ -235,11 +572,14 @@ func loadExistingLines() error {
 	defer rows.Close()
 
 	for rows.Next() {
-		var id, name, webhookURL, autoReplyMsg, jid string
-		var allowCalls, respondToGroups, autoMarkRead, alwaysOnline, active bool
-
-		err := rows.Scan(&id, &name, &webhookURL, &allowCalls, &respondToGroups,
-			&autoMarkRead, &alwaysOnline, &autoReplyMsg, &active, &jid)
+		var id, name, webhookURL, webhookSecret, webhookEvents, autoReplyMsg, callRejectMsg, pool, tags, jid string
+		var warmupProfile, warmupLimits string
+		var warmupStartedAt sql.NullTime
+		var webhookTimeout, webhookMaxAttempts, capacity int
+		var allowCalls, respondToGroups, autoMarkRead, alwaysOnline, simulateTyping, active bool
+
+		err := rows.Scan(&id, &name, &webhookURL, &webhookSecret, &webhookTimeout, &webhookMaxAttempts, &webhookEvents, &allowCalls, &respondToGroups,
+			&autoMarkRead, &alwaysOnline, &autoReplyMsg, &callRejectMsg, &capacity, &simulateTyping, &pool, &tags, &warmupProfile, &warmupLimits, &warmupStartedAt, &active, &jid)
 		if err != nil {
 			log.Printf("Error al leer línea de DB: %v", err)
 			continue
@@ -266,8 +606,7 @@ func loadExistingLines() error {
 		// Configurar dispositivo para evitar bans
 		configureDevice(deviceStore)
 
-		clientLog := waLog.Stdout("Client-"+id, "INFO", true)
-		client := whatsmeow.NewClient(deviceStore, clientLog)
+		client := newMessagingClient(deviceStore, id)
 
 		line := &Line{
 			ID:         id,
@@ -277,12 +616,24 @@ func loadExistingLines() error {
 			WebhookURL: webhookURL,
 			Available:  false,
 			Active:     active,
+			Pool:       pool,
+			Tags:       splitList(tags),
+			Limits:     loadRateLimits(id),
+			Warmup:     warmupFromColumns(warmupProfile, warmupLimits, warmupStartedAt),
+
+			WebhookSecret:      webhookSecret,
+			WebhookTimeout:     webhookTimeout,
+			WebhookMaxAttempts: webhookMaxAttempts,
+			WebhookEvents:      splitList(webhookEvents),
 			Config: LineConfig{
 				AllowCalls:      allowCalls,
 				RespondToGroups: respondToGroups,
 				AutoMarkRead:    autoMarkRead,
 				AlwaysOnline:    alwaysOnline,
 				AutoReplyMsg:    autoReplyMsg,
+				CallRejectMsg:   callRejectMsg,
+				Capacity:        capacity,
+				SimulateTyping:  simulateTyping,
 			},
 		}
 
@@ -292,6 +643,7 @@ func loadExistingLines() error {
 		})
 
 		lines[id] = line
+		startOutboundWorkers(line)
 
 		// Intentar reconectar si tiene sesión y está activa
 		if deviceStore.ID != nil && active {
@@ -310,7 +662,9 @@ func loadExistingLines() error {
 // Crear nueva línea
 func createLine(w http.ResponseWriter, r *http.Request) {
 	var req struct {
-		Name string `json:"name"`
+		Name   string         `json:"name"`
+		Warmup *WarmupRequest `json:"warmup,omitempty"` // nil = WHATSGO_WARMUP_PROFILE
+		LineTagsRequest
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -323,6 +677,23 @@ func createLine(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Una key restringida a ciertas líneas no puede crear líneas nuevas
+	if key := apiKeyFromContext(r); key != nil && len(key.LineIDs) > 0 {
+		http.Error(w, "La API key está restringida a líneas específicas", http.StatusForbidden)
+		return
+	}
+
+	// Los números nuevos empiezan con volumen reducido
+	warmupReq := WarmupRequest{Profile: defaultWarmupProfile}
+	if req.Warmup != nil {
+		warmupReq = *req.Warmup
+	}
+	warmup, err := warmupFromRequest(warmupReq)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	linesMutex.Lock()
 	defer linesMutex.Unlock()
 
@@ -332,9 +703,8 @@ func createLine(w http.ResponseWriter, r *http.Request) {
 	deviceStore := container.NewDevice()
 	// Configurar dispositivo para evitar bans
 	configureDevice(deviceStore)
-	
-	clientLog := waLog.Stdout("Client-"+lineID, "INFO", true)
-	client := whatsmeow.NewClient(deviceStore, clientLog)
+
+	client := newMessagingClient(deviceStore, lineID)
 
 	line := &Line{
 		ID:        lineID,
@@ -343,24 +713,35 @@ func createLine(w http.ResponseWriter, r *http.Request) {
 		Client:    client,
 		Available: false,
 		Active:    true,
+		Warmup:    warmup,
+
+		WebhookTimeout:     defaultWebhookTimeout,
+		WebhookMaxAttempts: defaultWebhookMaxAttempts,
 		Config: LineConfig{
 			AllowCalls:      false,
 			RespondToGroups: false,
 			AutoMarkRead:    true,
 			AlwaysOnline:    true,
 			AutoReplyMsg:    "",
+			Capacity:        1,
 		},
 	}
 
+	if err := applyLineTags(line, req.LineTagsRequest); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// Configurar event handlers
 	client.AddEventHandler(func(evt interface{}) {
 		handleEvent(line, evt)
 	})
 
 	lines[lineID] = line
+	startOutboundWorkers(line)
 
 	// Guardar línea en base de datos
-	err := saveLineToDB(line)
+	err = saveLineToDB(line)
 	if err != nil {
 		log.Printf("Error al guardar línea en DB: %v", err)
 	}
@@ -374,7 +755,7 @@ func createLine(w http.ResponseWriter, r *http.Request) {
 
 // Conectar línea
 func connectLine(line *Line) {
-	if line.Client.Store.ID == nil {
+	if line.Client.StoreID() == nil {
 		// Nueva sesión - generar QR
 		qrChan, _ := line.Client.GetQRChannel(context.Background())
 		err := line.Client.Connect()
@@ -384,16 +765,38 @@ func connectLine(line *Line) {
 		}
 
 		line.Status = "qr_pending"
+		publishLineStatus(line)
 
 		for evt := range qrChan {
-			if evt.Event == "code" {
+			switch evt.Event {
+			case whatsmeow.QRChannelEventCode:
 				// Generar imagen QR
 				png, err := qrcode.Encode(evt.Code, qrcode.Medium, 256)
 				if err == nil {
 					line.QRCode = fmt.Sprintf("data:image/png;base64,%s", encodeBase64(png))
 				}
 				log.Printf("Código QR generado para %s", line.ID)
-			} else {
+
+				emitWebhookEvent(line, EventConnectionQR, map[string]interface{}{
+					"code":       evt.Code,
+					"qr_code":    line.QRCode,
+					"expires_in": int(evt.Timeout.Seconds()),
+				})
+				eventBus.Publish(BusLineQR, line.ID, map[string]interface{}{
+					"qr_code":    line.QRCode,
+					"expires_in": int(evt.Timeout.Seconds()),
+				})
+			case whatsmeow.QRChannelSuccess.Event:
+				log.Printf("Línea %s vinculada", line.ID)
+				eventBus.Publish(BusLinePaired, line.ID, nil)
+			case whatsmeow.QRChannelTimeout.Event:
+				log.Printf("Código QR expirado para %s", line.ID)
+				line.Status = "disconnected"
+				line.QRCode = ""
+				line.PairingCode = ""
+				eventBus.Publish(BusLineQRTimeout, line.ID, nil)
+				publishLineStatus(line)
+			default:
 				log.Printf("Evento QR: %s", evt.Event)
 			}
 		}
@@ -416,13 +819,20 @@ func handleEvent(line *Line, rawEvt interface{}) {
 			line.Available = true
 		}
 		line.QRCode = ""
+		line.PairingCode = ""
+		startWarmup(line)
 		log.Printf("Línea %s conectada", line.ID)
+		publishLineStatus(line)
 
 		// Guardar JID en base de datos cuando se conecta por primera vez
-		if line.Client.Store.ID != nil {
+		jid := ""
+		if line.Client.StoreID() != nil {
+			jid = line.Client.StoreID().String()
 			go saveLineToDB(line)
 		}
 
+		emitWebhookEvent(line, EventConnectionConnected, map[string]string{"jid": jid})
+
 		// Configurar presencia según configuración
 		if line.Config.AlwaysOnline && line.Active {
 			go func() {
@@ -434,6 +844,12 @@ func handleEvent(line *Line, rawEvt interface{}) {
 		line.Status = "disconnected"
 		line.Available = false
 		log.Printf("Línea %s desconectada", line.ID)
+		publishLineStatus(line)
+
+		emitWebhookEvent(line, EventConnectionLoggedOut, map[string]interface{}{
+			"reason":     evt.Reason.String(),
+			"on_connect": evt.OnConnect,
+		})
 
 	case *events.Message:
 		// Si la línea está desactivada, no procesar mensajes
@@ -449,33 +865,40 @@ func handleEvent(line *Line, rawEvt interface{}) {
 			}()
 		}
 
-		// No responder a grupos según configuración
-		if evt.Info.IsGroup && !line.Config.RespondToGroups {
+		// Los votos de encuestas llegan cifrados y se agregan por encuesta.
+		// Se procesan también en grupos: respond_to_groups no los afecta
+		if evt.Message.GetPollUpdateMessage() != nil {
+			go handlePollVote(line, evt)
 			return
 		}
 
-		// Registrar mensaje recibido
-		messageText := evt.Message.GetConversation()
-		if messageText == "" && evt.Message.GetExtendedTextMessage() != nil {
-			messageText = evt.Message.GetExtendedTextMessage().GetText()
+		// Reacciones, ediciones y eliminaciones actualizan el historial
+		// del mensaje original en lugar de registrarse como mensajes
+		if handleMessageAction(line, evt) {
+			return
 		}
 
-		messageType := "text"
-		if evt.Message.GetImageMessage() != nil {
-			messageType = "image"
-		} else if evt.Message.GetAudioMessage() != nil {
-			if evt.Message.GetAudioMessage().GetPTT() {
-				messageType = "voice"
-			} else {
-				messageType = "audio"
-			}
-		} else if evt.Message.GetVideoMessage() != nil {
-			messageType = "video"
-		} else if evt.Message.GetDocumentMessage() != nil {
-			messageType = "document"
+		// No responder a grupos según configuración
+		if evt.Info.IsGroup && !line.Config.RespondToGroups {
+			return
 		}
 
-		go logMessage(line.ID, "received", evt.Info.Sender.String(), evt.Info.Chat.String(), messageType, messageText, evt.Info.IsGroup)
+		// Registrar mensaje recibido
+		messageText := messageTextOf(evt.Message)
+		messageType := messageTypeOf(evt.Message)
+
+		eventBus.Publish(BusMessageReceived, line.ID, map[string]interface{}{
+			"id":        evt.Info.ID,
+			"chat":      evt.Info.Chat.String(),
+			"sender":    evt.Info.Sender.String(),
+			"push_name": evt.Info.PushName,
+			"type":      messageType,
+			"text":      messageText,
+			"is_group":  evt.Info.IsGroup,
+		})
+
+		// Descargar media, registrar y notificar al webhook
+		go processIncomingMessage(line, evt, messageType, messageText)
 
 		// Enviar respuesta automática si está configurada
 		if line.Config.AutoReplyMsg != "" {
@@ -486,46 +909,87 @@ func handleEvent(line *Line, rawEvt interface{}) {
 			}()
 		}
 
-		// Enviar a webhook si está configurado
-		if line.WebhookURL != "" {
-			go sendToWebhook(line, evt)
+	case *events.Receipt:
+		// Actualizar estado de entrega de mensajes enviados
+		go handleReceipt(line, evt)
+
+	case *events.CallOffer:
+		log.Printf("Llamada entrante en línea %s de %s", line.ID, evt.From)
+		go handleCallOffer(line, evt)
+
+	case *events.GroupInfo:
+		if data := buildGroupParticipantsEventData(evt); data != nil {
+			emitWebhookEvent(line, EventGroupParticipants, data)
 		}
 
-	case *events.Receipt:
-		// Manejar recibos de lectura
-		if evt.Type == events.ReceiptTypeRead || evt.Type == events.ReceiptTypeReadSelf {
-			log.Printf("Mensaje leído en línea %s", line.ID)
+	case *events.Presence:
+		data := map[string]interface{}{
+			"from":        evt.From.String(),
+			"unavailable": evt.Unavailable,
 		}
+		if !evt.LastSeen.IsZero() {
+			data["last_seen"] = evt.LastSeen
+		}
+		emitWebhookEvent(line, EventPresence, data)
+
+	case *events.ChatPresence:
+		emitWebhookEvent(line, EventChatPresence, map[string]string{
+			"chat":   evt.Chat.String(),
+			"sender": evt.Sender.String(),
+			"state":  string(evt.State),
+			"media":  string(evt.Media),
+		})
 	}
 }
 
-// Enviar a webhook
-func sendToWebhook(line *Line, evt *events.Message) {
-	payload := WebhookPayload{
-		From:    evt.Info.Sender.String(),
-		To:      evt.Info.Chat.String(),
-		Message: evt.Message.GetConversation(),
-		LineID:  line.ID,
+// Procesar un mensaje entrante: descargar su media, registrarlo y enviarlo al webhook
+func processIncomingMessage(line *Line, evt *events.Message, messageType, messageText string) {
+	media, err := downloadIncomingMedia(line, evt)
+	if err != nil {
+		log.Printf("Error con media de mensaje %s en línea %s: %v", evt.Info.ID, line.ID, err)
 	}
 
-	if payload.Message == "" && evt.Message.GetExtendedTextMessage() != nil {
-		payload.Message = evt.Message.GetExtendedTextMessage().GetText()
+	mediaID := ""
+	if media != nil {
+		mediaID = media.ID
 	}
 
-	jsonData, err := json.Marshal(payload)
-	if err != nil {
-		log.Printf("Error al serializar webhook: %v", err)
-		return
+	stored := StoredMessage{
+		LineID:    line.ID,
+		Direction: "received",
+		MessageID: evt.Info.ID,
+		Chat:      evt.Info.Chat.String(),
+		Sender:    evt.Info.Sender.String(),
+		Type:      messageType,
+		Text:      messageText,
+		MediaID:   mediaID,
+		IsGroup:   evt.Info.IsGroup,
+	}
+	if stored.Text == "" {
+		stored.Text = messageCaptionOf(evt.Message)
+	}
+	if stored.Text == "" {
+		stored.Text = structuredTextOf(evt.Message)
+	}
+	if quoted := quotedMessageOf(evt.Message); quoted != nil {
+		stored.QuotedID = quoted.ID
 	}
 
-	resp, err := http.Post(line.WebhookURL, "application/json", bytes.NewBuffer(jsonData))
+	savePollOf(line.ID, evt.Info.ID, evt.Info.Chat, evt.Message)
+
+	err = logMessage(stored)
 	if err != nil {
-		log.Printf("Error al enviar webhook: %v", err)
-		return
+		log.Printf("Error al registrar mensaje recibido: %v", err)
+	} else {
+		chatActivity(stored)
 	}
-	defer resp.Body.Close()
 
-	log.Printf("Webhook enviado para línea %s", line.ID)
+	// Enviar a webhook si está configurado
+	if line.WebhookURL != "" {
+		data := buildMessageEventData(line, evt)
+		data.Media = media
+		emitWebhookEvent(line, EventMessageReceived, data)
+	}
 }
 
 // Obtener todas las líneas
@@ -533,8 +997,18 @@ func getLines(w http.ResponseWriter, r *http.Request) {
 	linesMutex.RLock()
 	defer linesMutex.RUnlock()
 
+	// Filtros opcionales ?pool=ventas&tag=country:mx (tag puede repetirse)
+	pool, tags, err := normalizeTagFilter(r.URL.Query().Get("pool"), r.URL.Query()["tag"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	var result []*Line
 	for _, line := range lines {
+		if !canAccessLine(r, line.ID) || !lineMatches(line, pool, tags) {
+			continue
+		}
 		lineCopy := &Line{
 			ID:         line.ID,
 			Name:       line.Name,
@@ -544,6 +1018,16 @@ func getLines(w http.ResponseWriter, r *http.Request) {
 			LastUsed:   line.LastUsed,
 			Config:     line.Config,
 			Active:     line.Active,
+			Pool:       line.Pool,
+			Tags:       line.Tags,
+			Limits:     line.Limits,
+			Warmup:     warmupStatusOf(line),
+
+			PairingCode: line.PairingCode,
+
+			WebhookTimeout:     line.WebhookTimeout,
+			WebhookMaxAttempts: line.WebhookMaxAttempts,
+			WebhookEvents:      line.WebhookEvents,
 		}
 		result = append(result, lineCopy)
 	}
@@ -575,6 +1059,16 @@ func getLine(w http.ResponseWriter, r *http.Request) {
 		LastUsed:   line.LastUsed,
 		Config:     line.Config,
 		Active:     line.Active,
+		Pool:       line.Pool,
+		Tags:       line.Tags,
+		Limits:     line.Limits,
+		Warmup:     warmupStatusOf(line),
+
+		PairingCode: line.PairingCode,
+
+		WebhookTimeout:     line.WebhookTimeout,
+		WebhookMaxAttempts: line.WebhookMaxAttempts,
+		WebhookEvents:      line.WebhookEvents,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -596,8 +1090,9 @@ func getQRCode(w http.ResponseWriter, r *http.Request) {
 	}
 
 	response := map[string]string{
-		"qr_code": line.QRCode,
-		"status":  line.Status,
+		"qr_code":      line.QRCode,
+		"pairing_code": line.PairingCode,
+		"status":       line.Status,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -622,6 +1117,9 @@ func deleteLine(w http.ResponseWriter, r *http.Request) {
 		line.Client.Disconnect()
 	}
 
+	stopOutboundWorkers(line)
+	go failPendingMessages(lineID, "Línea eliminada")
+
 	delete(lines, lineID)
 
 	// Eliminar línea de base de datos
@@ -654,8 +1152,32 @@ func setWebhook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if config.Events != nil {
+		for _, event := range *config.Events {
+			if !validWebhookSubscription(event) {
+				http.Error(w, fmt.Sprintf("Evento de webhook inválido: %s", event), http.StatusBadRequest)
+				return
+			}
+		}
+		line.WebhookEvents = *config.Events
+	}
+
 	line.WebhookURL = config.URL
 
+	// Secreto para la firma X-WhatsGO-Signature
+	if config.Secret != "" {
+		line.WebhookSecret = config.Secret
+	} else if line.WebhookSecret == "" || config.RegenerateSecret {
+		line.WebhookSecret = generateWebhookSecret()
+	}
+
+	if config.Timeout > 0 {
+		line.WebhookTimeout = config.Timeout
+	}
+	if config.MaxAttempts > 0 {
+		line.WebhookMaxAttempts = config.MaxAttempts
+	}
+
 	// Guardar línea en base de datos
 	err := saveLineToDB(line)
 	if err != nil {
@@ -663,7 +1185,13 @@ func setWebhook(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"message": "Webhook configurado"})
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":      "Webhook configurado",
+		"secret":       line.WebhookSecret,
+		"timeout":      line.WebhookTimeout,
+		"max_attempts": line.WebhookMaxAttempts,
+		"events":       line.WebhookEvents,
+	})
 }
 
 // Actualizar configuración de línea
@@ -762,6 +1290,8 @@ func toggleLineActive(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	publishLineStatus(line)
+
 	// Guardar línea en base de datos
 	err := saveLineToDB(line)
 	if err != nil {
@@ -825,18 +1355,16 @@ func configureDevice(device *store.Device) {
 	// Usar SetOSInfo para establecer el nombre del sistema operativo y versión
 	// Versión específica solicitada: 2.3000.1028524044
 	store.SetOSInfo("Google Chrome (Linux)", [3]uint32{2, 3000, 1028524044})
-	
+
 	// El Platform se usa para el nombre del dispositivo en "Linked Devices"
 	device.Platform = "Google Chrome (Linux)"
 }
 
-
-
 // Enviar mensaje con línea específica
 func sendMessage(w http.ResponseWriter, r *http.Request) {
-	var req MessageRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	req, err := decodeMessageRequest(w, r)
+	if err != nil {
+		writeRequestError(w, err)
 		return
 	}
 
@@ -845,6 +1373,11 @@ func sendMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !canAccessLine(r, req.From) {
+		http.Error(w, "La API key no tiene acceso a esta línea", http.StatusForbidden)
+		return
+	}
+
 	linesMutex.RLock()
 	line, exists := lines[req.From]
 	linesMutex.RUnlock()
@@ -854,62 +1387,26 @@ func sendMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !line.Available || line.Status != "connected" {
+	// Una línea pausada o sin sesión no puede enviar; si solo está
+	// desconectada temporalmente el mensaje espera en la cola
+	if !line.Active || line.Client.StoreID() == nil {
 		http.Error(w, "Línea no disponible", http.StatusServiceUnavailable)
 		return
 	}
 
-	// Parsear número de destino
-	recipient, err := parseJID(req.To)
-	if err != nil {
-		http.Error(w, "Número de destino inválido", http.StatusBadRequest)
-		return
-	}
-
-	var msg *waProto.Message
-	var uploadErr error
-
-	// Determinar tipo de mensaje
-	if req.MediaType != "" && req.MediaType != "text" {
-		msg, uploadErr = createMediaMessage(line.Client, req)
-		if uploadErr != nil {
-			http.Error(w, fmt.Sprintf("Error al procesar media: %v", uploadErr), http.StatusBadRequest)
-			return
-		}
-	} else {
-		// Mensaje de texto simple
-		if req.Message == "" {
-			http.Error(w, "Message es requerido para mensajes de texto", http.StatusBadRequest)
-			return
-		}
-		msg = &waProto.Message{
-			Conversation: &req.Message,
-		}
-	}
-
-	// Enviar mensaje
-	_, err = line.Client.SendMessage(context.Background(), recipient, msg)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error al enviar mensaje: %v", err), http.StatusInternalServerError)
+	if err := validateMessageRequest(req); err != nil {
+		writeRequestError(w, err)
 		return
 	}
 
-	line.LastUsed = time.Now()
-
-	go logMessage(line.ID, "sent", line.Client.Store.ID.String(), req.To, req.MediaType, req.Message, false)
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"message": "Mensaje enviado",
-		"line_id": line.ID,
-	})
+	enqueueAndRespond(w, line, req, req.Async)
 }
 
 // Enviar mensaje con línea automática
 func sendMessageAuto(w http.ResponseWriter, r *http.Request) {
-	var req MessageRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	req, err := decodeMessageRequest(w, r)
+	if err != nil {
+		writeRequestError(w, err)
 		return
 	}
 
@@ -924,74 +1421,82 @@ func sendMessageAuto(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	linesMutex.RLock()
-	defer linesMutex.RUnlock()
-
-	// Buscar línea disponible
-	var selectedLine *Line
-	var oldestTime time.Time
-
-	for _, line := range lines {
-		if line.Available && line.Status == "connected" && line.Active {
-			if selectedLine == nil || line.LastUsed.Before(oldestTime) {
-				selectedLine = line
-				oldestTime = line.LastUsed
-			}
-		}
+	if err := validateMessageRequest(req); err != nil {
+		writeRequestError(w, err)
+		return
 	}
 
-	if selectedLine == nil {
-		http.Error(w, "No hay líneas disponibles", http.StatusServiceUnavailable)
+	selector, err := lineSelectorFor(req.Strategy)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Parsear número de destino
-	recipient, err := parseJID(req.To)
+	pool, tags, err := normalizeTagFilter(req.Pool, req.Tags)
 	if err != nil {
-		http.Error(w, "Número de destino inválido", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Crear mensaje
-	var msg *waProto.Message
-	var uploadErr error
-
-	if req.MediaType != "" && req.MediaType != "text" {
-		// Es un mensaje multimedia
-		msg, uploadErr = createMediaMessage(selectedLine.Client, req)
-		if uploadErr != nil {
-			http.Error(w, fmt.Sprintf("Error al procesar media: %v", uploadErr), http.StatusInternalServerError)
-			return
+	// Líneas candidatas
+	linesMutex.RLock()
+	var candidates []*Line
+	for _, line := range lines {
+		if !canAccessLine(r, line.ID) {
+			continue
 		}
-	} else {
-		// Es un mensaje de texto
-		msg = &waProto.Message{
-			Conversation: &req.Message,
+		if line.Available && line.Status == "connected" && line.Active && lineMatches(line, pool, tags) {
+			candidates = append(candidates, line)
 		}
 	}
+	linesMutex.RUnlock()
 
-	// Enviar mensaje
-	_, err = selectedLine.Client.SendMessage(context.Background(), recipient, msg)
+	// Descartar las líneas sin cupo. Si ninguna lo tiene se usa la que lo
+	// recupera antes, y enqueueAndRespond encola o responde 429 según on_limit
+	var withinLimits []*Line
+	var soonest *Line
+	var soonestWait time.Duration
+	for _, line := range candidates {
+		err := checkRateLimits(line, req.To, "", true)
+		if limitErr, ok := err.(*rateLimitError); ok {
+			if soonest == nil || limitErr.RetryAfter < soonestWait {
+				soonest, soonestWait = line, limitErr.RetryAfter
+			}
+			continue
+		} else if err != nil {
+			log.Printf("Error al comprobar límites de línea %s: %v", line.ID, err)
+		}
+		withinLimits = append(withinLimits, line)
+	}
 
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error al enviar mensaje: %v", err), http.StatusInternalServerError)
-		return
+	selectedLine := selector.Select(withinLimits, req)
+	if selectedLine == nil {
+		selectedLine = soonest
 	}
 
-	selectedLine.LastUsed = time.Now()
+	// Reservar la línea para que peticiones concurrentes elijan otra
+	if selectedLine != nil {
+		linesMutex.Lock()
+		selectedLine.LastUsed = time.Now()
+		linesMutex.Unlock()
+	}
 
-	go logMessage(selectedLine.ID, "sent", selectedLine.Client.Store.ID.String(), req.To, req.MediaType, req.Message, false)
+	if selectedLine == nil {
+		http.Error(w, "No hay líneas disponibles", http.StatusServiceUnavailable)
+		return
+	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"message": "Mensaje enviado",
-		"line_id": selectedLine.ID,
-	})
+	enqueueAndRespond(w, selectedLine, req, req.Async)
 }
 
 // Utilidades
 
 func parseJID(phone string) (types.JID, error) {
+	// Un JID completo (p.ej. un grupo) se usa tal cual
+	if strings.Contains(phone, "@") {
+		return types.ParseJID(phone)
+	}
+
 	// Limpiar número
 	cleanPhone := ""
 	for _, c := range phone {
@@ -1007,89 +1512,7 @@ func parseJID(phone string) (types.JID, error) {
 	return types.NewJID(cleanPhone, types.DefaultUserServer), nil
 }
 
-// Procesar imagen para WhatsApp (optimizar y convertir si es necesario)
-func processImageForWhatsApp(imageBytes []byte, mimeType string) ([]byte, string, error) {
-	// Decodificar la imagen
-	img, format, err := image.Decode(bytes.NewReader(imageBytes))
-	if err != nil {
-		return nil, "", fmt.Errorf("error al decodificar imagen: %v", err)
-	}
-
-	bounds := img.Bounds()
-	width := bounds.Dx()
-	height := bounds.Dy()
-
-	log.Printf("Imagen detectada: formato=%s, dimensiones=%dx%d, tamaño=%d bytes", format, width, height, len(imageBytes))
-
-	// Redimensionar si es muy grande (WhatsApp recomienda máximo 1280x1280)
-	maxDimension := 1280
-	needsResize := width > maxDimension || height > maxDimension
-
-	var finalImg image.Image = img
-
-	if needsResize {
-		// Calcular nuevas dimensiones manteniendo aspect ratio
-		var newWidth, newHeight int
-		if width > height {
-			newWidth = maxDimension
-			newHeight = (height * maxDimension) / width
-		} else {
-			newHeight = maxDimension
-			newWidth = (width * maxDimension) / height
-		}
-
-		log.Printf("Redimensionando imagen: %dx%d -> %dx%d", width, height, newWidth, newHeight)
-
-		// Crear imagen redimensionada (simple nearest neighbor)
-		resized := image.NewRGBA(image.Rect(0, 0, newWidth, newHeight))
-		for y := 0; y < newHeight; y++ {
-			for x := 0; x < newWidth; x++ {
-				srcX := (x * width) / newWidth
-				srcY := (y * height) / newHeight
-				resized.Set(x, y, img.At(srcX, srcY))
-			}
-		}
-		finalImg = resized
-	}
-
-	// Convertir a JPEG con calidad optimizada
-	var buf bytes.Buffer
-	quality := 75 // Calidad base
-
-	// Si el archivo original es muy grande, reducir calidad
-	if len(imageBytes) > 500000 { // > 500KB
-		quality = 60
-	} else if len(imageBytes) > 200000 { // > 200KB
-		quality = 70
-	}
-
-	opts := &jpeg.Options{Quality: quality}
-
-	err = jpeg.Encode(&buf, finalImg, opts)
-	if err != nil {
-		return nil, "", fmt.Errorf("error al convertir imagen a JPEG: %v", err)
-	}
-
-	processedBytes := buf.Bytes()
-	log.Printf("Imagen procesada: %d bytes -> %d bytes (JPEG calidad=%d)", len(imageBytes), len(processedBytes), quality)
-
-	// Si todavía es muy grande, reducir calidad aún más
-	if len(processedBytes) > 300000 {
-		log.Printf("Imagen aún muy grande, reduciendo calidad a 50")
-		buf.Reset()
-		opts.Quality = 50
-		err = jpeg.Encode(&buf, finalImg, opts)
-		if err != nil {
-			return nil, "", fmt.Errorf("error al recomprimir imagen: %v", err)
-		}
-		processedBytes = buf.Bytes()
-		log.Printf("Imagen recomprimida: %d bytes (JPEG calidad=50)", len(processedBytes))
-	}
-
-	return processedBytes, "image/jpeg", nil
-}
-
-func createMediaMessage(client *whatsmeow.Client, req MessageRequest) (*waProto.Message, error) {
+func createMediaMessage(client MessagingClient, req MessageRequest) (*waProto.Message, error) {
 	// Limpiar y procesar media_data
 	mediaData := req.MediaData
 	mimeType := req.MimeType
@@ -1139,60 +1562,101 @@ func createMediaMessage(client *whatsmeow.Client, req MessageRequest) (*waProto.
 		mimeType = req.MimeType
 	}
 
-	// Si no hay MIME type, intentar detectar por media_type
-	if mimeType == "" {
-		switch req.MediaType {
-		case "image":
-			mimeType = "image/jpeg"
-		case "audio":
-			mimeType = "audio/ogg; codecs=opus"
-		case "voice":
-			mimeType = "audio/ogg; codecs=opus" // Notas de voz en formato OGG Opus
-		case "video":
-			mimeType = "video/mp4"
-		case "document":
-			mimeType = "application/pdf"
+	// El archivo llega en base64 o ya guardado en disco (media_url o multipart)
+	var mediaBytes []byte
+	var mediaFile *os.File
+	var mediaSize int64
+	var err error
+	if req.mediaFile != "" {
+		mediaFile, err = os.Open(req.mediaFile)
+		if err != nil {
+			return nil, fmt.Errorf("archivo temporal no disponible: %v", err)
+		}
+		defer mediaFile.Close()
+
+		info, err := mediaFile.Stat()
+		if err != nil {
+			return nil, fmt.Errorf("archivo temporal no disponible: %v", err)
 		}
-		log.Printf("MIME type por defecto asignado: %s", mimeType)
+		mediaSize = info.Size()
+	} else {
+		mediaBytes, err = base64.StdEncoding.DecodeString(mediaData)
+		if err != nil {
+			return nil, fmt.Errorf("error al decodificar base64: %v (data length: %d)", err, len(mediaData))
+		}
+		mediaSize = int64(len(mediaBytes))
 	}
 
-	// Decodificar base64
-	mediaBytes, err := base64.StdEncoding.DecodeString(mediaData)
-	if err != nil {
-		return nil, fmt.Errorf("error al decodificar base64: %v (data length: %d)", err, len(mediaData))
+	// Las solicitudes se validan al encolarse y ya traen el MIME type; si
+	// falta (p.ej. mensajes encolados antes), se detecta por el contenido
+	if mimeType == "" {
+		head := mediaBytes[:min(len(mediaBytes), 512)]
+		if mediaFile != nil {
+			head = make([]byte, 512)
+			n, _ := io.ReadFull(mediaFile, head)
+			head = head[:n]
+			if _, err := mediaFile.Seek(0, io.SeekStart); err != nil {
+				return nil, fmt.Errorf("error al leer archivo temporal: %v", err)
+			}
+		}
+		if err := validateMediaContent(&req, head, mediaSize, ""); err != nil {
+			return nil, err
+		}
+		mimeType = req.MimeType
 	}
 
-	log.Printf("Archivo decodificado: %d bytes, MIME: %s, Tipo: %s", len(mediaBytes), mimeType, req.MediaType)
+	log.Printf("Archivo decodificado: %d bytes, MIME: %s, Tipo: %s", mediaSize, mimeType, req.MediaType)
 
 	// Validar tamaños recomendados
-	maxSize := int64(0)
-	switch req.MediaType {
-	case "image":
-		maxSize = 5 * 1024 * 1024 // 5 MB
-	case "audio", "voice":
-		maxSize = 16 * 1024 * 1024 // 16 MB
-	case "video":
-		maxSize = 16 * 1024 * 1024 // 16 MB
-	case "document":
-		maxSize = 100 * 1024 * 1024 // 100 MB
+	maxSize := maxMediaSize(req.MediaType)
+	if mediaSize > maxSize {
+		return nil, fmt.Errorf("archivo muy grande: %d bytes (máximo recomendado: %d bytes)", mediaSize, maxSize)
 	}
 
-	if int64(len(mediaBytes)) > maxSize {
-		return nil, fmt.Errorf("archivo muy grande: %d bytes (máximo recomendado: %d bytes)", len(mediaBytes), maxSize)
+	// Las imágenes y stickers se procesan en memoria
+	if mediaFile != nil && (req.MediaType == "image" || req.MediaType == "sticker") {
+		mediaBytes, err = io.ReadAll(mediaFile)
+		if err != nil {
+			return nil, fmt.Errorf("error al leer archivo temporal: %v", err)
+		}
+		mediaFile = nil
 	}
 
 	// Procesar imagen si es necesario
+	var processed *ProcessedImage
 	if req.MediaType == "image" {
-		mediaBytes, mimeType, err = processImageForWhatsApp(mediaBytes, mimeType)
+		processed, err = processImageForWhatsApp(mediaBytes)
 		if err != nil {
 			return nil, fmt.Errorf("error al procesar imagen: %v", err)
 		}
+		mediaBytes, mimeType = processed.Data, "image/jpeg"
+	}
+
+	// Miniatura del video, si se adjuntó una imagen
+	var videoThumbnail []byte
+	if req.MediaType == "video" && req.Thumbnail != "" {
+		thumbnailBytes, err := decodeBase64Media(req.Thumbnail)
+		if err == nil {
+			videoThumbnail, err = thumbnailFromBytes(thumbnailBytes)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error al procesar miniatura: %v", err)
+		}
+	}
+
+	// Convertir a sticker WebP 512x512
+	if req.MediaType == "sticker" {
+		mediaBytes, err = processStickerForWhatsApp(mediaBytes)
+		if err != nil {
+			return nil, fmt.Errorf("error al procesar sticker: %v", err)
+		}
+		mimeType = "image/webp"
 	}
 
 	// Mapear tipo de media a tipo de WhatsApp correcto
 	var whatsappMediaType whatsmeow.MediaType
 	switch req.MediaType {
-	case "image":
+	case "image", "sticker":
 		whatsappMediaType = whatsmeow.MediaImage
 	case "audio", "voice":
 		whatsappMediaType = whatsmeow.MediaAudio
@@ -1204,18 +1668,24 @@ func createMediaMessage(client *whatsmeow.Client, req MessageRequest) (*waProto.
 		return nil, fmt.Errorf("tipo de media no soportado: %s", req.MediaType)
 	}
 
-	// Subir archivo a WhatsApp
-	uploaded, err := client.Upload(context.Background(), mediaBytes, whatsappMediaType)
+	// Subir archivo a WhatsApp; los archivos en disco se leen por partes
+	var uploaded whatsmeow.UploadResponse
+	if mediaFile != nil {
+		uploaded, err = client.UploadReader(context.Background(), mediaFile, nil, whatsappMediaType)
+	} else {
+		uploaded, err = client.Upload(context.Background(), mediaBytes, whatsappMediaType)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("error al subir archivo: %v (tamaño: %d bytes)", err, len(mediaBytes))
+		return nil, fmt.Errorf("error al subir archivo: %v (tamaño: %d bytes)", err, mediaSize)
 	}
 
-	log.Printf("Archivo subido exitosamente: URL=%s, tamaño=%d bytes", uploaded.URL, len(mediaBytes))
+	log.Printf("Archivo subido exitosamente: URL=%s, tamaño=%d bytes", uploaded.URL, uploaded.FileLength)
 
 	var msg *waProto.Message
 
 	switch req.MediaType {
 	case "image":
+		width, height := uint32(processed.Width), uint32(processed.Height)
 		msg = &waProto.Message{
 			ImageMessage: &waProto.ImageMessage{
 				Caption:       &req.Caption,
@@ -1226,6 +1696,25 @@ func createMediaMessage(client *whatsmeow.Client, req MessageRequest) (*waProto.
 				FileEncSHA256: uploaded.FileEncSHA256,
 				FileSHA256:    uploaded.FileSHA256,
 				FileLength:    &uploaded.FileLength,
+				Width:         &width,
+				Height:        &height,
+				JPEGThumbnail: processed.Thumbnail,
+			},
+		}
+
+	case "sticker":
+		stickerSize := uint32(stickerSize)
+		msg = &waProto.Message{
+			StickerMessage: &waProto.StickerMessage{
+				URL:           &uploaded.URL,
+				DirectPath:    &uploaded.DirectPath,
+				MediaKey:      uploaded.MediaKey,
+				Mimetype:      &mimeType,
+				FileEncSHA256: uploaded.FileEncSHA256,
+				FileSHA256:    uploaded.FileSHA256,
+				FileLength:    &uploaded.FileLength,
+				Width:         &stickerSize,
+				Height:        &stickerSize,
 			},
 		}
 
@@ -1270,6 +1759,7 @@ func createMediaMessage(client *whatsmeow.Client, req MessageRequest) (*waProto.
 				FileEncSHA256: uploaded.FileEncSHA256,
 				FileSHA256:    uploaded.FileSHA256,
 				FileLength:    &uploaded.FileLength,
+				JPEGThumbnail: videoThumbnail,
 			},
 		}
 
@@ -1327,36 +1817,73 @@ func encodeBase64(data []byte) string {
 }
 
 // Registrar mensaje en la base de datos
-func logMessage(lineID, direction, fromNumber, toNumber, messageType, messageText string, isGroup bool) error {
+func logMessage(msg StoredMessage) error {
 	query := `
 	INSERT INTO message_logs 
-	(line_id, direction, from_number, to_number, message_type, message_text, is_group)
-	VALUES (?, ?, ?, ?, ?, ?, ?)
+	(line_id, direction, message_id, chat_jid, sender, from_number, to_number, message_type, message_text, quoted_id, media_id, is_group, status)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 
-	// Limitar el texto del mensaje a 500 caracteres para no hacer la BD muy grande
-	if len(messageText) > 500 {
-		messageText = messageText[:500] + "..."
+	// Los mensajes enviados parten del acuse del servidor; los recibos los hacen avanzar
+	status := ""
+	if msg.Direction == "sent" {
+		status = DeliveryServerAck
+	}
+
+	// from_number/to_number se mantienen para las estadísticas: el contacto
+	// es el remitente en los recibidos y el chat en los enviados. Como en
+	// versiones anteriores, to_number de un envío a un contacto es solo el
+	// número; el JID completo queda en chat_jid
+	fromNumber, toNumber := msg.Sender, msg.Chat
+	if msg.Direction == "sent" {
+		if chat, err := types.ParseJID(msg.Chat); err == nil && chat.Server == types.DefaultUserServer {
+			toNumber = chat.User
+		}
 	}
 
-	_, err := configDB.Exec(query, lineID, direction, fromNumber, toNumber, messageType, messageText, isGroup)
+	_, err := configDB.Exec(query, msg.LineID, msg.Direction, msg.MessageID, msg.Chat, msg.Sender, fromNumber, toNumber,
+		msg.Type, msg.Text, nullIfEmpty(msg.QuotedID), nullIfEmpty(msg.MediaID), msg.IsGroup, status)
 	return err
 }
 
+// Guardar NULL en lugar de cadena vacía en columnas opcionales
+func nullIfEmpty(value string) interface{} {
+	if value == "" {
+		return nil
+	}
+	return value
+}
+
+// Modificador de datetime() de SQLite para los últimos days días
+func periodModifier(days int) string {
+	return fmt.Sprintf("-%d days", days)
+}
+
 // Obtener estadísticas
 func getStats(w http.ResponseWriter, r *http.Request) {
 	period := r.URL.Query().Get("period")
 	lineID := r.URL.Query().Get("line_id")
 	messageType := r.URL.Query().Get("message_type")
 
+	// Restricted keys can only read stats of their own lines
+	if key := apiKeyFromContext(r); key != nil && len(key.LineIDs) > 0 && (lineID == "" || !key.CanAccessLine(lineID)) {
+		http.Error(w, "La API key requiere line_id de una línea permitida", http.StatusForbidden)
+		return
+	}
+
 	// Default period: 30 days
 	if period == "" {
 		period = "30"
 	}
+	days, err := strconv.Atoi(period)
+	if err != nil || days < 1 {
+		http.Error(w, "period debe ser un número de días positivo", http.StatusBadRequest)
+		return
+	}
 
 	// Build WHERE clause
-	whereConditions := []string{fmt.Sprintf("timestamp >= datetime('now', '-%s days')", period)}
-	args := []interface{}{}
+	whereConditions := []string{"timestamp >= datetime('now', ?)"}
+	args := []interface{}{periodModifier(days)}
 
 	if lineID != "" {
 		whereConditions = append(whereConditions, "line_id = ?")
@@ -1380,7 +1907,7 @@ func getStats(w http.ResponseWriter, r *http.Request) {
 
 	// Total messages
 	var totalMessages int
-	err := configDB.QueryRow("SELECT COUNT(*) FROM message_logs "+whereClause, args...).Scan(&totalMessages)
+	err = configDB.QueryRow("SELECT COUNT(*) FROM message_logs "+whereClause, args...).Scan(&totalMessages)
 	if err != nil {
 		log.Printf("Error getting total messages: %v", err)
 	}
@@ -1404,6 +1931,27 @@ func getStats(w http.ResponseWriter, r *http.Request) {
 	}
 	overview["total_received"] = totalReceived
 
+	// Delivery and read rates (only sent messages tracked with a WhatsApp ID)
+	var trackedSent, delivered, read int
+	err = configDB.QueryRow(`
+	SELECT
+		COUNT(*),
+		COALESCE(SUM(CASE WHEN status IN ('delivered', 'read', 'played') THEN 1 ELSE 0 END), 0),
+		COALESCE(SUM(CASE WHEN status IN ('read', 'played') THEN 1 ELSE 0 END), 0)
+	FROM message_logs
+	`+whereClause+` AND direction = 'sent' AND message_id IS NOT NULL AND message_id != ''`, args...).Scan(&trackedSent, &delivered, &read)
+	if err != nil {
+		log.Printf("Error getting delivery rates: %v", err)
+	}
+	overview["total_delivered"] = delivered
+	overview["total_read"] = read
+	overview["delivered_rate"] = 0.0
+	overview["read_rate"] = 0.0
+	if trackedSent > 0 {
+		overview["delivered_rate"] = math.Round(float64(delivered)*1000/float64(trackedSent)) / 10
+		overview["read_rate"] = math.Round(float64(read)*1000/float64(trackedSent)) / 10
+	}
+
 	// Total active lines
 	linesMutex.RLock()
 	activeLines := 0
@@ -1415,6 +1963,12 @@ func getStats(w http.ResponseWriter, r *http.Request) {
 	linesMutex.RUnlock()
 	overview["total_lines"] = activeLines
 
+	// Calls (not affected by message_type)
+	callStats := getCallStats(days, lineID)
+	overview["total_calls"] = callStats["total"]
+	overview["rejected_calls"] = callStats["rejected"]
+	stats["calls"] = callStats
+
 	stats["overview"] = overview
 
 	// Messages per day
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow/store/sqlstore"
+	"go.mau.fi/whatsmeow/types"
+	waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+// Servidor de prueba con la API completa sobre el transporte fake y bases
+// de datos temporales
+func setupTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	dir := t.TempDir()
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "config.db")+"?_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		t.Fatalf("Error al abrir base de datos: %v", err)
+	}
+	// Los goroutines de las líneas pueden seguir escribiendo al terminar
+	// el test: la base queda cerrada, no en nil
+	configDB = db
+	t.Cleanup(func() { db.Close() })
+
+	if err := initConfigDatabase(); err != nil {
+		t.Fatalf("Error al inicializar base de datos: %v", err)
+	}
+
+	container, err = sqlstore.New(context.Background(), "sqlite3", "file:"+filepath.Join(dir, "whatsapp.db")+"?_foreign_keys=on", waLog.Noop)
+	if err != nil {
+		t.Fatalf("Error al crear contenedor de base de datos: %v", err)
+	}
+
+	previousTransport, previousToken := transport, bootstrapToken
+	transport = "fake"
+	bootstrapToken = "test-bootstrap"
+	t.Cleanup(func() {
+		transport, bootstrapToken = previousTransport, previousToken
+	})
+
+	t.Cleanup(func() {
+		linesMutex.Lock()
+		defer linesMutex.Unlock()
+		for id, line := range lines {
+			stopOutboundWorkers(line)
+			delete(lines, id)
+		}
+	})
+
+	server := httptest.NewServer(newRouter())
+	t.Cleanup(server.Close)
+	return server
+}
+
+// Llamar a la API y decodificar la respuesta JSON en out (si no es nil)
+func doJSON(t *testing.T, server *httptest.Server, method, path, key string, body, out interface{}) int {
+	t.Helper()
+
+	var payload bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			t.Fatalf("Error al codificar %s %s: %v", method, path, err)
+		}
+	}
+
+	req, err := http.NewRequest(method, server.URL+path, &payload)
+	if err != nil {
+		t.Fatalf("Error al crear %s %s: %v", method, path, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", key)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error en %s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	if out != nil && resp.StatusCode < 300 {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("Respuesta inválida de %s %s: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// Esperar a que se cumpla cond; los eventos se procesan en goroutines
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Tiempo agotado esperando %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Recorrido completo de una línea: alta, vinculación, envío, recibo y
+// cierre de sesión
+func TestLineLifecycle(t *testing.T) {
+	server := setupTestServer(t)
+
+	// La primera key se crea con el token de bootstrap
+	var created struct {
+		Key string `json:"key"`
+	}
+	status := doJSON(t, server, "POST", "/api/keys", bootstrapToken, map[string]interface{}{
+		"name":   "e2e",
+		"scopes": []string{"*"},
+	}, &created)
+	if status != http.StatusCreated || created.Key == "" {
+		t.Fatalf("Crear API key: status %d", status)
+	}
+	key := created.Key
+
+	var newLine struct {
+		ID string `json:"id"`
+	}
+	if status := doJSON(t, server, "POST", "/api/lines", key, map[string]string{"name": "Ventas"}, &newLine); status != http.StatusOK {
+		t.Fatalf("Crear línea: status %d", status)
+	}
+
+	linesMutex.RLock()
+	line := lines[newLine.ID]
+	linesMutex.RUnlock()
+	if line == nil {
+		t.Fatalf("La línea %s no quedó registrada", newLine.ID)
+	}
+	fake := line.Client.(*FakeClient)
+
+	// Sin sesión no se puede enviar
+	msg := map[string]string{"from": line.ID, "to": "5491122334455", "message": "Hola"}
+	if status := doJSON(t, server, "POST", "/api/messages/send", key, msg, nil); status != http.StatusServiceUnavailable {
+		t.Fatalf("Enviar sin vincular: status %d, se esperaba 503", status)
+	}
+
+	// Vincular: esperar a que connectLine abra el canal QR
+	waitFor(t, "el código QR", func() bool { return line.Status == "qr_pending" })
+	own := types.NewJID("5491100000000", types.DefaultUserServer)
+	fake.Pair(own)
+	waitFor(t, "la conexión", func() bool { return line.Status == "connected" && line.Available })
+
+	var sent struct {
+		ID         string `json:"id"`
+		Status     string `json:"status"`
+		WhatsAppID string `json:"whatsapp_id"`
+	}
+	if status := doJSON(t, server, "POST", "/api/messages/send", key, msg, &sent); status != http.StatusOK {
+		t.Fatalf("Enviar mensaje: status %d", status)
+	}
+	if sent.Status != QueueStatusSent || sent.WhatsAppID == "" {
+		t.Fatalf("Envío: status %q, whatsapp_id %q", sent.Status, sent.WhatsAppID)
+	}
+
+	outgoing := fake.Sent()
+	if len(outgoing) != 1 || string(outgoing[0].ID) != sent.WhatsAppID || outgoing[0].Message.GetConversation() != "Hola" {
+		t.Fatalf("Mensajes entregados al transporte: %+v", outgoing)
+	}
+
+	var queueStatus, recipient string
+	var sentAt sql.NullTime
+	err := configDB.QueryRow(`
+		SELECT status, recipient, sent_at FROM outbound_queue WHERE id = ?
+	`, sent.ID).Scan(&queueStatus, &recipient, &sentAt)
+	if err != nil {
+		t.Fatalf("Fila de outbound_queue: %v", err)
+	}
+	if queueStatus != QueueStatusSent || recipient != "5491122334455" || !sentAt.Valid {
+		t.Fatalf("outbound_queue: status %q, recipient %q, sent_at %v", queueStatus, recipient, sentAt)
+	}
+
+	var direction, text, chat, sender string
+	err = configDB.QueryRow(`
+		SELECT direction, message_text, chat_jid, sender FROM message_logs WHERE line_id = ? AND message_id = ?
+	`, line.ID, sent.WhatsAppID).Scan(&direction, &text, &chat, &sender)
+	if err != nil {
+		t.Fatalf("Fila de message_logs: %v", err)
+	}
+	if direction != "sent" || text != "Hola" || chat != "5491122334455@s.whatsapp.net" || sender != own.String() {
+		t.Fatalf("message_logs: direction %q, text %q, chat %q, sender %q", direction, text, chat, sender)
+	}
+
+	// El recibo de entrega actualiza el historial y el estado del mensaje
+	contact := types.NewJID("5491122334455", types.DefaultUserServer)
+	fake.EmitReceipt(contact, contact, types.ReceiptTypeDelivered, types.MessageID(sent.WhatsAppID))
+	waitFor(t, "el recibo", func() bool {
+		var delivery sql.NullString
+		configDB.QueryRow(`
+			SELECT status FROM message_logs WHERE line_id = ? AND message_id = ?
+		`, line.ID, sent.WhatsAppID).Scan(&delivery)
+		return delivery.String == DeliveryDelivered
+	})
+
+	var item QueuedMessage
+	if status := doJSON(t, server, "GET", "/api/messages/"+sent.ID, key, nil, &item); status != http.StatusOK {
+		t.Fatalf("Consultar mensaje: status %d", status)
+	}
+	if item.DeliveryInfo == nil || item.DeliveryInfo.Status != DeliveryDelivered {
+		t.Fatalf("Estado de entrega: %+v", item.DeliveryInfo)
+	}
+
+	// Al cerrar la sesión la línea deja de estar disponible
+	fake.EmitLoggedOut()
+	var current struct {
+		Status    string `json:"status"`
+		Available bool   `json:"available"`
+	}
+	if status := doJSON(t, server, "GET", "/api/lines/"+line.ID, key, nil, &current); status != http.StatusOK {
+		t.Fatalf("Consultar línea: status %d", status)
+	}
+	if current.Status != "disconnected" || current.Available {
+		t.Fatalf("Tras cerrar sesión: status %q, available %v", current.Status, current.Available)
+	}
+	if status := doJSON(t, server, "POST", "/api/messages/send", key, msg, nil); status != http.StatusServiceUnavailable {
+		t.Fatalf("Enviar tras cerrar sesión: status %d, se esperaba 503", status)
+	}
+}
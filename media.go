@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// MediaStore guarda los archivos multimedia recibidos. La implementación
+// por defecto usa un directorio local; puede reemplazarse por otra (S3, etc.)
+// asignando mediaStore al iniciar.
+type MediaStore interface {
+	Save(name string, data []byte) (location string, err error)
+	Open(location string) (io.ReadSeekCloser, error)
+	Delete(location string) error
+}
+
+// LocalMediaStore guarda los archivos en un directorio del disco
+type LocalMediaStore struct {
+	Dir string
+}
+
+func (s *LocalMediaStore) Save(name string, data []byte) (string, error) {
+	// Agrupar por día para no acumular miles de archivos en un directorio
+	subdir := time.Now().UTC().Format("2006-01-02")
+	if err := os.MkdirAll(filepath.Join(s.Dir, subdir), 0755); err != nil {
+		return "", err
+	}
+
+	location := filepath.Join(subdir, name)
+	if err := os.WriteFile(filepath.Join(s.Dir, location), data, 0644); err != nil {
+		return "", err
+	}
+	return location, nil
+}
+
+func (s *LocalMediaStore) Open(location string) (io.ReadSeekCloser, error) {
+	return os.Open(filepath.Join(s.Dir, filepath.Clean("/"+location)))
+}
+
+func (s *LocalMediaStore) Delete(location string) error {
+	err := os.Remove(filepath.Join(s.Dir, filepath.Clean("/"+location)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Archivo multimedia recibido, referenciado desde message_logs
+type MediaFile struct {
+	ID        string    `json:"id"`
+	LineID    string    `json:"line_id"`
+	MessageID string    `json:"message_id"`
+	URL       string    `json:"url"`
+	MimeType  string    `json:"mime_type"`
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256"`
+	FileName  string    `json:"file_name,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+
+	location string
+}
+
+var (
+	mediaStore MediaStore = &LocalMediaStore{Dir: envOrDefault("WHATSGO_MEDIA_DIR", "./sessions/media")}
+	// Días que se conservan los archivos recibidos; 0 = indefinidamente
+	mediaRetentionDays = envIntOrDefault("WHATSGO_MEDIA_RETENTION_DAYS", 30)
+	// URL pública base para construir enlaces absolutos en los webhooks
+	publicBaseURL = strings.TrimSuffix(os.Getenv("WHATSGO_PUBLIC_URL"), "/")
+)
+
+func envOrDefault(name, def string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return def
+}
+
+func envIntOrDefault(name string, def int) int {
+	if value, err := strconv.Atoi(os.Getenv(name)); err == nil {
+		return value
+	}
+	return def
+}
+
+// URL con la que se descarga un archivo a través de la API
+func mediaURL(id string) string {
+	return publicBaseURL + "/api/media/" + id
+}
+
+// Obtener la parte descargable de un mensaje multimedia
+func downloadableOf(msg *waProto.Message) (whatsmeow.DownloadableMessage, string, string) {
+	switch {
+	case msg.GetImageMessage() != nil:
+		return msg.GetImageMessage(), msg.GetImageMessage().GetMimetype(), ""
+	case msg.GetAudioMessage() != nil:
+		return msg.GetAudioMessage(), msg.GetAudioMessage().GetMimetype(), ""
+	case msg.GetVideoMessage() != nil:
+		return msg.GetVideoMessage(), msg.GetVideoMessage().GetMimetype(), ""
+	case msg.GetStickerMessage() != nil:
+		return msg.GetStickerMessage(), msg.GetStickerMessage().GetMimetype(), ""
+	case msg.GetDocumentMessage() != nil:
+		doc := msg.GetDocumentMessage()
+		return doc, doc.GetMimetype(), doc.GetFileName()
+	}
+	return nil, "", ""
+}
+
+// Extensión de archivo para un MIME type
+func extensionForMime(mimeType string) string {
+	base := strings.TrimSpace(strings.Split(mimeType, ";")[0])
+	switch base {
+	case "image/jpeg":
+		return ".jpg"
+	case "image/png":
+		return ".png"
+	case "image/webp":
+		return ".webp"
+	case "audio/ogg":
+		return ".ogg"
+	case "audio/mpeg":
+		return ".mp3"
+	case "audio/mp4":
+		return ".m4a"
+	case "audio/aac":
+		return ".aac"
+	case "audio/amr":
+		return ".amr"
+	case "video/mp4":
+		return ".mp4"
+	case "video/3gpp":
+		return ".3gp"
+	case "application/pdf":
+		return ".pdf"
+	case "application/zip":
+		return ".zip"
+	case "text/plain":
+		return ".txt"
+	}
+	if exts, _ := mime.ExtensionsByType(base); len(exts) > 0 {
+		return exts[0]
+	}
+	return ".bin"
+}
+
+// Descargar y guardar el archivo de un mensaje entrante; nil si el
+// mensaje no tiene media
+func downloadIncomingMedia(line *Line, evt *events.Message) (*MediaFile, error) {
+	downloadable, mimeType, fileName := downloadableOf(evt.Message)
+	if downloadable == nil {
+		return nil, nil
+	}
+
+	data, err := line.Client.Download(context.Background(), downloadable)
+	if err != nil {
+		return nil, fmt.Errorf("error al descargar media: %v", err)
+	}
+
+	sum := sha256.Sum256(data)
+	media := &MediaFile{
+		ID:        fmt.Sprintf("media_%d", time.Now().UnixNano()),
+		LineID:    line.ID,
+		MessageID: evt.Info.ID,
+		MimeType:  mimeType,
+		Size:      int64(len(data)),
+		SHA256:    hex.EncodeToString(sum[:]),
+		FileName:  fileName,
+		CreatedAt: time.Now().UTC(),
+	}
+	media.URL = mediaURL(media.ID)
+
+	media.location, err = mediaStore.Save(media.ID+extensionForMime(mimeType), data)
+	if err != nil {
+		return nil, fmt.Errorf("error al guardar media: %v", err)
+	}
+
+	_, err = configDB.Exec(`
+		INSERT INTO media_files (id, line_id, message_id, mime_type, size, sha256, file_name, location, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, media.ID, media.LineID, media.MessageID, media.MimeType, media.Size, media.SHA256, media.FileName, media.location, media.CreatedAt)
+	if err != nil {
+		mediaStore.Delete(media.location)
+		return nil, fmt.Errorf("error al registrar media: %v", err)
+	}
+
+	log.Printf("Media %s guardado para línea %s (%d bytes, %s)", media.ID, line.ID, media.Size, media.MimeType)
+	return media, nil
+}
+
+// Obtener un archivo registrado
+func getMediaFile(id string) (*MediaFile, error) {
+	var media MediaFile
+	var messageID, fileName sql.NullString
+
+	err := configDB.QueryRow(`
+		SELECT id, line_id, message_id, mime_type, size, sha256, file_name, location, created_at
+		FROM media_files WHERE id = ?
+	`, id).Scan(&media.ID, &media.LineID, &messageID, &media.MimeType, &media.Size,
+		&media.SHA256, &fileName, &media.location, &media.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	media.MessageID = messageID.String
+	media.FileName = fileName.String
+	media.URL = mediaURL(media.ID)
+	return &media, nil
+}
+
+// Descargar un archivo multimedia recibido
+func getMedia(w http.ResponseWriter, r *http.Request) {
+	media, err := getMediaFile(mux.Vars(r)["id"])
+	if err == sql.ErrNoRows || (err == nil && !canAccessLine(r, media.LineID)) {
+		http.Error(w, "Archivo no encontrado", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error al consultar media: %v", err)
+		http.Error(w, "Error al consultar archivo", http.StatusInternalServerError)
+		return
+	}
+
+	file, err := mediaStore.Open(media.location)
+	if os.IsNotExist(err) {
+		http.Error(w, "El archivo expiró", http.StatusGone)
+		return
+	} else if err != nil {
+		log.Printf("Error al abrir media %s: %v", media.ID, err)
+		http.Error(w, "Error al abrir archivo", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	name := media.FileName
+	if name == "" {
+		name = media.ID + extensionForMime(media.MimeType)
+	}
+
+	// El tipo declarado lo elige quien envió el archivo: solo se muestran en
+	// el navegador las imágenes, audios y videos reconocidos por su contenido.
+	// El resto se descarga, sin permitir que se ejecute como documento
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(file, head)
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		log.Printf("Error al leer media %s: %v", media.ID, err)
+		http.Error(w, "Error al abrir archivo", http.StatusInternalServerError)
+		return
+	}
+
+	contentType, disposition := media.MimeType, "attachment"
+	if sniffed := sniffMimeType(head[:n]); isInlineMime(sniffed) {
+		contentType, disposition = sniffed, "inline"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": name}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox; default-src 'none'")
+	w.Header().Set("X-Content-SHA256", media.SHA256)
+	http.ServeContent(w, r, name, media.CreatedAt, file)
+}
+
+// Tipos que pueden mostrarse en el navegador sin ejecutar código. SVG queda
+// fuera porque admite scripts
+func isInlineMime(mimeType string) bool {
+	if mimeType == "image/svg+xml" {
+		return false
+	}
+	return strings.HasPrefix(mimeType, "image/") || strings.HasPrefix(mimeType, "audio/") ||
+		strings.HasPrefix(mimeType, "video/")
+}
+
+// Eliminar archivos más antiguos que el período de retención
+func purgeExpiredMedia() {
+	if mediaRetentionDays <= 0 {
+		return
+	}
+
+	cutoff := time.Now().UTC().AddDate(0, 0, -mediaRetentionDays)
+	rows, err := configDB.Query("SELECT id, location FROM media_files WHERE created_at < ?", cutoff)
+	if err != nil {
+		log.Printf("Error al buscar media expirado: %v", err)
+		return
+	}
+
+	type expired struct{ id, location string }
+	var files []expired
+	for rows.Next() {
+		var f expired
+		if err := rows.Scan(&f.id, &f.location); err == nil {
+			files = append(files, f)
+		}
+	}
+	rows.Close()
+
+	for _, f := range files {
+		if err := mediaStore.Delete(f.location); err != nil {
+			log.Printf("Error al eliminar media %s: %v", f.id, err)
+			continue
+		}
+		configDB.Exec("DELETE FROM media_files WHERE id = ?", f.id)
+	}
+
+	if len(files) > 0 {
+		log.Printf("Media expirado eliminado: %d archivo(s)", len(files))
+	}
+}
+
+// Ejecutar la limpieza de media periódicamente
+func startMediaRetention() {
+	go func() {
+		for {
+			purgeExpiredMedia()
+			purgeStagedMedia()
+			time.Sleep(time.Hour)
+		}
+	}()
+}
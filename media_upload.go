@@ -0,0 +1,384 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Los archivos enviados por media_url, multipart o media_data se guardan en
+// disco antes de encolarse, en lugar de viajar en base64 dentro de la cola
+var (
+	uploadDir = envOrDefault("WHATSGO_UPLOAD_DIR", "./sessions/uploads")
+	// Redes privadas a las que media_url sí puede acceder, separadas por
+	// comas (p.ej. "10.0.0.0/8,192.168.1.20")
+	mediaURLAllowedNets = parseAllowedNets(os.Getenv("WHATSGO_MEDIA_URL_ALLOW"))
+	// Cliente para descargar media_url
+	mediaFetchClient = newMediaFetchClient()
+)
+
+const (
+	// Redirecciones que se siguen al descargar media_url
+	maxMediaURLRedirects = 5
+	// Tamaño máximo de los campos de texto de un envío multipart
+	maxMultipartFieldSize = 64 * 1024
+	// Los archivos temporales sin un envío pendiente se eliminan tras este tiempo
+	stagedMediaTTL = time.Hour
+)
+
+// El archivo superó el límite mientras se leía
+var errMediaTooLarge = errors.New("archivo muy grande")
+
+// Guardar el contenido de r en un archivo temporal sin pasar de limit bytes.
+// Devuelve también los primeros bytes para detectar el tipo de archivo
+func stageMedia(r io.Reader, limit int64) (string, []byte, int64, error) {
+	if err := os.MkdirAll(uploadDir, 0755); err != nil {
+		return "", nil, 0, err
+	}
+	file, err := os.CreateTemp(uploadDir, "upload_*")
+	if err != nil {
+		return "", nil, 0, err
+	}
+	defer file.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	head = head[:n]
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		os.Remove(file.Name())
+		return "", nil, 0, errMediaTooLarge
+	} else if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		os.Remove(file.Name())
+		return "", nil, 0, fmt.Errorf("error al leer archivo: %v", err)
+	}
+
+	if _, err := file.Write(head); err != nil {
+		os.Remove(file.Name())
+		return "", nil, 0, err
+	}
+	copied, err := io.Copy(file, io.LimitReader(r, limit-int64(n)+1))
+	if errors.As(err, &maxBytesErr) {
+		os.Remove(file.Name())
+		return "", nil, 0, errMediaTooLarge
+	} else if err != nil {
+		os.Remove(file.Name())
+		return "", nil, 0, fmt.Errorf("error al leer archivo: %v", err)
+	}
+
+	size := int64(n) + copied
+	if size > limit {
+		os.Remove(file.Name())
+		return "", nil, 0, errMediaTooLarge
+	}
+	if size == 0 {
+		os.Remove(file.Name())
+		return "", nil, 0, fmt.Errorf("el archivo está vacío")
+	}
+	return file.Name(), head, size, nil
+}
+
+// Descargar media_url a un archivo temporal
+func fetchMediaURL(req *MessageRequest) error {
+	resp, err := mediaFetchClient.Get(req.MediaURL)
+	if err != nil {
+		return fmt.Errorf("no se pudo descargar media_url: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("media_url respondió %s", resp.Status)
+	}
+
+	limit := maxMediaSize(req.MediaType)
+	if resp.ContentLength > limit {
+		return mediaTooLarge(req.MediaType, resp.ContentLength, limit)
+	}
+
+	staged, _, size, err := stageMedia(resp.Body, limit)
+	if err == errMediaTooLarge {
+		return mediaTooLarge(req.MediaType, 0, limit)
+	} else if err != nil {
+		return fmt.Errorf("media_url: %v", err)
+	}
+
+	req.mediaFile = staged
+	req.mimeHint = resp.Header.Get("Content-Type")
+	if req.FileName == "" && req.MediaType == "document" {
+		req.FileName = remoteFileName(resp)
+	}
+
+	log.Printf("media_url descargado: %s (%d bytes)", req.MediaURL, size)
+	return nil
+}
+
+// Nombre del archivo descargado: Content-Disposition o el final de la URL
+func remoteFileName(resp *http.Response) string {
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		return filepath.Base(params["filename"])
+	}
+	if name := path.Base(resp.Request.URL.Path); name != "/" && name != "." {
+		return name
+	}
+	return ""
+}
+
+// Validar media_url antes de encolar. Las direcciones IP se revisan aquí y
+// de nuevo al conectar, ya resuelto el nombre
+func validateMediaURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("media_url debe ser una URL http(s) válida")
+	}
+	if ip := net.ParseIP(u.Hostname()); ip != nil && !mediaURLAddressAllowed(ip) {
+		return fmt.Errorf("media_url no puede apuntar a una dirección privada: %s", ip)
+	}
+	return nil
+}
+
+// Cliente de media_url: solo se conecta a direcciones públicas (salvo las de
+// WHATSGO_MEDIA_URL_ALLOW) y revalida cada redirección. No usa el proxy del
+// entorno, que haría la conexión en nuestro lugar
+func newMediaFetchClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 30 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !mediaURLAddressAllowed(ip) {
+				return fmt.Errorf("dirección no permitida: %s", host)
+			}
+			return nil
+		},
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{
+		Timeout:   2 * time.Minute,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxMediaURLRedirects {
+				return fmt.Errorf("demasiadas redirecciones")
+			}
+			return validateMediaURL(req.URL.String())
+		},
+	}
+}
+
+// Indica si media_url puede conectarse a ip: las direcciones públicas y las
+// incluidas en WHATSGO_MEDIA_URL_ALLOW
+func mediaURLAddressAllowed(ip net.IP) bool {
+	for _, allowed := range mediaURLAllowedNets {
+		if allowed.Contains(ip) {
+			return true
+		}
+	}
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() || ip.IsUnspecified() || sharedAddressSpace.Contains(ip))
+}
+
+// 100.64.0.0/10 (CGNAT), que IsPrivate no incluye
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// Leer una lista de redes o direcciones IP separadas por comas
+func parseAllowedNets(value string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, entry := range splitList(value) {
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Printf("WHATSGO_MEDIA_URL_ALLOW: red inválida %s", entry)
+			continue
+		}
+		nets = append(nets, network)
+	}
+	return nets
+}
+
+// Leer la solicitud de envío, en JSON o en multipart/form-data
+func decodeMessageRequest(w http.ResponseWriter, r *http.Request) (MessageRequest, error) {
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if contentType == "multipart/form-data" {
+		return decodeMultipartMessageRequest(w, r)
+	}
+
+	var req MessageRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	return req, err
+}
+
+// Leer un envío multipart: los campos de texto de MessageRequest y el
+// archivo en "file", que se guarda en disco a medida que llega
+func decodeMultipartMessageRequest(w http.ResponseWriter, r *http.Request) (req MessageRequest, err error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize()+1024*1024)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return req, fmt.Errorf("multipart inválido: %v", err)
+	}
+
+	defer func() {
+		if err != nil {
+			discardStagedMedia(req)
+		}
+	}()
+
+	var fileName, replyToChat string
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return req, fmt.Errorf("multipart inválido: %v", err)
+		}
+
+		if part.FormName() == "file" {
+			if req.mediaFile != "" {
+				return req, fmt.Errorf("solo se admite un archivo por mensaje")
+			}
+			req.mediaFile, _, _, err = stageMedia(part, maxUploadSize())
+			if err == errMediaTooLarge {
+				return req, mediaTooLarge(req.MediaType, 0, maxUploadSize())
+			} else if err != nil {
+				return req, err
+			}
+			fileName = part.FileName()
+			req.mimeHint = part.Header.Get("Content-Type")
+			continue
+		}
+
+		// La miniatura de un video puede enviarse como archivo
+		if part.FormName() == "thumbnail" && part.FileName() != "" {
+			limit := maxMediaSize("image")
+			data, err := io.ReadAll(io.LimitReader(part, limit+1))
+			if err != nil {
+				return req, fmt.Errorf("multipart inválido: %v", err)
+			}
+			if int64(len(data)) > limit {
+				return req, mediaTooLarge("image", 0, limit)
+			}
+			req.Thumbnail = base64.StdEncoding.EncodeToString(data)
+			continue
+		}
+
+		data, err := io.ReadAll(io.LimitReader(part, maxMultipartFieldSize))
+		if err != nil {
+			return req, fmt.Errorf("multipart inválido: %v", err)
+		}
+		value := string(data)
+
+		switch part.FormName() {
+		case "from":
+			req.From = value
+		case "to":
+			req.To = value
+		case "message":
+			req.Message = value
+		case "media_type":
+			req.MediaType = value
+		case "caption":
+			req.Caption = value
+		case "file_name":
+			req.FileName = value
+		case "mime_type":
+			req.MimeType = value
+		case "media_url":
+			req.MediaURL = value
+		case "async":
+			req.Async, _ = strconv.ParseBool(value)
+		case "reply_to":
+			req.ReplyTo = &ReplyTo{MessageID: value}
+		case "reply_to_chat":
+			replyToChat = value
+		case "mentions":
+			req.Mentions = append(req.Mentions, value)
+		case "strategy":
+			req.Strategy = value
+		case "pool":
+			req.Pool = value
+		case "tags":
+			req.Tags = append(req.Tags, value)
+		case "on_limit":
+			req.OnLimit = value
+		case "simulate_typing":
+			if simulate, err := strconv.ParseBool(value); err == nil {
+				req.SimulateTyping = &simulate
+			}
+		case "thumbnail":
+			req.Thumbnail = value
+		}
+	}
+
+	if req.ReplyTo != nil {
+		req.ReplyTo.Chat = replyToChat
+	}
+
+	if req.mediaFile != "" && req.FileName == "" {
+		req.FileName = fileName
+	}
+
+	return req, nil
+}
+
+// Eliminar el archivo temporal de una solicitud, si lo tiene
+func discardStagedMedia(req MessageRequest) {
+	if req.mediaFile == "" {
+		return
+	}
+	if err := os.Remove(req.mediaFile); err != nil && !os.IsNotExist(err) {
+		log.Printf("Error al eliminar archivo temporal %s: %v", req.mediaFile, err)
+	}
+}
+
+// Eliminar archivos temporales huérfanos: solicitudes rechazadas o
+// mensajes de líneas eliminadas
+func purgeStagedMedia() {
+	entries, err := os.ReadDir(uploadDir)
+	if err != nil {
+		return
+	}
+
+	cutoff := time.Now().Add(-stagedMediaTTL)
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || entry.IsDir() || info.ModTime().After(cutoff) {
+			continue
+		}
+
+		staged := filepath.Join(uploadDir, entry.Name())
+		var id string
+		err = configDB.QueryRow(`
+			SELECT id FROM outbound_queue WHERE media_file = ? AND status IN (?, ?) LIMIT 1
+		`, staged, QueueStatusQueued, QueueStatusSending).Scan(&id)
+		if err == sql.ErrNoRows {
+			os.Remove(staged)
+		}
+	}
+}
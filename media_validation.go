@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Límites por tipo de media, configurables con WHATSGO_MAX_<TIPO>_MB
+var mediaSizeLimits = map[string]int64{
+	"image":    megabytesFromEnv("WHATSGO_MAX_IMAGE_MB", 5),
+	"sticker":  megabytesFromEnv("WHATSGO_MAX_STICKER_MB", 5),
+	"audio":    megabytesFromEnv("WHATSGO_MAX_AUDIO_MB", 16),
+	"voice":    megabytesFromEnv("WHATSGO_MAX_VOICE_MB", 16),
+	"video":    megabytesFromEnv("WHATSGO_MAX_VIDEO_MB", 16),
+	"document": megabytesFromEnv("WHATSGO_MAX_DOCUMENT_MB", 100),
+}
+
+// Formatos que WhatsApp acepta por tipo de media; los documentos admiten
+// cualquier formato
+var allowedMimeTypes = map[string][]string{
+	"image":   {"image/jpeg", "image/png", "image/webp"},
+	"sticker": {"image/png", "image/jpeg", "image/webp"},
+	"audio":   {"audio/ogg", "audio/mpeg", "audio/mp4", "audio/aac", "audio/amr"},
+	"voice":   {"audio/ogg"},
+	"video":   {"video/mp4", "video/3gpp"},
+}
+
+// Nombres alternativos de un mismo formato
+var mimeAliases = map[string]string{
+	"image/jpg":                    "image/jpeg",
+	"image/pjpeg":                  "image/jpeg",
+	"audio/mp3":                    "audio/mpeg",
+	"audio/opus":                   "audio/ogg",
+	"application/ogg":              "audio/ogg",
+	"audio/x-m4a":                  "audio/mp4",
+	"audio/m4a":                    "audio/mp4",
+	"audio/x-aac":                  "audio/aac",
+	"audio/aacp":                   "audio/aac",
+	"audio/wave":                   "audio/wav",
+	"audio/x-wav":                  "audio/wav",
+	"application/x-zip-compressed": "application/zip",
+}
+
+func megabytesFromEnv(name string, def int) int64 {
+	return int64(envIntOrDefault(name, def)) * 1024 * 1024
+}
+
+// Tamaño máximo por tipo de media; 0 si el tipo no lleva archivo
+func maxMediaSize(mediaType string) int64 {
+	return mediaSizeLimits[mediaType]
+}
+
+// Tamaño máximo de cualquier archivo, para leer antes de conocer su tipo
+func maxUploadSize() int64 {
+	var max int64
+	for _, limit := range mediaSizeLimits {
+		if limit > max {
+			max = limit
+		}
+	}
+	return max
+}
+
+// Error de validación de media; se responde como JSON con Status (413 o 415)
+type MediaError struct {
+	Status    int      `json:"-"`
+	Code      string   `json:"code"` // "media_too_large" o "unsupported_media_type"
+	Message   string   `json:"error"`
+	MediaType string   `json:"media_type,omitempty"`
+	MimeType  string   `json:"mime_type,omitempty"`          // Detectado por el contenido
+	Declared  string   `json:"declared_mime_type,omitempty"` // Indicado en la solicitud
+	Size      int64    `json:"size,omitempty"`
+	MaxSize   int64    `json:"max_size,omitempty"`
+	Allowed   []string `json:"allowed,omitempty"`
+}
+
+func (e *MediaError) Error() string {
+	return e.Message
+}
+
+// El archivo excede el límite; size es 0 si se cortó la lectura al superarlo
+func mediaTooLarge(mediaType string, size, maxSize int64) *MediaError {
+	message := fmt.Sprintf("archivo muy grande (máximo: %d bytes)", maxSize)
+	if size > 0 {
+		message = fmt.Sprintf("archivo muy grande: %d bytes (máximo: %d bytes)", size, maxSize)
+	}
+	return &MediaError{
+		Status:    http.StatusRequestEntityTooLarge,
+		Code:      "media_too_large",
+		Message:   message,
+		MediaType: mediaType,
+		Size:      size,
+		MaxSize:   maxSize,
+	}
+}
+
+func unsupportedMedia(mediaType, detected, declared, message string) *MediaError {
+	return &MediaError{
+		Status:    http.StatusUnsupportedMediaType,
+		Code:      "unsupported_media_type",
+		Message:   message,
+		MediaType: mediaType,
+		MimeType:  detected,
+		Declared:  declared,
+		Allowed:   allowedMimeTypes[mediaType],
+	}
+}
+
+// Responder un error de una solicitud de envío: los de media como JSON con
+// su código, el resto como 400
+func writeRequestError(w http.ResponseWriter, err error) {
+	var mediaErr *MediaError
+	if errors.As(err, &mediaErr) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(mediaErr.Status)
+		json.NewEncoder(w).Encode(mediaErr)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+// Normalizar un MIME type: sin parámetros, en minúsculas y sin alias
+func normalizeMime(mimeType string) string {
+	base, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		base = strings.ToLower(strings.TrimSpace(strings.Split(mimeType, ";")[0]))
+	}
+	if alias, ok := mimeAliases[base]; ok {
+		return alias
+	}
+	return base
+}
+
+// Detectar el formato por los primeros bytes del archivo. Completa a
+// http.DetectContentType con los formatos de audio y video de WhatsApp
+func sniffMimeType(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte("#!AMR")):
+		return "audio/amr"
+	case len(head) >= 12 && string(head[4:8]) == "ftyp":
+		brand := string(head[8:12])
+		switch {
+		case brand == "M4A " || brand == "M4B ":
+			return "audio/mp4"
+		case strings.HasPrefix(brand, "3gp") || strings.HasPrefix(brand, "3g2"):
+			return "video/3gpp"
+		case brand == "qt  ":
+			return "video/quicktime"
+		}
+		return "video/mp4"
+	case len(head) >= 2 && head[0] == 0xFF && head[1]&0xF6 == 0xF0:
+		// Cabecera ADTS: sincronía de 12 bits y capa 00
+		return "audio/aac"
+	case len(head) >= 2 && head[0] == 0xFF && head[1]&0xE0 == 0xE0 && head[1]&0x06 != 0:
+		// Trama MPEG de audio sin etiqueta ID3
+		return "audio/mpeg"
+	}
+	return normalizeMime(http.DetectContentType(head))
+}
+
+// Contenido que no permite identificar el formato
+func isGenericMime(mimeType string) bool {
+	return mimeType == "application/octet-stream" || mimeType == "text/plain"
+}
+
+// Formatos de documento que son un ZIP por dentro (Office, OpenDocument, EPUB...)
+func isZipBased(mimeType string) bool {
+	return strings.HasPrefix(mimeType, "application/vnd.openxmlformats-officedocument.") ||
+		strings.HasPrefix(mimeType, "application/vnd.oasis.opendocument.") ||
+		strings.HasSuffix(mimeType, "+zip") ||
+		mimeType == "application/java-archive" ||
+		mimeType == "application/vnd.android.package-archive"
+}
+
+// Indicar si el MIME type declarado corresponde al contenido detectado
+func mimeCompatible(declared, detected string) bool {
+	declared = normalizeMime(declared)
+	switch {
+	case declared == detected, isGenericMime(detected):
+		return true
+	case detected == "application/zip":
+		return isZipBased(declared)
+	case detected == "video/mp4":
+		// Los M4A suelen usar las mismas marcas ftyp que los MP4
+		return declared == "audio/mp4"
+	case strings.HasPrefix(detected, "text/"):
+		return strings.HasPrefix(declared, "text/") || strings.HasSuffix(declared, "+xml") || strings.HasSuffix(declared, "/xml")
+	}
+	return false
+}
+
+// Validar el contenido de la media y completar MIME type y nombre de
+// archivo. hint es un tipo sugerido por el origen (cabecera Content-Type)
+// que solo se usa si el contenido no es reconocible
+func validateMediaContent(req *MessageRequest, head []byte, size int64, hint string) error {
+	if limit := maxMediaSize(req.MediaType); size > limit {
+		return mediaTooLarge(req.MediaType, size, limit)
+	}
+
+	detected := sniffMimeType(head)
+	declared := req.MimeType
+
+	// Un MP4 enviado como audio es un M4A con marca ftyp genérica
+	if detected == "video/mp4" && (req.MediaType == "audio" || req.MediaType == "voice") {
+		detected = "audio/mp4"
+	}
+
+	if declared != "" && !mimeCompatible(declared, detected) {
+		return unsupportedMedia(req.MediaType, detected, declared,
+			fmt.Sprintf("El contenido del archivo (%s) no coincide con el MIME type indicado (%s)", detected, declared))
+	}
+
+	if allowed, ok := allowedMimeTypes[req.MediaType]; ok && !containsString(allowed, detected) {
+		return unsupportedMedia(req.MediaType, detected, declared,
+			fmt.Sprintf("Formato no soportado para %s: %s", req.MediaType, detected))
+	}
+
+	switch {
+	case declared != "":
+		// Se conserva lo declarado, que puede ser más preciso (p.ej. codecs)
+	case req.MediaType == "document" && (isGenericMime(detected) || detected == "application/zip"):
+		req.MimeType = detected
+		if byExt := mime.TypeByExtension(filepath.Ext(req.FileName)); byExt != "" {
+			req.MimeType = byExt
+		} else if hint != "" && normalizeMime(hint) != "application/octet-stream" {
+			req.MimeType = hint
+		}
+	case detected == "audio/ogg":
+		req.MimeType = "audio/ogg; codecs=opus"
+	default:
+		req.MimeType = detected
+	}
+
+	if req.MediaType == "document" {
+		ext := extensionForMime(req.MimeType)
+		if req.FileName == "" {
+			req.FileName = "documento" + ext
+		} else if filepath.Ext(req.FileName) == "" && ext != ".bin" {
+			req.FileName += ext
+		}
+	}
+
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Decodificar base64, con o sin prefijo Data URL
+func decodeBase64Media(data string) ([]byte, error) {
+	if strings.HasPrefix(data, "data:") {
+		if comma := strings.Index(data, ","); comma > 0 {
+			data = data[comma+1:]
+		}
+	}
+	return base64.StdEncoding.DecodeString(data)
+}
+
+// Validar la miniatura adjunta a un video
+func validateThumbnail(req MessageRequest) error {
+	if req.MediaType != "video" {
+		return fmt.Errorf("thumbnail solo aplica a videos")
+	}
+	data, err := decodeBase64Media(req.Thumbnail)
+	if err != nil {
+		return fmt.Errorf("thumbnail no es base64 válido: %v", err)
+	}
+	if limit := maxMediaSize("image"); int64(len(data)) > limit {
+		return mediaTooLarge("image", int64(len(data)), limit)
+	}
+	if _, _, err := image.DecodeConfig(bytes.NewReader(data)); err != nil {
+		return unsupportedMedia("image", sniffMimeType(data[:min(len(data), 512)]), "", "thumbnail no es una imagen válida")
+	}
+	return nil
+}
+
+// Obtener, validar y completar la media de una solicitud antes de encolarla:
+// descarga media_url y revisa el tamaño y formato del archivo
+func prepareMedia(req *MessageRequest) error {
+	if maxMediaSize(req.MediaType) == 0 {
+		return nil
+	}
+
+	if req.MediaURL != "" && req.mediaFile == "" {
+		if err := fetchMediaURL(req); err != nil {
+			return err
+		}
+	}
+
+	if req.mediaFile != "" {
+		file, err := os.Open(req.mediaFile)
+		if err != nil {
+			return fmt.Errorf("archivo temporal no disponible: %v", err)
+		}
+		defer file.Close()
+
+		info, err := file.Stat()
+		if err != nil {
+			return fmt.Errorf("archivo temporal no disponible: %v", err)
+		}
+		head := make([]byte, 512)
+		n, _ := io.ReadFull(file, head)
+		return validateMediaContent(req, head[:n], info.Size(), req.mimeHint)
+	}
+
+	// Base64, con o sin prefijo Data URL (data:image/png;base64,...)
+	data, hint := req.MediaData, ""
+	if strings.HasPrefix(data, "data:") {
+		if comma := strings.Index(data, ","); comma > 0 {
+			hint = strings.TrimSuffix(data[5:comma], ";base64")
+			data = data[comma+1:]
+		}
+	}
+	if req.MimeType == "" && hint != "" {
+		req.MimeType = hint
+	}
+
+	// Se decodifica una sola vez: el archivo se guarda en disco como los de
+	// media_url y multipart, y la cola no lleva el base64
+	decoded, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return fmt.Errorf("media_data no es base64 válido: %v", err)
+	}
+	if len(decoded) == 0 {
+		return fmt.Errorf("media_data está vacío")
+	}
+	if err := validateMediaContent(req, decoded[:min(len(decoded), 512)], int64(len(decoded)), ""); err != nil {
+		return err
+	}
+
+	staged, _, _, err := stageMedia(bytes.NewReader(decoded), maxMediaSize(req.MediaType))
+	if err != nil {
+		return fmt.Errorf("media_data: %v", err)
+	}
+	req.mediaFile = staged
+	req.MediaData = ""
+	return nil
+}
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Reacción a un mensaje
+type Reaction struct {
+	Sender    string    `json:"sender"`
+	Emoji     string    `json:"emoji"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Buscar el mensaje sobre el que se actúa. id puede ser el ID de la cola
+// (msg_...) o el ID de WhatsApp; line_id en la consulta desambigua cuando el
+// mismo mensaje está registrado en varias líneas
+func findTargetMessage(r *http.Request) (*Line, StoredMessage, int, error) {
+	id := mux.Vars(r)["id"]
+	lineID := r.URL.Query().Get("line_id")
+
+	if item, err := getQueuedMessage(id); err == nil {
+		// Los mensajes de otras líneas no existen para la key
+		if !canAccessLine(r, item.LineID) {
+			return nil, StoredMessage{}, http.StatusNotFound, fmt.Errorf("Mensaje no encontrado")
+		}
+		if item.WhatsAppID == "" {
+			return nil, StoredMessage{}, http.StatusConflict, fmt.Errorf("El mensaje aún no ha sido enviado")
+		}
+		id = item.WhatsAppID
+		lineID = item.LineID
+	} else if err != sql.ErrNoRows {
+		return nil, StoredMessage{}, http.StatusInternalServerError, err
+	}
+
+	query := "SELECT " + storedMessageColumns + " FROM message_logs WHERE message_id = ?"
+	args := []interface{}{id}
+	if lineID != "" {
+		query += " AND line_id = ?"
+		args = append(args, lineID)
+	} else if key := apiKeyFromContext(r); key != nil && len(key.LineIDs) > 0 {
+		// Sin line_id, el mismo ID puede existir en otra línea: solo se
+		// buscan las permitidas para la key
+		placeholders := make([]string, len(key.LineIDs))
+		for i, allowed := range key.LineIDs {
+			placeholders[i] = "?"
+			args = append(args, allowed)
+		}
+		query += " AND line_id IN (" + strings.Join(placeholders, ",") + ")"
+	}
+	query += " ORDER BY id DESC LIMIT 1"
+
+	msg, err := scanStoredMessage(configDB.QueryRow(query, args...))
+	if err == sql.ErrNoRows || (err == nil && !canAccessLine(r, msg.LineID)) {
+		return nil, msg, http.StatusNotFound, fmt.Errorf("Mensaje no encontrado")
+	} else if err != nil {
+		return nil, msg, http.StatusInternalServerError, err
+	}
+
+	linesMutex.RLock()
+	line, exists := lines[msg.LineID]
+	linesMutex.RUnlock()
+
+	if !exists {
+		return nil, msg, http.StatusNotFound, fmt.Errorf("Línea no encontrada")
+	}
+	if !line.Active || line.Client.StoreID() == nil {
+		return nil, msg, http.StatusServiceUnavailable, fmt.Errorf("Línea no disponible")
+	}
+
+	return line, msg, http.StatusOK, nil
+}
+
+// Resolver el target o responder con el error correspondiente
+func targetMessageOrError(w http.ResponseWriter, r *http.Request) (*Line, StoredMessage, bool) {
+	line, msg, status, err := findTargetMessage(r)
+	if err != nil {
+		if status == http.StatusInternalServerError {
+			log.Printf("Error al buscar mensaje: %v", err)
+			http.Error(w, "Error al buscar mensaje", status)
+		} else {
+			http.Error(w, err.Error(), status)
+		}
+		return nil, msg, false
+	}
+	return line, msg, true
+}
+
+// Reaccionar a un mensaje; un emoji vacío retira la reacción
+func reactToMessage(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Emoji string `json:"emoji"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	line, target, ok := targetMessageOrError(w, r)
+	if !ok {
+		return
+	}
+
+	chat, sender, err := targetJIDs(target)
+	if err != nil {
+		http.Error(w, "Mensaje sin chat registrado", http.StatusConflict)
+		return
+	}
+
+	msg := line.Client.BuildReaction(chat, sender, types.MessageID(target.MessageID), req.Emoji)
+	if _, err := line.Client.SendMessage(context.Background(), chat, msg); err != nil {
+		log.Printf("Error al enviar reacción en línea %s: %v", line.ID, err)
+		http.Error(w, fmt.Sprintf("Error al enviar reacción: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	own := ownJID(line)
+	if err := recordReaction(line.ID, target.MessageID, own, req.Emoji); err != nil {
+		log.Printf("Error al registrar reacción: %v", err)
+	}
+	publishMessageAction(line.ID, target.Chat, target.MessageID, "reaction")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message":    "Reacción enviada",
+		"line_id":    line.ID,
+		"message_id": target.MessageID,
+		"emoji":      req.Emoji,
+	})
+}
+
+// Editar el texto de un mensaje enviado, dentro de la ventana de WhatsApp
+func editMessage(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if strings.TrimSpace(req.Message) == "" {
+		http.Error(w, "Message es requerido", http.StatusBadRequest)
+		return
+	}
+
+	line, target, ok := targetMessageOrError(w, r)
+	if !ok {
+		return
+	}
+
+	if target.Direction != "sent" {
+		http.Error(w, "Solo se pueden editar mensajes enviados por la línea", http.StatusBadRequest)
+		return
+	}
+	if target.RevokedAt != nil {
+		http.Error(w, "El mensaje fue eliminado", http.StatusConflict)
+		return
+	}
+	if time.Since(target.Timestamp) > whatsmeow.EditWindow {
+		http.Error(w, "El mensaje ya no se puede editar (ventana de 20 minutos)", http.StatusConflict)
+		return
+	}
+
+	chat, _, err := targetJIDs(target)
+	if err != nil {
+		http.Error(w, "Mensaje sin chat registrado", http.StatusConflict)
+		return
+	}
+
+	// Los mensajes multimedia editan su caption
+	var content *waProto.Message
+	switch target.Type {
+	case "text":
+		content = &waProto.Message{Conversation: &req.Message}
+	case "image":
+		content = &waProto.Message{ImageMessage: &waProto.ImageMessage{Caption: &req.Message}}
+	case "video":
+		content = &waProto.Message{VideoMessage: &waProto.VideoMessage{Caption: &req.Message}}
+	case "document":
+		content = &waProto.Message{DocumentMessage: &waProto.DocumentMessage{Caption: &req.Message}}
+	default:
+		http.Error(w, fmt.Sprintf("No se pueden editar mensajes de tipo %s", target.Type), http.StatusBadRequest)
+		return
+	}
+
+	msg := line.Client.BuildEdit(chat, types.MessageID(target.MessageID), content)
+	if _, err := line.Client.SendMessage(context.Background(), chat, msg); err != nil {
+		log.Printf("Error al editar mensaje en línea %s: %v", line.ID, err)
+		http.Error(w, fmt.Sprintf("Error al editar mensaje: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := recordEdit(line.ID, target.MessageID, target.Sender, req.Message); err != nil {
+		log.Printf("Error al registrar edición: %v", err)
+	}
+	publishMessageAction(line.ID, target.Chat, target.MessageID, "edited")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message":    "Mensaje editado",
+		"line_id":    line.ID,
+		"message_id": target.MessageID,
+		"text":       req.Message,
+	})
+}
+
+// Eliminar un mensaje para todos. Los mensajes recibidos solo pueden
+// eliminarse en grupos donde la línea es administradora
+func revokeMessage(w http.ResponseWriter, r *http.Request) {
+	line, target, ok := targetMessageOrError(w, r)
+	if !ok {
+		return
+	}
+
+	if target.RevokedAt != nil {
+		http.Error(w, "El mensaje ya fue eliminado", http.StatusConflict)
+		return
+	}
+	if target.Direction != "sent" && !target.IsGroup {
+		http.Error(w, "Solo se pueden eliminar para todos los mensajes enviados por la línea", http.StatusBadRequest)
+		return
+	}
+
+	chat, sender, err := targetJIDs(target)
+	if err != nil {
+		http.Error(w, "Mensaje sin chat registrado", http.StatusConflict)
+		return
+	}
+	if target.Direction == "sent" {
+		sender = types.EmptyJID
+	}
+
+	msg := line.Client.BuildRevoke(chat, sender, types.MessageID(target.MessageID))
+	if _, err := line.Client.SendMessage(context.Background(), chat, msg); err != nil {
+		log.Printf("Error al eliminar mensaje en línea %s: %v", line.ID, err)
+		http.Error(w, fmt.Sprintf("Error al eliminar mensaje: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := recordRevoke(line.ID, target.MessageID); err != nil {
+		log.Printf("Error al registrar eliminación: %v", err)
+	}
+	publishMessageAction(line.ID, target.Chat, target.MessageID, "revoked")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message":    "Mensaje eliminado",
+		"line_id":    line.ID,
+		"message_id": target.MessageID,
+	})
+}
+
+// Chat y remitente del mensaje registrado
+func targetJIDs(msg StoredMessage) (types.JID, types.JID, error) {
+	chat, err := types.ParseJID(msg.Chat)
+	if err != nil || msg.Chat == "" {
+		return chat, types.EmptyJID, fmt.Errorf("chat inválido: %q", msg.Chat)
+	}
+	sender, _ := types.ParseJID(msg.Sender)
+	return chat, sender, nil
+}
+
+// Procesar reacciones, ediciones y eliminaciones entrantes. Devuelve false
+// si el mensaje no es ninguna de ellas
+func handleMessageAction(line *Line, evt *events.Message) bool {
+	data := MessageActionEventData{
+		Chat:      evt.Info.Chat.String(),
+		Sender:    evt.Info.Sender.ToNonAD().String(),
+		IsGroup:   evt.Info.IsGroup,
+		FromMe:    evt.Info.IsFromMe,
+		Timestamp: evt.Info.Timestamp,
+	}
+
+	var event, action string
+	var err error
+	applied := true
+	protocolMsg := evt.Message.GetProtocolMessage()
+
+	switch {
+	case evt.Message.GetReactionMessage() != nil:
+		reaction := evt.Message.GetReactionMessage()
+		data.ID = reaction.GetKey().GetID()
+		data.Emoji = reaction.GetText()
+		event, action = EventMessageReaction, "reaction"
+		err = recordReaction(line.ID, data.ID, data.Sender, data.Emoji)
+
+	case protocolMsg != nil && protocolMsg.GetType() == waProto.ProtocolMessage_MESSAGE_EDIT:
+		edited := protocolMsg.GetEditedMessage()
+		data.ID = protocolMsg.GetKey().GetID()
+		data.Text = messageTextOf(edited)
+		if data.Text == "" {
+			data.Text = messageCaptionOf(edited)
+		}
+		event, action = EventMessageEdited, "edited"
+		applied, err = recordEdit(line.ID, data.ID, data.Sender, data.Text)
+
+	// REVOKE es el valor por defecto del enum; solo cuenta si hay ProtocolMessage
+	case protocolMsg != nil && protocolMsg.GetType() == waProto.ProtocolMessage_REVOKE:
+		data.ID = protocolMsg.GetKey().GetID()
+		event, action = EventMessageRevoked, "revoked"
+		if applied, err = canRevoke(line, evt, data.ID, data.Sender); applied {
+			applied, err = recordRevoke(line.ID, data.ID)
+		}
+
+	default:
+		return false
+	}
+
+	if err != nil {
+		log.Printf("Error al registrar %s de mensaje %s en línea %s: %v", action, data.ID, line.ID, err)
+	}
+
+	// Ediciones y eliminaciones que no corresponden a un mensaje del
+	// historial, o que no envió su autor, no se notifican
+	if !applied {
+		return true
+	}
+
+	publishMessageAction(line.ID, data.Chat, data.ID, action)
+	emitWebhookEvent(line, event, data)
+	return true
+}
+
+// Guardar o retirar la reacción de un remitente
+func recordReaction(lineID, messageID, sender, emoji string) error {
+	if emoji == "" {
+		_, err := configDB.Exec(`
+			DELETE FROM message_reactions WHERE line_id = ? AND message_id = ? AND sender = ?
+		`, lineID, messageID, sender)
+		return err
+	}
+
+	_, err := configDB.Exec(`
+		INSERT INTO message_reactions (line_id, message_id, sender, emoji, timestamp)
+		VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(line_id, message_id, sender) DO UPDATE SET
+			emoji = excluded.emoji,
+			timestamp = excluded.timestamp
+	`, lineID, messageID, sender, emoji)
+	return err
+}
+
+// Aplicar una edición; solo el autor del mensaje puede editarlo. Devuelve
+// false si no había un mensaje suyo con ese ID
+func recordEdit(lineID, messageID, sender, text string) (bool, error) {
+	ids, err := messageRowsBy(lineID, messageID, sender)
+	if err != nil || len(ids) == 0 {
+		return false, err
+	}
+	return updateMessageRows(ids, "message_text = ?, edited_at = CURRENT_TIMESTAMP", text)
+}
+
+// Aplicar una eliminación; la autorización ya fue verificada. Devuelve
+// false si no había un mensaje con ese ID
+func recordRevoke(lineID, messageID string) (bool, error) {
+	ids, err := messageRowsBy(lineID, messageID, "")
+	if err != nil || len(ids) == 0 {
+		return false, err
+	}
+	return updateMessageRows(ids, "message_text = '', revoked_at = CURRENT_TIMESTAMP")
+}
+
+// Indica si el remitente de una eliminación entrante puede eliminar el
+// mensaje: su autor o, en un grupo, un administrador
+func canRevoke(line *Line, evt *events.Message, messageID, sender string) (bool, error) {
+	ids, err := messageRowsBy(line.ID, messageID, sender)
+	if err != nil || len(ids) > 0 {
+		return len(ids) > 0, err
+	}
+	return evt.Info.IsGroup && isGroupAdmin(line, evt.Info.Chat, evt.Info.Sender), nil
+}
+
+// Filas del historial de la línea con el mensaje messageID enviado por
+// sender; vacío = de cualquier remitente. Los remitentes se comparan sin
+// dispositivo, porque los registros antiguos lo incluyen
+func messageRowsBy(lineID, messageID, sender string) ([]int64, error) {
+	rows, err := configDB.Query(`
+		SELECT id, COALESCE(sender, '') FROM message_logs WHERE line_id = ? AND message_id = ?
+	`, lineID, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		var rowSender string
+		if err := rows.Scan(&id, &rowSender); err != nil {
+			return nil, err
+		}
+		if sender == "" || sameUser(rowSender, sender) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, rows.Err()
+}
+
+func updateMessageRows(ids []int64, set string, args ...interface{}) (bool, error) {
+	placeholders := make([]string, len(ids))
+	for i, id := range ids {
+		placeholders[i] = "?"
+		args = append(args, id)
+	}
+	res, err := configDB.Exec(`
+		UPDATE message_logs SET `+set+` WHERE id IN (`+strings.Join(placeholders, ",")+`)
+	`, args...)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// Indica si dos JIDs son del mismo usuario, sin importar el dispositivo.
+// Los registros antiguos guardan solo el número
+func sameUser(a, b string) bool {
+	return userKey(a) == userKey(b)
+}
+
+func userKey(value string) string {
+	if !strings.Contains(value, "@") {
+		return value + "@" + types.DefaultUserServer
+	}
+	jid, err := types.ParseJID(value)
+	if err != nil {
+		return value
+	}
+	return jid.ToNonAD().String()
+}
+
+// Indica si user es administrador del grupo
+func isGroupAdmin(line *Line, group, user types.JID) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	info, err := line.Client.GetGroupInfo(ctx, group)
+	if err != nil {
+		log.Printf("Error al consultar administradores de %s: %v", group, err)
+		return false
+	}
+	user = user.ToNonAD()
+	for _, participant := range info.Participants {
+		if !participant.IsAdmin && !participant.IsSuperAdmin {
+			continue
+		}
+		if participant.JID.ToNonAD() == user || participant.PhoneNumber.ToNonAD() == user || participant.LID.ToNonAD() == user {
+			return true
+		}
+	}
+	return false
+}
+
+// Cargar las reacciones de una página de mensajes
+func loadReactions(lineID string, messages []StoredMessage) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	index := make(map[string]int, len(messages))
+	placeholders := make([]string, 0, len(messages))
+	args := []interface{}{lineID}
+	for i, m := range messages {
+		index[m.MessageID] = i
+		placeholders = append(placeholders, "?")
+		args = append(args, m.MessageID)
+	}
+
+	rows, err := configDB.Query(`
+		SELECT message_id, sender, emoji, timestamp FROM message_reactions
+		WHERE line_id = ? AND message_id IN (`+strings.Join(placeholders, ",")+`)
+		ORDER BY timestamp
+	`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var messageID string
+		var reaction Reaction
+		if err := rows.Scan(&messageID, &reaction.Sender, &reaction.Emoji, &reaction.Timestamp); err != nil {
+			return err
+		}
+		if i, ok := index[messageID]; ok {
+			messages[i].Reactions = append(messages[i].Reactions, reaction)
+		}
+	}
+	return rows.Err()
+}
+
+// Avisar a la bandeja que un mensaje del chat cambió
+func publishMessageAction(lineID, chat, messageID, action string) {
+	eventBus.Publish(BusChatUpdated, lineID, map[string]string{
+		"chat":       chat,
+		"message_id": messageID,
+		"action":     action,
+	})
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mau.fi/whatsmeow"
+)
+
+const (
+	// Tiempo máximo de espera a que el websocket de login esté listo
+	pairPhoneReadyTimeout = 20 * time.Second
+	// Nombre mostrado en el teléfono; debe tener el formato "Navegador (SO)"
+	pairPhoneDisplayName = "Chrome (Linux)"
+)
+
+// Vincular una línea con un código de 8 caracteres en lugar del QR
+func pairPhone(w http.ResponseWriter, r *http.Request) {
+	lineID := mux.Vars(r)["id"]
+
+	var req struct {
+		Phone string `json:"phone"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	phone := strings.TrimPrefix(strings.NewReplacer(" ", "", "-", "", "(", "", ")", "").Replace(req.Phone), "+")
+	if phone == "" {
+		http.Error(w, "El teléfono es requerido", http.StatusBadRequest)
+		return
+	}
+
+	linesMutex.RLock()
+	line, exists := lines[lineID]
+	linesMutex.RUnlock()
+
+	if !exists {
+		http.Error(w, "Línea no encontrada", http.StatusNotFound)
+		return
+	}
+
+	if line.Client.StoreID() != nil {
+		http.Error(w, "La línea ya está vinculada", http.StatusConflict)
+		return
+	}
+
+	if err := waitForLoginSocket(line); err != nil {
+		log.Printf("Error al preparar vinculación de línea %s: %v", line.ID, err)
+		http.Error(w, "No se pudo iniciar la vinculación, intenta nuevamente", http.StatusGatewayTimeout)
+		return
+	}
+
+	code, err := line.Client.PairPhone(r.Context(), phone, true, whatsmeow.PairClientChrome, pairPhoneDisplayName)
+	if errors.Is(err, whatsmeow.ErrPhoneNumberTooShort) || errors.Is(err, whatsmeow.ErrPhoneNumberIsNotInternational) {
+		http.Error(w, "El teléfono debe incluir el código de país (p.ej. 521234567890)", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Printf("Error al solicitar código de vinculación para línea %s: %v", line.ID, err)
+		http.Error(w, "Error al solicitar código de vinculación", http.StatusBadGateway)
+		return
+	}
+
+	line.Status = "pair_pending"
+	line.PairingCode = code
+	log.Printf("Código de vinculación generado para %s", line.ID)
+
+	eventBus.Publish(BusLinePairingCode, line.ID, map[string]string{"pairing_code": code})
+	publishLineStatus(line)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"pairing_code": code,
+		"status":       line.Status,
+	})
+}
+
+// Asegurar que la línea tenga abierto el websocket de login. PairPhone
+// requiere que haya llegado al menos un código QR.
+func waitForLoginSocket(line *Line) error {
+	qrEvents, unsubscribe := eventBus.Subscribe(func(id string) bool {
+		return id == line.ID
+	})
+	defer unsubscribe()
+
+	if line.Client.IsConnected() && line.QRCode != "" {
+		return nil
+	}
+
+	// Si no hay un intento de login en curso, iniciar uno nuevo
+	if line.Status != "qr_pending" || !line.Client.IsConnected() {
+		line.Client.Disconnect()
+		go connectLine(line)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pairPhoneReadyTimeout)
+	defer cancel()
+
+	for {
+		select {
+		case evt := <-qrEvents:
+			switch evt.Type {
+			case BusLineQR:
+				return nil
+			case BusLineQRTimeout:
+				return errors.New("el login expiró antes de generar el código")
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
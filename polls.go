@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// WhatsApp permite hasta 12 opciones por encuesta
+const maxPollOptions = 12
+
+// Encuesta a enviar con media_type "poll"
+type PollRequest struct {
+	Question        string   `json:"question"`
+	Options         []string `json:"options"`
+	SelectableCount int      `json:"selectable_count,omitempty"` // 0 = sin límite
+}
+
+// Resultado de una opción de la encuesta
+type PollOptionResult struct {
+	Name   string   `json:"name"`
+	Votes  int      `json:"votes"`
+	Voters []string `json:"voters"`
+}
+
+type PollResults struct {
+	PollID          string             `json:"poll_id"`
+	LineID          string             `json:"line_id"`
+	Chat            string             `json:"chat"`
+	Question        string             `json:"question"`
+	SelectableCount int                `json:"selectable_count"`
+	Options         []PollOptionResult `json:"options"`
+	TotalVoters     int                `json:"total_voters"`
+	CreatedAt       time.Time          `json:"created_at"`
+}
+
+type PollVoteEventData struct {
+	PollID          string    `json:"poll_id"`
+	Chat            string    `json:"chat"`
+	Voter           string    `json:"voter"`
+	SelectedOptions []string  `json:"selected_options"` // Vacío = voto retirado
+	Timestamp       time.Time `json:"timestamp"`
+}
+
+// Validar una solicitud de tipo poll
+func validatePollRequest(req MessageRequest) error {
+	poll := req.Poll
+	if poll == nil || strings.TrimSpace(poll.Question) == "" {
+		return fmt.Errorf("poll.question es requerido para encuestas")
+	}
+	if len(poll.Options) < 2 || len(poll.Options) > maxPollOptions {
+		return fmt.Errorf("La encuesta debe tener entre 2 y %d opciones", maxPollOptions)
+	}
+
+	seen := make(map[string]bool, len(poll.Options))
+	for _, option := range poll.Options {
+		if strings.TrimSpace(option) == "" {
+			return fmt.Errorf("Las opciones de la encuesta no pueden estar vacías")
+		}
+		if seen[option] {
+			return fmt.Errorf("Opción repetida en la encuesta: %s", option)
+		}
+		seen[option] = true
+	}
+
+	if poll.SelectableCount < 0 || poll.SelectableCount > len(poll.Options) {
+		return fmt.Errorf("poll.selectable_count debe estar entre 0 y %d", len(poll.Options))
+	}
+	return nil
+}
+
+// Obtener la encuesta de un mensaje, en cualquiera de sus versiones
+func pollCreationOf(msg *waProto.Message) *waProto.PollCreationMessage {
+	switch {
+	case msg.GetPollCreationMessage() != nil:
+		return msg.GetPollCreationMessage()
+	case msg.GetPollCreationMessageV2() != nil:
+		return msg.GetPollCreationMessageV2()
+	case msg.GetPollCreationMessageV3() != nil:
+		return msg.GetPollCreationMessageV3()
+	case msg.GetPollCreationMessageV5() != nil:
+		return msg.GetPollCreationMessageV5()
+	}
+	return nil
+}
+
+// Registrar una encuesta enviada o recibida para poder asociarle los votos
+func savePoll(lineID, messageID, chat string, poll *waProto.PollCreationMessage) error {
+	options := make([]string, 0, len(poll.GetOptions()))
+	for _, option := range poll.GetOptions() {
+		options = append(options, option.GetOptionName())
+	}
+	optionsJSON, _ := json.Marshal(options)
+
+	_, err := configDB.Exec(`
+		INSERT OR IGNORE INTO polls (line_id, message_id, chat_jid, question, options, selectable_count)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, lineID, messageID, chat, poll.GetName(), string(optionsJSON), poll.GetSelectableOptionsCount())
+	return err
+}
+
+// Descifrar un voto entrante, guardarlo y notificarlo. Cada voto reemplaza
+// la selección anterior del mismo votante
+func handlePollVote(line *Line, evt *events.Message) {
+	pollKey := evt.Message.GetPollUpdateMessage().GetPollCreationMessageKey()
+	pollID := pollKey.GetID()
+
+	vote, err := line.Client.DecryptPollVote(context.Background(), evt)
+	if err != nil {
+		log.Printf("Error al descifrar voto de encuesta %s en línea %s: %v", pollID, line.ID, err)
+		return
+	}
+
+	var optionsJSON string
+	err = configDB.QueryRow(`
+		SELECT options FROM polls WHERE line_id = ? AND message_id = ?
+	`, line.ID, pollID).Scan(&optionsJSON)
+	if err == sql.ErrNoRows {
+		log.Printf("Voto para encuesta desconocida %s en línea %s", pollID, line.ID)
+		return
+	} else if err != nil {
+		log.Printf("Error al obtener encuesta %s: %v", pollID, err)
+		return
+	}
+
+	// Sin las opciones no se puede saber qué se votó: guardar el voto
+	// vacío lo registraría como retirado
+	var options []string
+	if err := json.Unmarshal([]byte(optionsJSON), &options); err != nil {
+		log.Printf("Opciones inválidas en encuesta %s de línea %s: %v", pollID, line.ID, err)
+		return
+	}
+
+	// Los votos traen el SHA-256 de cada opción elegida
+	byHash := make(map[[32]byte]string, len(options))
+	for _, option := range options {
+		byHash[sha256.Sum256([]byte(option))] = option
+	}
+	selected := []string{}
+	for _, hash := range vote.GetSelectedOptions() {
+		var key [32]byte
+		copy(key[:], hash)
+		if option, ok := byHash[key]; ok {
+			selected = append(selected, option)
+		}
+	}
+
+	voter := evt.Info.Sender.ToNonAD().String()
+	selectedJSON, _ := json.Marshal(selected)
+	_, err = configDB.Exec(`
+		INSERT INTO poll_votes (line_id, poll_id, voter, options, timestamp)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(line_id, poll_id, voter) DO UPDATE SET
+			options = excluded.options,
+			timestamp = excluded.timestamp
+		WHERE excluded.timestamp >= poll_votes.timestamp
+	`, line.ID, pollID, voter, string(selectedJSON), evt.Info.Timestamp)
+	if err != nil {
+		log.Printf("Error al registrar voto de encuesta %s: %v", pollID, err)
+	}
+
+	publishMessageAction(line.ID, evt.Info.Chat.String(), pollID, "poll_vote")
+	emitWebhookEvent(line, EventPollVote, PollVoteEventData{
+		PollID:          pollID,
+		Chat:            evt.Info.Chat.String(),
+		Voter:           voter,
+		SelectedOptions: selected,
+		Timestamp:       evt.Info.Timestamp,
+	})
+}
+
+// Obtener los resultados agregados de una encuesta. id puede ser el ID de
+// la cola o el ID de WhatsApp del mensaje de la encuesta
+func getPollResults(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	lineID := r.URL.Query().Get("line_id")
+
+	if item, err := getQueuedMessage(id); err == nil {
+		id = item.WhatsAppID
+		lineID = item.LineID
+	}
+
+	query := `
+		SELECT line_id, message_id, chat_jid, question, options, selectable_count, created_at
+		FROM polls WHERE message_id = ?
+	`
+	args := []interface{}{id}
+	if lineID != "" {
+		query += " AND line_id = ?"
+		args = append(args, lineID)
+	}
+
+	var results PollResults
+	var optionsJSON string
+	err := configDB.QueryRow(query, args...).Scan(&results.LineID, &results.PollID, &results.Chat,
+		&results.Question, &optionsJSON, &results.SelectableCount, &results.CreatedAt)
+	if err == sql.ErrNoRows || (err == nil && !canAccessLine(r, results.LineID)) {
+		http.Error(w, "Encuesta no encontrada", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error al obtener encuesta: %v", err)
+		http.Error(w, "Error al obtener encuesta", http.StatusInternalServerError)
+		return
+	}
+
+	var options []string
+	if err := json.Unmarshal([]byte(optionsJSON), &options); err != nil {
+		log.Printf("Opciones inválidas en encuesta %s: %v", results.PollID, err)
+		http.Error(w, "Error al obtener encuesta", http.StatusInternalServerError)
+		return
+	}
+
+	results.Options = make([]PollOptionResult, len(options))
+	index := make(map[string]int, len(options))
+	for i, option := range options {
+		results.Options[i] = PollOptionResult{Name: option, Voters: []string{}}
+		index[option] = i
+	}
+
+	rows, err := configDB.Query(`
+		SELECT voter, options FROM poll_votes WHERE line_id = ? AND poll_id = ? ORDER BY timestamp
+	`, results.LineID, results.PollID)
+	if err != nil {
+		log.Printf("Error al obtener votos: %v", err)
+		http.Error(w, "Error al obtener votos", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var voter, selectedJSON string
+		if err := rows.Scan(&voter, &selectedJSON); err != nil {
+			log.Printf("Error al leer voto: %v", err)
+			continue
+		}
+
+		var selected []string
+		if err := json.Unmarshal([]byte(selectedJSON), &selected); err != nil {
+			log.Printf("Voto inválido de %s en encuesta %s: %v", voter, results.PollID, err)
+			continue
+		}
+		if len(selected) == 0 {
+			continue
+		}
+
+		results.TotalVoters++
+		for _, option := range selected {
+			if i, ok := index[option]; ok {
+				results.Options[i].Votes++
+				results.Options[i].Voters = append(results.Options[i].Voters, voter)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// Texto de una encuesta para el historial
+func pollTextOf(msg *waProto.Message) string {
+	poll := pollCreationOf(msg)
+	if poll == nil {
+		return ""
+	}
+	options := make([]string, 0, len(poll.GetOptions()))
+	for _, option := range poll.GetOptions() {
+		options = append(options, option.GetOptionName())
+	}
+	return fmt.Sprintf("%s (%s)", poll.GetName(), strings.Join(options, " / "))
+}
+
+// Registrar la encuesta de un mensaje si la tiene
+func savePollOf(lineID string, messageID string, chat types.JID, msg *waProto.Message) {
+	if poll := pollCreationOf(msg); poll != nil {
+		if err := savePoll(lineID, messageID, chat.String(), poll); err != nil {
+			log.Printf("Error al registrar encuesta %s: %v", messageID, err)
+		}
+	}
+}
@@ -3,14 +3,25 @@ const API_BASE = window.location.origin + '/api';
 
 let currentLineForWebhook = null;
 let refreshInterval = null;
+let linesStream = null;
+let qrStream = null;
+let currentLineForPairing = null;
 
 // Load lines on page load
 document.addEventListener('DOMContentLoaded', () => {
     loadLines();
-    // Refresh every 5 seconds
-    refreshInterval = setInterval(loadLines, 5000);
+    subscribeToLineEvents();
+    // Fallback refresh every 30 seconds
+    refreshInterval = setInterval(loadLines, 30000);
 });
 
+// Refresh the list when any line changes status
+function subscribeToLineEvents() {
+    linesStream = openEventStream(`${API_BASE}/events`);
+    linesStream.addEventListener('line.status', () => loadLines());
+    linesStream.addEventListener('line.paired', () => loadLines());
+}
+
 // Create new line
 async function createLine() {
     const name = document.getElementById('lineName').value.trim();
@@ -83,18 +94,21 @@ function displayLines(lines) {
         const statusColors = {
             'connected': 'bg-green-100 text-green-800',
             'qr_pending': 'bg-yellow-100 text-yellow-800',
+            'pair_pending': 'bg-yellow-100 text-yellow-800',
             'disconnected': 'bg-red-100 text-red-800'
         };
 
         const statusIcons = {
             'connected': 'fa-check-circle',
             'qr_pending': 'fa-qrcode',
+            'pair_pending': 'fa-mobile-alt',
             'disconnected': 'fa-times-circle'
         };
 
         const statusText = {
             'connected': 'Conectada',
             'qr_pending': 'Pendiente QR',
+            'pair_pending': 'Pendiente Código',
             'disconnected': 'Desconectada'
         };
 
@@ -118,12 +132,12 @@ function displayLines(lines) {
                         </div>
                     </div>
                     <div class="flex space-x-2">
-                        ${line.status === 'qr_pending' ? `
+                        ${line.status === 'qr_pending' || line.status === 'pair_pending' ? `
                             <button onclick="showQRCode('${line.id}')" class="px-4 py-2 bg-yellow-500 text-white rounded hover:bg-yellow-600 transition">
-                                <i class="fas fa-qrcode mr-1"></i>Ver QR
+                                <i class="fas fa-qrcode mr-1"></i>Vincular
                             </button>
                         ` : ''}
-                        ${line.status === 'disconnected' || line.status === 'qr_pending' ? `
+                        ${line.status === 'disconnected' || line.status === 'qr_pending' || line.status === 'pair_pending' ? `
                             <button onclick="reconnectLine('${line.id}')" class="px-4 py-2 bg-indigo-500 text-white rounded hover:bg-indigo-600 transition">
                                 <i class="fas fa-sync-alt mr-1"></i>Reconectar
                             </button>
@@ -148,10 +162,13 @@ function displayLines(lines) {
 }
 
 // Show QR Code Modal
-async function showQRCode(lineId) {
+function showQRCode(lineId) {
     const modal = document.getElementById('qrModal');
     const content = document.getElementById('qrContent');
     
+    currentLineForPairing = lineId;
+    showPairTab('qr');
+    document.getElementById('pairingCodeContent').innerHTML = '';
     modal.classList.remove('hidden');
     content.innerHTML = `
         <div class="animate-pulse">
@@ -160,66 +177,135 @@ async function showQRCode(lineId) {
         </div>
     `;
 
-    try {
-        const response = await fetch(`${API_BASE}/lines/${lineId}/qr`);
-        if (!response.ok) {
-            throw new Error('Error al obtener el código QR');
-        }
+    // Receive fresh QR codes and the pairing result from the line's event stream
+    if (qrStream) {
+        qrStream.close();
+    }
+    qrStream = openEventStream(`${API_BASE}/lines/${lineId}/events`);
 
-        const data = await response.json();
-        
-        if (data.qr_code) {
-            content.innerHTML = `
-                <img src="${data.qr_code}" alt="QR Code" class="mx-auto rounded shadow-lg" />
-                <p class="mt-4 text-gray-600">Escanea con WhatsApp</p>
-            `;
-            
-            // Keep checking for connection
-            const checkInterval = setInterval(async () => {
-                const checkResponse = await fetch(`${API_BASE}/lines/${lineId}/qr`);
-                const checkData = await checkResponse.json();
-                
-                if (checkData.status === 'connected') {
-                    clearInterval(checkInterval);
-                    showToast('¡Línea conectada exitosamente!', 'success');
-                    closeQRModal();
-                    loadLines();
-                }
-            }, 2000);
-            
-            // Stop checking after 2 minutes
-            setTimeout(() => clearInterval(checkInterval), 120000);
-        } else {
+    qrStream.addEventListener('line.qr', (e) => {
+        const data = JSON.parse(e.data).data;
+        content.innerHTML = `
+            <img src="${data.qr_code}" alt="QR Code" class="mx-auto rounded shadow-lg" />
+            <p class="mt-4 text-gray-600">Escanea con WhatsApp</p>
+        `;
+    });
+
+    qrStream.addEventListener('line.status', (e) => {
+        const data = JSON.parse(e.data).data;
+        if (data.status === 'connected') {
+            showToast('¡Línea conectada exitosamente!', 'success');
+            closeQRModal();
+            loadLines();
+        } else if (data.status === 'qr_pending' && !content.querySelector('img')) {
             content.innerHTML = `
                 <p class="text-yellow-600">
                     <i class="fas fa-hourglass-half text-4xl mb-2"></i><br>
                     Esperando código QR...
                 </p>
             `;
-            
-            // Retry after 2 seconds
-            setTimeout(() => showQRCode(lineId), 2000);
         }
-    } catch (error) {
-        console.error('Error:', error);
+    });
+
+    qrStream.addEventListener('line.qr_timeout', () => {
         content.innerHTML = `
             <p class="text-red-600">
-                <i class="fas fa-exclamation-circle text-4xl mb-2"></i><br>
-                Error al cargar el código QR
+                <i class="fas fa-clock text-4xl mb-2"></i><br>
+                El código QR expiró. Usa "Reconectar" para generar uno nuevo.
             </p>
         `;
+        qrStream.close();
+        loadLines();
+    });
+
+    qrStream.onerror = () => {
+        if (qrStream.readyState === EventSource.CLOSED) {
+            content.innerHTML = `
+                <p class="text-red-600">
+                    <i class="fas fa-exclamation-circle text-4xl mb-2"></i><br>
+                    Error al cargar el código QR
+                </p>
+            `;
+        }
+    };
+}
+
+// Switch between QR and phone-number pairing
+function showPairTab(tab) {
+    const active = 'flex-1 py-2 font-semibold text-green-600 border-b-2 border-green-600';
+    const inactive = 'flex-1 py-2 font-semibold text-gray-500';
+    document.getElementById('pairTabQR').className = tab === 'qr' ? active : inactive;
+    document.getElementById('pairTabPhone').className = tab === 'phone' ? active : inactive;
+    document.getElementById('pairQRPanel').classList.toggle('hidden', tab !== 'qr');
+    document.getElementById('pairPhonePanel').classList.toggle('hidden', tab !== 'phone');
+}
+
+// Request an 8-character pairing code for the phone number
+async function requestPairingCode() {
+    const phone = document.getElementById('pairPhoneNumber').value.trim();
+    const content = document.getElementById('pairingCodeContent');
+
+    if (!phone) {
+        showToast('Por favor ingresa el número de teléfono', 'error');
+        return;
+    }
+
+    content.innerHTML = '<p class="text-gray-600"><i class="fas fa-spinner fa-spin mr-2"></i>Solicitando código...</p>';
+
+    try {
+        const response = await fetch(`${API_BASE}/lines/${currentLineForPairing}/pair-phone`, {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json',
+            },
+            body: JSON.stringify({ phone }),
+        });
+
+        if (!response.ok) {
+            throw new Error(await response.text());
+        }
+
+        const data = await response.json();
+        content.innerHTML = `
+            <p class="text-4xl font-mono font-bold tracking-widest text-gray-800">${data.pairing_code}</p>
+            <p class="mt-2 text-sm text-gray-600">Esperando confirmación en el teléfono...</p>
+        `;
+        loadLines();
+    } catch (error) {
+        console.error('Error:', error);
+        content.innerHTML = `<p class="text-red-600">${error.message || 'Error al solicitar el código'}</p>`;
     }
 }
 
 // Close QR Modal
 function closeQRModal() {
     document.getElementById('qrModal').classList.add('hidden');
+    currentLineForPairing = null;
+    if (qrStream) {
+        qrStream.close();
+        qrStream = null;
+    }
 }
 
 // Open Webhook Modal
-function openWebhookModal(lineId, currentUrl) {
+async function openWebhookModal(lineId, currentUrl) {
     currentLineForWebhook = lineId;
     document.getElementById('webhookUrl').value = currentUrl;
+
+    // Marcar los eventos suscritos (sin suscripciones = todos)
+    let subscribed = [];
+    try {
+        const response = await fetch(`${API_BASE}/lines/${lineId}`);
+        if (response.ok) {
+            subscribed = (await response.json()).webhook_events || [];
+        }
+    } catch (error) {
+        console.error('Error:', error);
+    }
+    document.querySelectorAll('.webhook-event').forEach(cb => {
+        cb.checked = subscribed.length === 0 || subscribed.includes(cb.value);
+    });
+
     document.getElementById('webhookModal').classList.remove('hidden');
 }
 
@@ -237,20 +323,29 @@ async function saveWebhook() {
         return;
     }
 
+    // Todos marcados = sin filtro, para recibir también eventos futuros
+    const checkboxes = [...document.querySelectorAll('.webhook-event')];
+    const events = checkboxes.every(cb => cb.checked)
+        ? []
+        : checkboxes.filter(cb => cb.checked).map(cb => cb.value);
+
     try {
         const response = await fetch(`${API_BASE}/lines/${currentLineForWebhook}/webhook`, {
             method: 'POST',
             headers: {
                 'Content-Type': 'application/json',
             },
-            body: JSON.stringify({ url }),
+            body: JSON.stringify({ url, events }),
         });
 
         if (!response.ok) {
             throw new Error('Error al configurar el webhook');
         }
 
+        const result = await response.json();
         showToast('Webhook configurado exitosamente', 'success');
+        // Mostrar el secreto para que el receptor pueda verificar las firmas
+        prompt('Secreto para verificar la cabecera X-WhatsGO-Signature:', result.secret);
         closeWebhookModal();
         loadLines();
     } catch (error) {
@@ -391,7 +486,8 @@ async function openConfigModal(lineId) {
             respond_to_groups: false,
             auto_mark_read: true,
             always_online: true,
-            auto_reply_msg: ''
+            auto_reply_msg: '',
+            call_reject_msg: ''
         };
 
         // Set form values
@@ -400,6 +496,7 @@ async function openConfigModal(lineId) {
         document.getElementById('configAutoMarkRead').checked = config.auto_mark_read;
         document.getElementById('configAlwaysOnline').checked = config.always_online;
         document.getElementById('configAutoReplyMsg').value = config.auto_reply_msg || '';
+        document.getElementById('configCallRejectMsg').value = config.call_reject_msg || '';
 
         document.getElementById('configModal').classList.remove('hidden');
     } catch (error) {
@@ -425,7 +522,8 @@ async function saveConfig() {
         respond_to_groups: document.getElementById('configRespondToGroups').checked,
         auto_mark_read: document.getElementById('configAutoMarkRead').checked,
         always_online: document.getElementById('configAlwaysOnline').checked,
-        auto_reply_msg: document.getElementById('configAutoReplyMsg').value.trim()
+        auto_reply_msg: document.getElementById('configAutoReplyMsg').value.trim(),
+        call_reject_msg: document.getElementById('configCallRejectMsg').value.trim()
     };
 
     try {
@@ -0,0 +1,46 @@
+// Autenticación con API key para la interfaz web.
+// La key se guarda en localStorage y se envía en la cabecera X-API-Key
+// de todas las peticiones a /api. Si el servidor responde 401 se solicita.
+// Los streams de eventos (SSE) se abren con openEventStream.
+(function () {
+    const STORAGE_KEY = 'whatsgo_api_key';
+    const originalFetch = window.fetch.bind(window);
+    let promptCancelled = false;
+
+    window.fetch = async function (input, init = {}) {
+        const url = typeof input === 'string' ? input : input.url;
+        if (!url.includes('/api/')) {
+            return originalFetch(input, init);
+        }
+
+        const apiKey = localStorage.getItem(STORAGE_KEY);
+        const headers = new Headers(init.headers || {});
+        if (apiKey) {
+            headers.set('X-API-Key', apiKey);
+        }
+
+        const response = await originalFetch(input, { ...init, headers });
+
+        if (response.status === 401 && !promptCancelled) {
+            const newKey = prompt('Esta instancia requiere una API key. Ingrésala para continuar:');
+            if (!newKey) {
+                promptCancelled = true;
+            } else {
+                localStorage.setItem(STORAGE_KEY, newKey.trim());
+                headers.set('X-API-Key', newKey.trim());
+                return originalFetch(input, { ...init, headers });
+            }
+        }
+
+        return response;
+    };
+
+    // EventSource no permite cabeceras: la key viaja en el parámetro api_key
+    window.openEventStream = function (url) {
+        const apiKey = localStorage.getItem(STORAGE_KEY);
+        if (apiKey) {
+            url += (url.includes('?') ? '&' : '?') + 'api_key=' + encodeURIComponent(apiKey);
+        }
+        return new EventSource(url);
+    };
+})();
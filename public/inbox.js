@@ -0,0 +1,362 @@
+// Detectar la URL base automáticamente
+const API_BASE = window.location.origin + '/api';
+
+const AGENT_KEY = 'whatsgo_agent_name';
+
+let currentLine = null;
+let currentChat = null;
+let currentFilter = 'open';
+let chats = [];
+let inboxStream = null;
+
+document.addEventListener('DOMContentLoaded', () => {
+    loadInboxLines();
+    highlightFilter();
+});
+
+// Agent name used for assignments, asked once and kept in localStorage
+function agentName() {
+    let name = localStorage.getItem(AGENT_KEY);
+    if (!name) {
+        name = (prompt('Ingresa tu nombre de agente:') || '').trim();
+        if (name) {
+            localStorage.setItem(AGENT_KEY, name);
+        }
+    }
+    return name;
+}
+
+// Load lines for the selector
+async function loadInboxLines() {
+    try {
+        const response = await fetch(`${API_BASE}/lines`);
+        if (!response.ok) {
+            throw new Error('Error al cargar las líneas');
+        }
+
+        const lines = await response.json();
+        const select = document.getElementById('inboxLine');
+        (lines || []).forEach(line => {
+            const option = document.createElement('option');
+            option.value = line.id;
+            option.textContent = `${line.name} (${line.id})`;
+            select.appendChild(option);
+        });
+    } catch (error) {
+        console.error('Error:', error);
+        showToast('Error al cargar las líneas', 'error');
+    }
+}
+
+// Switch line and subscribe to its live events
+function selectLine(lineId) {
+    currentLine = lineId || null;
+    currentChat = null;
+    renderThread([]);
+
+    if (inboxStream) {
+        inboxStream.close();
+        inboxStream = null;
+    }
+    if (!currentLine) {
+        document.getElementById('chatList').innerHTML = '<p class="text-gray-500 text-center py-8">Selecciona una línea</p>';
+        return;
+    }
+
+    inboxStream = openEventStream(`${API_BASE}/lines/${currentLine}/events`);
+    inboxStream.addEventListener('chat.updated', (e) => {
+        const data = JSON.parse(e.data).data;
+        loadChats();
+        if (currentChat && data.chat === currentChat) {
+            loadThread();
+            if (data.direction === 'received') {
+                fetch(`${API_BASE}/lines/${currentLine}/chats/${encodeURIComponent(currentChat)}/read`, { method: 'POST' });
+            }
+        }
+    });
+
+    loadChats();
+}
+
+function setFilter(filter) {
+    currentFilter = filter;
+    highlightFilter();
+    loadChats();
+}
+
+function highlightFilter() {
+    document.querySelectorAll('.inbox-filter').forEach(btn => {
+        btn.className = btn.dataset.filter === currentFilter
+            ? 'inbox-filter flex-1 py-1 rounded bg-green-600 text-white'
+            : 'inbox-filter flex-1 py-1 rounded bg-gray-100 text-gray-700 hover:bg-gray-200';
+    });
+}
+
+// Load the chat list of the current line
+async function loadChats() {
+    if (!currentLine) {
+        return;
+    }
+
+    const params = new URLSearchParams({ limit: 100 });
+    if (currentFilter === 'open' || currentFilter === 'closed') {
+        params.set('status', currentFilter);
+    } else if (currentFilter === 'mine') {
+        params.set('status', 'open');
+        params.set('assigned_to', agentName());
+    }
+
+    try {
+        const response = await fetch(`${API_BASE}/lines/${currentLine}/chats?${params}`);
+        if (!response.ok) {
+            throw new Error('Error al cargar conversaciones');
+        }
+
+        chats = (await response.json()).chats || [];
+        renderChats();
+    } catch (error) {
+        console.error('Error:', error);
+        showToast('Error al cargar conversaciones', 'error');
+    }
+}
+
+function renderChats() {
+    const container = document.getElementById('chatList');
+
+    if (chats.length === 0) {
+        container.innerHTML = '<p class="text-gray-500 text-center py-8">No hay conversaciones</p>';
+        return;
+    }
+
+    container.innerHTML = chats.map(chat => `
+        <div onclick="openChat('${chat.chat}')" class="p-4 border-b border-gray-100 cursor-pointer hover:bg-gray-50 ${chat.chat === currentChat ? 'bg-green-50' : ''}">
+            <div class="flex items-center justify-between">
+                <p class="font-semibold text-gray-800 truncate">
+                    ${chat.is_group ? '<i class="fas fa-users mr-1 text-gray-500"></i>' : ''}${escapeHTML(chatName(chat.chat))}
+                </p>
+                ${chat.unread_count > 0 ? `<span class="px-2 py-0.5 rounded-full text-xs font-bold bg-green-600 text-white">${chat.unread_count}</span>` : ''}
+            </div>
+            <p class="text-sm text-gray-600 truncate">
+                ${chat.last_message.direction === 'sent' ? '<i class="fas fa-reply mr-1 text-gray-400"></i>' : ''}${escapeHTML(chat.last_message.text || `[${chat.last_message.type}]`)}
+            </p>
+            <p class="text-xs text-gray-400 mt-1">
+                ${new Date(chat.last_message_at).toLocaleString()}
+                ${chat.assigned_to ? ` · <i class="fas fa-user mr-1"></i>${escapeHTML(chat.assigned_to)}` : ''}
+                ${chat.status === 'closed' ? ' · Cerrado' : ''}
+            </p>
+        </div>
+    `).join('');
+}
+
+// Open a thread and mark it as read
+async function openChat(chat) {
+    currentChat = chat;
+    renderChats();
+    await loadThread();
+
+    try {
+        await fetch(`${API_BASE}/lines/${currentLine}/chats/${encodeURIComponent(chat)}/read`, { method: 'POST' });
+    } catch (error) {
+        console.error('Error:', error);
+    }
+}
+
+async function loadThread() {
+    try {
+        const response = await fetch(`${API_BASE}/lines/${currentLine}/chats/${encodeURIComponent(currentChat)}/messages?limit=100`);
+        if (!response.ok) {
+            throw new Error('Error al cargar mensajes');
+        }
+
+        const data = await response.json();
+        renderThread((data.messages || []).reverse());
+    } catch (error) {
+        console.error('Error:', error);
+        showToast('Error al cargar mensajes', 'error');
+    }
+}
+
+function renderThread(messages) {
+    const header = document.getElementById('threadHeader');
+    const reply = document.getElementById('threadReply');
+    const container = document.getElementById('threadMessages');
+
+    if (!currentChat) {
+        header.classList.add('hidden');
+        reply.classList.add('hidden');
+        container.innerHTML = '<p class="text-gray-500 text-center py-8">Selecciona una conversación</p>';
+        return;
+    }
+
+    const chat = chats.find(c => c.chat === currentChat) || { assigned_to: '', status: 'open' };
+    document.getElementById('threadTitle').textContent = chatName(currentChat);
+    document.getElementById('threadAssignee').textContent = chat.assigned_to ? `Asignado a ${chat.assigned_to}` : 'Sin asignar';
+    document.getElementById('threadStatusButton').innerHTML = chat.status === 'closed'
+        ? '<i class="fas fa-folder-open mr-1"></i>Reabrir'
+        : '<i class="fas fa-check mr-1"></i>Cerrar';
+    header.classList.remove('hidden');
+    reply.classList.remove('hidden');
+
+    container.innerHTML = messages.map(msg => `
+        <div class="flex ${msg.direction === 'sent' ? 'justify-end' : 'justify-start'}">
+            <div class="max-w-md px-4 py-2 rounded-lg shadow-sm ${msg.direction === 'sent' ? 'bg-green-100' : 'bg-white'}">
+                ${msg.is_group && msg.direction === 'received' ? `<p class="text-xs font-semibold text-gray-500">${escapeHTML(chatName(msg.sender))}</p>` : ''}
+                ${msg.media_url ? `<a href="#" data-media-url="${escapeHTML(msg.media_url)}" onclick="openMedia(event, this.dataset.mediaUrl)" class="text-blue-600 text-sm"><i class="fas fa-paperclip mr-1"></i>${escapeHTML(msg.type)}</a>` : ''}
+                ${msg.revoked_at
+                    ? '<p class="text-gray-400 italic"><i class="fas fa-ban mr-1"></i>Mensaje eliminado</p>'
+                    : `<p class="text-gray-800 whitespace-pre-wrap">${escapeHTML(msg.text || (msg.media_url ? '' : `[${msg.type}]`))}</p>`}
+                ${(msg.reactions || []).length ? `<p class="text-sm mt-1">${msg.reactions.map(r => escapeHTML(r.emoji)).join(' ')}</p>` : ''}
+                <p class="text-xs text-gray-400 text-right mt-1">
+                    ${msg.edited_at && !msg.revoked_at ? 'Editado · ' : ''}${new Date(msg.timestamp).toLocaleTimeString()}
+                    ${msg.direction === 'sent' ? deliveryIcon(msg.delivery_status) : ''}
+                </p>
+            </div>
+        </div>
+    `).join('');
+    container.scrollTop = container.scrollHeight;
+}
+
+// Media requires the API key header, so it is fetched and opened as a blob.
+// Only what the server marks as inline (images, audio, video) is displayed;
+// anything else is downloaded so it never runs in this origin
+async function openMedia(event, url) {
+    event.preventDefault();
+    const win = window.open('', '_blank');
+
+    try {
+        const response = await fetch(url);
+        if (!response.ok) {
+            throw new Error(await response.text());
+        }
+
+        const disposition = response.headers.get('Content-Disposition') || '';
+        const blob = await response.blob();
+
+        if (disposition.startsWith('inline') && win) {
+            win.location = URL.createObjectURL(blob);
+            return;
+        }
+
+        if (win) {
+            win.close();
+        }
+        const match = disposition.match(/filename="?([^";]+)"?/);
+        const link = document.createElement('a');
+        link.href = URL.createObjectURL(new Blob([blob], { type: 'application/octet-stream' }));
+        link.download = match ? match[1] : 'archivo';
+        link.click();
+        setTimeout(() => URL.revokeObjectURL(link.href), 60000);
+    } catch (error) {
+        if (win) {
+            win.close();
+        }
+        console.error('Error:', error);
+        showToast('Error al abrir archivo', 'error');
+    }
+}
+
+// Reply from the thread through the regular send endpoint
+async function sendReply() {
+    const textarea = document.getElementById('replyText');
+    const message = textarea.value.trim();
+    if (!message || !currentChat) {
+        return;
+    }
+
+    try {
+        const response = await fetch(`${API_BASE}/messages/send`, {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json',
+            },
+            body: JSON.stringify({ from: currentLine, to: currentChat, message }),
+        });
+
+        if (!response.ok) {
+            throw new Error(await response.text());
+        }
+
+        textarea.value = '';
+        loadThread();
+    } catch (error) {
+        console.error('Error:', error);
+        showToast(error.message || 'Error al enviar la respuesta', 'error');
+    }
+}
+
+async function updateChat(changes) {
+    try {
+        const response = await fetch(`${API_BASE}/lines/${currentLine}/chats/${encodeURIComponent(currentChat)}`, {
+            method: 'PUT',
+            headers: {
+                'Content-Type': 'application/json',
+            },
+            body: JSON.stringify(changes),
+        });
+
+        if (!response.ok) {
+            throw new Error('Error al actualizar la conversación');
+        }
+
+        await loadChats();
+        loadThread();
+    } catch (error) {
+        console.error('Error:', error);
+        showToast('Error al actualizar la conversación', 'error');
+    }
+}
+
+function assignToMe() {
+    const name = agentName();
+    if (name) {
+        updateChat({ assigned_to: name });
+    }
+}
+
+function toggleChatStatus() {
+    const chat = chats.find(c => c.chat === currentChat);
+    updateChat({ status: chat && chat.status === 'closed' ? 'open' : 'closed' });
+}
+
+function chatName(jid) {
+    return jid.split('@')[0];
+}
+
+function deliveryIcon(status) {
+    switch (status) {
+        case 'read':
+        case 'played':
+            return '<i class="fas fa-check-double text-blue-500 ml-1"></i>';
+        case 'delivered':
+            return '<i class="fas fa-check-double ml-1"></i>';
+        default:
+            return '<i class="fas fa-check ml-1"></i>';
+    }
+}
+
+// Safe for text and quoted attribute values
+function escapeHTML(text) {
+    const div = document.createElement('div');
+    div.textContent = text;
+    return div.innerHTML.replace(/"/g, '&quot;').replace(/'/g, '&#39;');
+}
+
+// Show Toast Notification
+function showToast(message, type = 'info') {
+    const toast = document.getElementById('toast');
+    const toastMessage = document.getElementById('toastMessage');
+
+    const colors = {
+        success: 'bg-green-600 text-white',
+        error: 'bg-red-600 text-white',
+        info: 'bg-blue-600 text-white'
+    };
+
+    toast.className = `fixed bottom-4 right-4 px-6 py-3 rounded-lg shadow-lg ${colors[type]}`;
+    toastMessage.textContent = message;
+    toast.classList.remove('hidden');
+
+    setTimeout(() => {
+        toast.classList.add('hidden');
+    }, 3000);
+}
@@ -6,6 +6,7 @@ let messageHistory = [];
 // Límites de tamaño de archivo (en bytes)
 const FILE_SIZE_LIMITS = {
     'image': 5 * 1024 * 1024,      // 5 MB
+    'sticker': 5 * 1024 * 1024,    // 5 MB (se convierte a WebP 512x512)
     'audio': 16 * 1024 * 1024,     // 16 MB
     'video': 16 * 1024 * 1024,     // 16 MB
     'document': 100 * 1024 * 1024  // 100 MB
@@ -14,6 +15,7 @@ const FILE_SIZE_LIMITS = {
 // MIME types recomendados
 const RECOMMENDED_MIMES = {
     'image': ['image/jpeg', 'image/png', 'image/gif', 'image/webp'],
+    'sticker': ['image/png', 'image/jpeg', 'image/webp'],
     'audio': ['audio/ogg', 'audio/mpeg', 'audio/mp3', 'audio/aac'],
     'video': ['video/mp4', 'video/3gpp', 'video/quicktime'],
     'document': ['application/pdf', 'application/msword', 'application/vnd.openxmlformats-officedocument.wordprocessingml.document']
@@ -97,12 +99,9 @@ async function sendMessageWithLine(event) {
                 return;
             }
 
-            // Convertir archivo a base64
-            showToast('Procesando archivo...', 'info');
-            const base64Data = await fileToBase64(file);
-            
+            // El archivo se envía como multipart/form-data
             payload.media_type = messageType;
-            payload.media_data = base64Data;
+            payload.file = file;
             payload.mime_type = file.type;
             
             if (messageType === 'document') {
@@ -115,13 +114,7 @@ async function sendMessageWithLine(event) {
             }
         }
 
-        const response = await fetch(`${API_BASE}/messages/send`, {
-            method: 'POST',
-            headers: {
-                'Content-Type': 'application/json',
-            },
-            body: JSON.stringify(payload),
-        });
+        const response = await fetch(`${API_BASE}/messages/send`, requestOptions(payload));
 
         if (!response.ok) {
             const error = await response.text();
@@ -189,12 +182,9 @@ async function sendMessageAuto(event) {
                 return;
             }
 
-            // Convertir archivo a base64
-            showToast('Procesando archivo...', 'info');
-            const base64Data = await fileToBase64(file);
-            
+            // El archivo se envía como multipart/form-data
             payload.media_type = messageType;
-            payload.media_data = base64Data;
+            payload.file = file;
             payload.mime_type = file.type;
             
             if (messageType === 'document') {
@@ -207,13 +197,7 @@ async function sendMessageAuto(event) {
             }
         }
 
-        const response = await fetch(`${API_BASE}/messages/send-auto`, {
-            method: 'POST',
-            headers: {
-                'Content-Type': 'application/json',
-            },
-            body: JSON.stringify(payload),
-        });
+        const response = await fetch(`${API_BASE}/messages/send-auto`, requestOptions(payload));
 
         if (!response.ok) {
             const error = await response.text();
@@ -452,17 +436,26 @@ function handleFileSelectAuto(event) {
     }
 }
 
-// Convert file to base64
-function fileToBase64(file) {
-    return new Promise((resolve, reject) => {
-        const reader = new FileReader();
-        reader.onload = () => {
-            // Retornar el data URL completo (incluye data:image/png;base64,...)
-            resolve(reader.result);
+// Build fetch options: JSON for text, multipart/form-data when there is a file
+function requestOptions(payload) {
+    if (!payload.file) {
+        return {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json',
+            },
+            body: JSON.stringify(payload),
         };
-        reader.onerror = reject;
-        reader.readAsDataURL(file);
-    });
+    }
+
+    const form = new FormData();
+    for (const [key, value] of Object.entries(payload)) {
+        if (key !== 'file' && value) {
+            form.append(key, value);
+        }
+    }
+    form.append('file', payload.file, payload.file.name);
+    return { method: 'POST', body: form };
 }
 
 // Format file size
@@ -82,6 +82,8 @@ function updateOverview(overview) {
     document.getElementById('totalSent').textContent = overview.total_sent || 0;
     document.getElementById('totalReceived').textContent = overview.total_received || 0;
     document.getElementById('totalLines').textContent = overview.total_lines || 0;
+    document.getElementById('totalCalls').textContent = overview.total_calls || 0;
+    document.getElementById('rejectedCalls').textContent = overview.rejected_calls || 0;
 }
 
 // Update messages per day chart
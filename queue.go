@@ -0,0 +1,596 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Estados de un mensaje en la cola de salida
+const (
+	QueueStatusQueued  = "queued"
+	QueueStatusSending = "sending"
+	QueueStatusSent    = "sent"
+	QueueStatusFailed  = "failed"
+)
+
+const (
+	outboundWorkersPerLine = 2
+	outboundMaxAttempts    = 5
+	outboundBaseBackoff    = 2 * time.Second
+	outboundMaxBackoff     = 5 * time.Minute
+	outboundPollInterval   = time.Second
+	// Tiempo que una petición síncrona espera el resultado antes de responder 202
+	syncSendTimeout = 30 * time.Second
+)
+
+type QueuedMessage struct {
+	ID          string     `json:"id"`
+	LineID      string     `json:"line_id"`
+	To          string     `json:"to"`
+	MediaType   string     `json:"media_type"`
+	Status      string     `json:"status"`
+	Attempts    int        `json:"attempts"`
+	MaxAttempts int        `json:"max_attempts"`
+	LastError   string     `json:"error,omitempty"`
+	NextAttempt *time.Time `json:"next_attempt_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	SentAt      *time.Time `json:"sent_at,omitempty"`
+	WhatsAppID  string     `json:"whatsapp_id,omitempty"`
+	*DeliveryInfo
+
+	request MessageRequest
+}
+
+var (
+	// Canales para avisar a las peticiones síncronas cuando un mensaje termina
+	queueWaiters      = make(map[string]chan *QueuedMessage)
+	queueWaitersMutex sync.Mutex
+)
+
+// Encolar un mensaje para la línea indicada
+func enqueueMessage(line *Line, req MessageRequest) (*QueuedMessage, error) {
+	req.From = line.ID
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	item := &QueuedMessage{
+		ID:          fmt.Sprintf("msg_%d", now.UnixNano()),
+		LineID:      line.ID,
+		To:          req.To,
+		MediaType:   req.MediaType,
+		Status:      QueueStatusQueued,
+		MaxAttempts: outboundMaxAttempts,
+		NextAttempt: &now,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+		request:     req,
+	}
+
+	_, err = configDB.Exec(`
+		INSERT INTO outbound_queue
+		(id, line_id, recipient, media_type, request, media_file, status, attempts, max_attempts, next_attempt_at, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, 0, ?, ?, ?, ?)
+	`, item.ID, item.LineID, item.To, item.MediaType, string(payload), req.mediaFile, item.Status, item.MaxAttempts, now, now, now)
+	if err != nil {
+		return nil, err
+	}
+
+	line.notifyQueue()
+	return item, nil
+}
+
+func scanQueuedMessage(scanner interface{ Scan(...interface{}) error }) (*QueuedMessage, error) {
+	var item QueuedMessage
+	var payload string
+	var lastError, whatsappID, mediaFile sql.NullString
+	var nextAttempt, sentAt sql.NullTime
+
+	err := scanner.Scan(&item.ID, &item.LineID, &item.To, &item.MediaType, &payload, &item.Status,
+		&item.Attempts, &item.MaxAttempts, &lastError, &nextAttempt, &item.CreatedAt, &item.UpdatedAt, &sentAt, &whatsappID, &mediaFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(payload), &item.request); err != nil {
+		return nil, fmt.Errorf("solicitud corrupta en cola: %v", err)
+	}
+	item.request.mediaFile = mediaFile.String
+	item.LastError = lastError.String
+	item.WhatsAppID = whatsappID.String
+	if nextAttempt.Valid && item.Status == QueueStatusQueued {
+		item.NextAttempt = &nextAttempt.Time
+	}
+	if sentAt.Valid {
+		item.SentAt = &sentAt.Time
+	}
+	return &item, nil
+}
+
+const queueColumns = `id, line_id, recipient, media_type, request, status,
+	attempts, max_attempts, last_error, next_attempt_at, created_at, updated_at, sent_at, whatsapp_id, media_file`
+
+// Obtener un mensaje de la cola por ID
+func getQueuedMessage(id string) (*QueuedMessage, error) {
+	row := configDB.QueryRow("SELECT "+queueColumns+" FROM outbound_queue WHERE id = ?", id)
+	return scanQueuedMessage(row)
+}
+
+// Reservar el siguiente mensaje pendiente de la línea. No se toman mensajes
+// para un destinatario que ya tiene otro envío en curso, para conservar el orden.
+func claimNextQueuedMessage(lineID string) (*QueuedMessage, error) {
+	now := time.Now().UTC()
+	row := configDB.QueryRow(`
+		UPDATE outbound_queue
+		SET status = ?, updated_at = ?
+		WHERE id = (
+			SELECT id FROM outbound_queue
+			WHERE line_id = ? AND status = ? AND next_attempt_at <= ?
+			AND recipient NOT IN (
+				SELECT recipient FROM outbound_queue WHERE line_id = ? AND status = ?
+			)
+			ORDER BY created_at ASC
+			LIMIT 1
+		) AND status = ?
+		RETURNING `+queueColumns,
+		QueueStatusSending, now, lineID, QueueStatusQueued, now, lineID, QueueStatusSending, QueueStatusQueued)
+
+	item, err := scanQueuedMessage(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return item, err
+}
+
+// Calcular el backoff exponencial para el intento indicado
+func outboundBackoff(attempts int) time.Duration {
+	backoff := outboundBaseBackoff
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= outboundMaxBackoff {
+			return outboundMaxBackoff
+		}
+	}
+	return backoff
+}
+
+// Registrar el resultado de un intento de envío
+func finishQueuedMessage(item *QueuedMessage, sendErr error) {
+	now := time.Now().UTC()
+	item.Attempts++
+	item.UpdatedAt = now
+
+	if sendErr == nil {
+		item.Status = QueueStatusSent
+		item.LastError = ""
+		item.NextAttempt = nil
+		item.SentAt = &now
+	} else if item.Attempts >= item.MaxAttempts {
+		item.Status = QueueStatusFailed
+		item.LastError = sendErr.Error()
+		item.NextAttempt = nil
+	} else {
+		next := now.Add(outboundBackoff(item.Attempts))
+		item.Status = QueueStatusQueued
+		item.LastError = sendErr.Error()
+		item.NextAttempt = &next
+	}
+
+	var nextAttempt interface{}
+	if item.NextAttempt != nil {
+		nextAttempt = *item.NextAttempt
+	}
+	var sentAt interface{}
+	if item.SentAt != nil {
+		sentAt = *item.SentAt
+	}
+
+	_, err := configDB.Exec(`
+		UPDATE outbound_queue
+		SET status = ?, attempts = ?, last_error = ?, next_attempt_at = ?, updated_at = ?, sent_at = ?, whatsapp_id = ?
+		WHERE id = ?
+	`, item.Status, item.Attempts, item.LastError, nextAttempt, now, sentAt, item.WhatsAppID, item.ID)
+	if err != nil {
+		log.Printf("Error al actualizar mensaje %s en cola: %v", item.ID, err)
+	}
+
+	if item.Status == QueueStatusSent || item.Status == QueueStatusFailed {
+		discardStagedMedia(item.request)
+
+		queueWaitersMutex.Lock()
+		if ch, ok := queueWaiters[item.ID]; ok {
+			ch <- item
+			delete(queueWaiters, item.ID)
+		}
+		queueWaitersMutex.Unlock()
+	}
+}
+
+// Marcar como fallidos los mensajes pendientes de una línea eliminada
+func failPendingMessages(lineID, reason string) {
+	_, err := configDB.Exec(`
+		UPDATE outbound_queue SET status = ?, last_error = ?, updated_at = ?
+		WHERE line_id = ? AND status IN (?, ?)
+	`, QueueStatusFailed, reason, time.Now().UTC(), lineID, QueueStatusQueued, QueueStatusSending)
+	if err != nil {
+		log.Printf("Error al cancelar cola de línea %s: %v", lineID, err)
+	}
+}
+
+// Devolver a la cola los envíos interrumpidos por un reinicio
+func recoverOutboundQueue() error {
+	_, err := configDB.Exec("UPDATE outbound_queue SET status = ?, updated_at = ? WHERE status = ?",
+		QueueStatusQueued, time.Now().UTC(), QueueStatusSending)
+	return err
+}
+
+// Avisar a los workers de la línea que hay trabajo nuevo
+func (line *Line) notifyQueue() {
+	if line.queueNotify == nil {
+		return
+	}
+	select {
+	case line.queueNotify <- struct{}{}:
+	default:
+	}
+}
+
+// Arrancar el pool de workers de envío de una línea
+func startOutboundWorkers(line *Line) {
+	ctx, cancel := context.WithCancel(context.Background())
+	line.queueNotify = make(chan struct{}, 1)
+	line.stopWorkers = cancel
+
+	for i := 0; i < outboundWorkersPerLine; i++ {
+		go outboundWorker(ctx, line)
+	}
+}
+
+// Detener los workers de envío de una línea
+func stopOutboundWorkers(line *Line) {
+	if line.stopWorkers != nil {
+		line.stopWorkers()
+	}
+}
+
+func outboundWorker(ctx context.Context, line *Line) {
+	ticker := time.NewTicker(outboundPollInterval)
+	defer ticker.Stop()
+
+	for {
+		// Solo se envía cuando la línea está conectada y activa
+		for line.Available && line.Status == "connected" {
+			item, err := claimNextQueuedMessage(line.ID)
+			if err != nil {
+				log.Printf("Error al leer cola de línea %s: %v", line.ID, err)
+				break
+			}
+			if item == nil {
+				break
+			}
+			// Respetar los límites y la pausa entre envíos de la línea
+			if !paceQueuedMessage(ctx, line, item) {
+				if ctx.Err() != nil {
+					return
+				}
+				continue
+			}
+			// La escritura simulada no ocupa al worker, pero solo puede
+			// haber typingSendsPerLine en curso: si no hay turno, se espera
+			if shouldSimulateTyping(line, item.request) {
+				state := typingStateFor(line.ID)
+				if !state.acquire(ctx) {
+					return
+				}
+				go sendWithTyping(ctx, line, item, state)
+				continue
+			}
+			processQueuedMessage(line, item)
+			if ctx.Err() != nil {
+				return
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-line.queueNotify:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Construir y enviar un mensaje de la cola
+func processQueuedMessage(line *Line, item *QueuedMessage) {
+	req := item.request
+
+	recipient, err := parseJID(req.To)
+	var msg *waProto.Message
+	if err == nil {
+		msg, err = buildMessage(line, recipient, req)
+	}
+	if err == nil {
+		var resp whatsmeow.SendResponse
+		resp, err = line.Client.SendMessage(context.Background(), recipient, msg)
+		item.WhatsAppID = string(resp.ID)
+	}
+
+	if err != nil {
+		log.Printf("Error al enviar mensaje %s (intento %d): %v", item.ID, item.Attempts+1, err)
+		finishQueuedMessage(item, err)
+		return
+	}
+
+	line.LastUsed = time.Now()
+
+	// Se registra antes de liberar al solicitante para que los recibos
+	// que lleguen de inmediato encuentren el mensaje
+	stored := StoredMessage{
+		LineID:    line.ID,
+		Direction: "sent",
+		MessageID: item.WhatsAppID,
+		Chat:      recipient.String(),
+		Sender:    ownJID(line),
+		Type:      req.MediaType,
+		Text:      req.Message,
+		IsGroup:   recipient.Server == types.GroupServer,
+	}
+	if req.ReplyTo != nil {
+		stored.QuotedID = req.ReplyTo.MessageID
+	}
+	if stored.Type == "" {
+		stored.Type = "text"
+	}
+	if stored.Text == "" {
+		stored.Text = req.Caption
+	}
+	if stored.Text == "" {
+		stored.Text = structuredTextOf(msg)
+	}
+	savePollOf(line.ID, item.WhatsAppID, recipient, msg)
+	if err := logMessage(stored); err != nil {
+		log.Printf("Error al registrar mensaje enviado: %v", err)
+	} else {
+		chatActivity(stored)
+	}
+
+	finishQueuedMessage(item, nil)
+}
+
+// JID propio de la línea, sin dispositivo. Vacío si la sesión se cerró
+// mientras tanto
+func ownJID(line *Line) string {
+	if id := line.Client.StoreID(); id != nil {
+		return id.ToNonAD().String()
+	}
+	return ""
+}
+
+// Construir el mensaje de WhatsApp a partir de la solicitud
+func buildMessage(line *Line, recipient types.JID, req MessageRequest) (*waProto.Message, error) {
+	ctxInfo, err := buildContextInfo(line.ID, recipient, req)
+	if err != nil {
+		return nil, err
+	}
+	if len(req.Mentions) > 0 {
+		req.Message = mentionText(req.Message, req.Mentions)
+		if req.Caption != "" {
+			req.Caption = mentionText(req.Caption, req.Mentions)
+		}
+	}
+
+	var msg *waProto.Message
+	if req.MediaType == "location" || req.MediaType == "contact" {
+		msg, err = createStructuredMessage(req)
+		if err != nil {
+			return nil, err
+		}
+	} else if req.MediaType == "poll" {
+		msg = line.Client.BuildPollCreation(req.Poll.Question, req.Poll.Options, req.Poll.SelectableCount)
+	} else if req.MediaType != "" && req.MediaType != "text" {
+		msg, err = createMediaMessage(line.Client, req)
+		if err != nil {
+			return nil, fmt.Errorf("error al procesar media: %v", err)
+		}
+	} else {
+		msg = &waProto.Message{
+			Conversation: &req.Message,
+		}
+	}
+
+	if ctxInfo != nil {
+		attachContextInfo(msg, ctxInfo)
+	}
+	return msg, nil
+}
+
+// Validar una solicitud antes de encolarla, para rechazar con 400 lo que
+// nunca podrá enviarse en lugar de reintentarlo
+func validateMessageRequest(req MessageRequest) error {
+	if _, err := parseJID(req.To); err != nil {
+		return fmt.Errorf("Número de destino inválido")
+	}
+
+	if err := validateReplyAndMentions(req); err != nil {
+		return err
+	}
+
+	if err := validateOnLimit(req.OnLimit); err != nil {
+		return err
+	}
+
+	if req.Thumbnail != "" {
+		if err := validateThumbnail(req); err != nil {
+			return err
+		}
+	}
+
+	switch req.MediaType {
+	case "", "text":
+		if req.Message == "" {
+			return fmt.Errorf("Message es requerido para mensajes de texto")
+		}
+	case "image", "sticker", "audio", "voice", "video", "document":
+		if req.mediaFile != "" {
+			break
+		}
+		if req.MediaURL != "" {
+			if req.MediaData != "" {
+				return fmt.Errorf("media_data y media_url son excluyentes")
+			}
+			return validateMediaURL(req.MediaURL)
+		}
+
+		data := req.MediaData
+		if strings.HasPrefix(data, "data:") {
+			if comma := strings.Index(data, ","); comma > 0 {
+				data = data[comma+1:]
+			}
+		}
+		// El base64 se decodifica y valida en prepareMedia
+		if data == "" {
+			return fmt.Errorf("media_data, media_url o un archivo es requerido para %s", req.MediaType)
+		}
+	case "location", "contact":
+		if err := validateStructuredRequest(req); err != nil {
+			return err
+		}
+	case "poll":
+		if err := validatePollRequest(req); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("tipo de media no soportado: %s", req.MediaType)
+	}
+
+	return nil
+}
+
+// Encolar y responder: 202 en modo asíncrono; en modo síncrono espera el
+// resultado y responde 202 si sigue pendiente tras syncSendTimeout
+func enqueueAndRespond(w http.ResponseWriter, line *Line, req MessageRequest, async bool) {
+	// Con la línea sin cupo se rechaza con 429 o se encola sin esperar el
+	// envío, que saldrá cuando se libere el límite
+	limitErr, overLimit := checkRateLimits(line, req.To, "", true).(*rateLimitError)
+	if overLimit {
+		if onLimitFor(line, req) == OnLimitReject {
+			discardStagedMedia(req)
+			writeRateLimited(w, limitErr)
+			return
+		}
+		async = true
+	}
+
+	// La media se descarga y valida antes de encolar para rechazar de
+	// inmediato URLs inaccesibles y archivos demasiado grandes o de otro tipo
+	if err := prepareMedia(&req); err != nil {
+		discardStagedMedia(req)
+		writeRequestError(w, err)
+		return
+	}
+
+	item, err := enqueueMessage(line, req)
+	if err != nil {
+		discardStagedMedia(req)
+		log.Printf("Error al encolar mensaje: %v", err)
+		http.Error(w, "Error al encolar mensaje", http.StatusInternalServerError)
+		return
+	}
+
+	if !async {
+		done := make(chan *QueuedMessage, 1)
+		queueWaitersMutex.Lock()
+		queueWaiters[item.ID] = done
+		queueWaitersMutex.Unlock()
+
+		// El mensaje pudo terminar antes de registrar la espera
+		if current, err := getQueuedMessage(item.ID); err == nil && (current.Status == QueueStatusSent || current.Status == QueueStatusFailed) {
+			queueWaitersMutex.Lock()
+			delete(queueWaiters, item.ID)
+			queueWaitersMutex.Unlock()
+			item = current
+		} else {
+			select {
+			case item = <-done:
+			case <-time.After(syncSendTimeout):
+				queueWaitersMutex.Lock()
+				delete(queueWaiters, item.ID)
+				queueWaitersMutex.Unlock()
+				if current, err := getQueuedMessage(item.ID); err == nil {
+					item = current
+				}
+			}
+		}
+
+		switch item.Status {
+		case QueueStatusSent:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{
+				"message":     "Mensaje enviado",
+				"line_id":     line.ID,
+				"id":          item.ID,
+				"status":      item.Status,
+				"whatsapp_id": item.WhatsAppID,
+			})
+			return
+		case QueueStatusFailed:
+			http.Error(w, fmt.Sprintf("Error al enviar mensaje: %s", item.LastError), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if overLimit {
+		// Cuándo se espera que la línea vuelva a tener cupo
+		w.Header().Set("Retry-After", retryAfterHeader(limitErr))
+	}
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Mensaje encolado",
+		"line_id": line.ID,
+		"id":      item.ID,
+		"status":  item.Status,
+	})
+}
+
+// Consultar estado de un mensaje
+func getMessageStatus(w http.ResponseWriter, r *http.Request) {
+	item, err := getQueuedMessage(mux.Vars(r)["id"])
+	if err == sql.ErrNoRows {
+		http.Error(w, "Mensaje no encontrado", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error al consultar mensaje: %v", err)
+		http.Error(w, "Error al consultar mensaje", http.StatusInternalServerError)
+		return
+	}
+
+	if !canAccessLine(r, item.LineID) {
+		http.Error(w, "Mensaje no encontrado", http.StatusNotFound)
+		return
+	}
+
+	if item.WhatsAppID != "" {
+		if info, err := getDeliveryInfo(item.LineID, item.WhatsAppID); err == nil {
+			item.DeliveryInfo = info
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(item)
+}
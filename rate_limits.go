@@ -0,0 +1,474 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Qué hacer con un envío que supera los límites de la línea
+const (
+	OnLimitQueue  = "queue"  // Encolarlo y enviarlo cuando haya cupo
+	OnLimitReject = "reject" // Rechazarlo con 429 y Retry-After
+)
+
+// Límites de envío de una línea; 0 = sin límite
+type RateLimits struct {
+	PerMinute         int    `json:"per_minute"`
+	PerHour           int    `json:"per_hour"`
+	PerDay            int    `json:"per_day"`              // Día natural, hora local
+	NewContactsPerDay int    `json:"new_contacts_per_day"` // Chats que la línea inicia por primera vez
+	MinDelayMs        int    `json:"min_delay_ms"`         // Pausa aleatoria entre envíos, entre min y max
+	MaxDelayMs        int    `json:"max_delay_ms"`
+	OnLimit           string `json:"on_limit"` // "queue" (default) o "reject"
+}
+
+// Uso actual de los límites de una línea
+type RateUsage struct {
+	LastMinute     int `json:"last_minute"`
+	LastHour       int `json:"last_hour"`
+	Today          int `json:"today"`
+	NewContacts    int `json:"new_contacts_today"`
+	Pending        int `json:"pending"`
+	RetryAfterSecs int `json:"retry_after,omitempty"` // Espera hasta el próximo envío posible
+}
+
+// Límite alcanzado: cuánto falta para que se libere y cuál es
+type rateLimitError struct {
+	RetryAfter time.Duration
+	Reason     string
+}
+
+func (e *rateLimitError) Error() string {
+	return e.Reason
+}
+
+// Ritmo de envío de cada línea: momento a partir del cual puede salir el
+// siguiente mensaje
+type sendPacer struct {
+	mu         sync.Mutex
+	nextSendAt time.Time
+}
+
+var (
+	sendPacers      = make(map[string]*sendPacer)
+	sendPacersMutex sync.Mutex
+)
+
+func sendPacerFor(lineID string) *sendPacer {
+	sendPacersMutex.Lock()
+	defer sendPacersMutex.Unlock()
+	pacer, ok := sendPacers[lineID]
+	if !ok {
+		pacer = &sendPacer{}
+		sendPacers[lineID] = pacer
+	}
+	return pacer
+}
+
+// Validar los límites recibidos por la API
+func validateRateLimits(limits RateLimits) error {
+	if limits.PerMinute < 0 || limits.PerHour < 0 || limits.PerDay < 0 || limits.NewContactsPerDay < 0 {
+		return fmt.Errorf("Los límites no pueden ser negativos")
+	}
+	if limits.MinDelayMs < 0 || limits.MaxDelayMs < 0 {
+		return fmt.Errorf("Las pausas no pueden ser negativas")
+	}
+	if limits.MaxDelayMs != 0 && limits.MaxDelayMs < limits.MinDelayMs {
+		return fmt.Errorf("max_delay_ms no puede ser menor que min_delay_ms")
+	}
+	return validateOnLimit(limits.OnLimit)
+}
+
+func validateOnLimit(onLimit string) error {
+	switch onLimit {
+	case "", OnLimitQueue, OnLimitReject:
+		return nil
+	}
+	return fmt.Errorf("on_limit debe ser \"queue\" o \"reject\"")
+}
+
+// Política ante un límite: la de la solicitud o, si no indica, la de la línea
+func onLimitFor(line *Line, req MessageRequest) string {
+	if req.OnLimit != "" {
+		return req.OnLimit
+	}
+	if line.Limits.OnLimit != "" {
+		return line.Limits.OnLimit
+	}
+	return OnLimitQueue
+}
+
+// Pausa aleatoria antes del siguiente envío
+func randomSendDelay(limits RateLimits) time.Duration {
+	minDelay, maxDelay := limits.MinDelayMs, limits.MaxDelayMs
+	if maxDelay < minDelay {
+		maxDelay = minDelay
+	}
+	delay := minDelay
+	if maxDelay > minDelay {
+		delay += rand.Intn(maxDelay - minDelay + 1)
+	}
+	return time.Duration(delay) * time.Millisecond
+}
+
+func startOfToday() time.Time {
+	now := time.Now()
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+}
+
+// Comprobar si la línea puede enviar a recipient. Cuentan los mensajes
+// enviados en cada ventana más los que están en curso (excepto excludeID);
+// con includeQueued también los que esperan en cola, que consumirán cupo
+// antes que este. Devuelve un *rateLimitError si se supera algún límite
+func checkRateLimits(line *Line, recipient, excludeID string, includeQueued bool) error {
+	limits := line.Limits
+
+	// El calentamiento de un número nuevo reduce el límite diario
+	perDay, perDayReason := limits.PerDay, "Límite de mensajes por día alcanzado"
+	if warmupLimit := line.Warmup.dailyLimit(); warmupLimit > 0 && (perDay == 0 || warmupLimit < perDay) {
+		perDay = warmupLimit
+		perDayReason = fmt.Sprintf("Límite de calentamiento alcanzado (día %d: %d mensajes)", line.Warmup.currentDay(), warmupLimit)
+	}
+
+	if limits.PerMinute == 0 && limits.PerHour == 0 && perDay == 0 && limits.NewContactsPerDay == 0 {
+		return nil
+	}
+
+	pending, err := pendingSends(line.ID, excludeID, includeQueued)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var exceeded *rateLimitError
+	exceed := func(wait time.Duration, reason string) {
+		if exceeded == nil || wait > exceeded.RetryAfter {
+			exceeded = &rateLimitError{RetryAfter: wait, Reason: reason}
+		}
+	}
+
+	windows := []struct {
+		limit  int
+		window time.Duration
+		reason string
+	}{
+		{limits.PerMinute, time.Minute, "Límite de mensajes por minuto alcanzado"},
+		{limits.PerHour, time.Hour, "Límite de mensajes por hora alcanzado"},
+	}
+	for _, w := range windows {
+		if w.limit == 0 {
+			continue
+		}
+		sent, oldest, err := sentSince(line.ID, now.Add(-w.window))
+		if err != nil {
+			return err
+		}
+		if sent+pending >= w.limit {
+			// Se libera cupo cuando el envío más antiguo sale de la ventana
+			wait := w.window
+			if !oldest.IsZero() {
+				wait = oldest.Add(w.window).Sub(now)
+			}
+			exceed(wait, w.reason)
+		}
+	}
+
+	startOfDay := startOfToday()
+	untilTomorrow := startOfDay.AddDate(0, 0, 1).Sub(now)
+
+	if perDay > 0 {
+		sent, _, err := sentSince(line.ID, startOfDay)
+		if err != nil {
+			return err
+		}
+		if sent+pending >= perDay {
+			exceed(untilTomorrow, perDayReason)
+		}
+	}
+
+	if limits.NewContactsPerDay > 0 && recipient != "" {
+		isNew, err := isNewContact(line.ID, recipient)
+		if err != nil {
+			return err
+		}
+		if isNew {
+			count, err := newContactsSince(line.ID, startOfDay)
+			if err != nil {
+				return err
+			}
+			if count >= limits.NewContactsPerDay {
+				exceed(untilTomorrow, "Límite de contactos nuevos por día alcanzado")
+			}
+		}
+	}
+
+	if exceeded != nil {
+		if exceeded.RetryAfter < time.Second {
+			exceeded.RetryAfter = time.Second
+		}
+		return exceeded
+	}
+	return nil
+}
+
+// Mensajes enviados desde since y el momento del más antiguo
+func sentSince(lineID string, since time.Time) (int, time.Time, error) {
+	var count int
+	err := configDB.QueryRow(`
+		SELECT COUNT(*) FROM outbound_queue WHERE line_id = ? AND status = ? AND sent_at >= ?
+	`, lineID, QueueStatusSent, since.UTC()).Scan(&count)
+	if err != nil || count == 0 {
+		return count, time.Time{}, err
+	}
+
+	var oldest time.Time
+	err = configDB.QueryRow(`
+		SELECT sent_at FROM outbound_queue WHERE line_id = ? AND status = ? AND sent_at >= ?
+		ORDER BY sent_at ASC LIMIT 1
+	`, lineID, QueueStatusSent, since.UTC()).Scan(&oldest)
+	return count, oldest, err
+}
+
+// Mensajes en curso y, con includeQueued, también los encolados
+func pendingSends(lineID, excludeID string, includeQueued bool) (int, error) {
+	statuses := []interface{}{QueueStatusSending, QueueStatusSending}
+	if includeQueued {
+		statuses[1] = QueueStatusQueued
+	}
+	var count int
+	err := configDB.QueryRow(`
+		SELECT COUNT(*) FROM outbound_queue WHERE line_id = ? AND id != ? AND status IN (?, ?)
+	`, lineID, excludeID, statuses[0], statuses[1]).Scan(&count)
+	return count, err
+}
+
+// Un contacto es nuevo si la línea nunca intercambió mensajes con él
+func isNewContact(lineID, recipient string) (bool, error) {
+	jid, err := parseJID(recipient)
+	if err != nil {
+		return false, err
+	}
+	var id int64
+	err = configDB.QueryRow(`
+		SELECT id FROM message_logs WHERE line_id = ? AND chat_jid = ? LIMIT 1
+	`, lineID, jid.String()).Scan(&id)
+	if err == sql.ErrNoRows {
+		return true, nil
+	}
+	return false, err
+}
+
+// Chats cuyo primer mensaje lo envió la línea desde since
+func newContactsSince(lineID string, since time.Time) (int, error) {
+	var count int
+	err := configDB.QueryRow(`
+		SELECT COUNT(*) FROM message_logs m
+		JOIN (
+			SELECT MIN(id) AS first_id FROM message_logs
+			WHERE line_id = ? AND chat_jid IS NOT NULL AND chat_jid != ''
+			GROUP BY chat_jid
+		) f ON m.id = f.first_id
+		WHERE m.direction = 'sent' AND m.timestamp >= ?
+	`, lineID, since.UTC().Format("2006-01-02 15:04:05")).Scan(&count)
+	return count, err
+}
+
+// Esperar el turno de envío de un mensaje reservado por un worker. Si la
+// línea superó un límite, el mensaje vuelve a la cola hasta que haya cupo y
+// se devuelve false
+func paceQueuedMessage(ctx context.Context, line *Line, item *QueuedMessage) bool {
+	pacer := sendPacerFor(line.ID)
+
+	pacer.mu.Lock()
+	err := checkRateLimits(line, item.To, item.ID, false)
+	if limitErr, ok := err.(*rateLimitError); ok {
+		pacer.mu.Unlock()
+		deferQueuedMessage(item, limitErr)
+		return false
+	} else if err != nil {
+		log.Printf("Error al comprobar límites de línea %s: %v", line.ID, err)
+	}
+
+	slot := time.Now()
+	if pacer.nextSendAt.After(slot) {
+		slot = pacer.nextSendAt
+	}
+	pacer.nextSendAt = slot.Add(randomSendDelay(line.Limits))
+	pacer.mu.Unlock()
+
+	if wait := time.Until(slot); wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+// Devolver un mensaje a la cola hasta que se libere el límite, sin contar
+// un intento
+func deferQueuedMessage(item *QueuedMessage, limitErr *rateLimitError) {
+	now := time.Now().UTC()
+	next := now.Add(limitErr.RetryAfter)
+	_, err := configDB.Exec(`
+		UPDATE outbound_queue SET status = ?, last_error = ?, next_attempt_at = ?, updated_at = ?
+		WHERE id = ?
+	`, QueueStatusQueued, limitErr.Reason, next, now, item.ID)
+	if err != nil {
+		log.Printf("Error al diferir mensaje %s: %v", item.ID, err)
+		return
+	}
+	log.Printf("Mensaje %s diferido hasta %s: %s", item.ID, next.Format(time.RFC3339), limitErr.Reason)
+}
+
+// Volver a poner en turno los mensajes diferidos por un límite, para que
+// los workers los reevalúen tras cambiar los límites de la línea
+func (line *Line) releaseDeferredMessages() {
+	_, err := configDB.Exec(`
+		UPDATE outbound_queue SET next_attempt_at = ? WHERE line_id = ? AND status = ? AND attempts = 0
+	`, time.Now().UTC(), line.ID, QueueStatusQueued)
+	if err != nil {
+		log.Printf("Error al reactivar cola de línea %s: %v", line.ID, err)
+	}
+	line.notifyQueue()
+}
+
+// Responder 429 con Retry-After
+func writeRateLimited(w http.ResponseWriter, limitErr *rateLimitError) {
+	w.Header().Set("Retry-After", retryAfterHeader(limitErr))
+	http.Error(w, limitErr.Reason, http.StatusTooManyRequests)
+}
+
+// Valor de Retry-After: segundos enteros, redondeando hacia arriba
+func retryAfterHeader(limitErr *rateLimitError) string {
+	return strconv.Itoa(int(math.Ceil(limitErr.RetryAfter.Seconds())))
+}
+
+// Cargar los límites guardados de una línea
+func loadRateLimits(lineID string) RateLimits {
+	var limits RateLimits
+	err := configDB.QueryRow(`
+		SELECT per_minute, per_hour, per_day, new_contacts_per_day, min_delay_ms, max_delay_ms, on_limit
+		FROM line_limits WHERE line_id = ?
+	`, lineID).Scan(&limits.PerMinute, &limits.PerHour, &limits.PerDay, &limits.NewContactsPerDay,
+		&limits.MinDelayMs, &limits.MaxDelayMs, &limits.OnLimit)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error al cargar límites de línea %s: %v", lineID, err)
+	}
+	return limits
+}
+
+func saveRateLimits(lineID string, limits RateLimits) error {
+	_, err := configDB.Exec(`
+		INSERT OR REPLACE INTO line_limits
+		(line_id, per_minute, per_hour, per_day, new_contacts_per_day, min_delay_ms, max_delay_ms, on_limit, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+	`, lineID, limits.PerMinute, limits.PerHour, limits.PerDay, limits.NewContactsPerDay,
+		limits.MinDelayMs, limits.MaxDelayMs, limits.OnLimit)
+	return err
+}
+
+// Uso actual de la línea frente a sus límites
+func rateUsageOf(line *Line) (RateUsage, error) {
+	var usage RateUsage
+	var err error
+	now := time.Now()
+	if usage.LastMinute, _, err = sentSince(line.ID, now.Add(-time.Minute)); err != nil {
+		return usage, err
+	}
+	if usage.LastHour, _, err = sentSince(line.ID, now.Add(-time.Hour)); err != nil {
+		return usage, err
+	}
+	if usage.Today, _, err = sentSince(line.ID, startOfToday()); err != nil {
+		return usage, err
+	}
+	if usage.NewContacts, err = newContactsSince(line.ID, startOfToday()); err != nil {
+		return usage, err
+	}
+	if usage.Pending, err = pendingSends(line.ID, "", true); err != nil {
+		return usage, err
+	}
+	if limitErr, ok := checkRateLimits(line, "", "", true).(*rateLimitError); ok {
+		usage.RetryAfterSecs = int(math.Ceil(limitErr.RetryAfter.Seconds()))
+	}
+	return usage, nil
+}
+
+// Consultar los límites de una línea y su uso actual
+func getLineLimits(w http.ResponseWriter, r *http.Request) {
+	lineID := mux.Vars(r)["id"]
+
+	linesMutex.RLock()
+	line, exists := lines[lineID]
+	linesMutex.RUnlock()
+
+	if !exists {
+		http.Error(w, "Línea no encontrada", http.StatusNotFound)
+		return
+	}
+
+	usage, err := rateUsageOf(line)
+	if err != nil {
+		log.Printf("Error al calcular uso de línea %s: %v", lineID, err)
+		http.Error(w, "Error al calcular uso", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"limits": line.Limits,
+		"usage":  usage,
+	})
+}
+
+// Reemplazar los límites de una línea
+func setLineLimits(w http.ResponseWriter, r *http.Request) {
+	lineID := mux.Vars(r)["id"]
+
+	var limits RateLimits
+	if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateRateLimits(limits); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	linesMutex.Lock()
+	defer linesMutex.Unlock()
+
+	line, exists := lines[lineID]
+	if !exists {
+		http.Error(w, "Línea no encontrada", http.StatusNotFound)
+		return
+	}
+
+	line.Limits = limits
+	if err := saveRateLimits(lineID, limits); err != nil {
+		log.Printf("Error al guardar límites de línea %s: %v", lineID, err)
+		http.Error(w, "Error al guardar límites", http.StatusInternalServerError)
+		return
+	}
+
+	// Los mensajes diferidos se reevalúan con los nuevos límites
+	line.releaseDeferredMessages()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Límites actualizados",
+		"limits":  line.Limits,
+	})
+}
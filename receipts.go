@@ -0,0 +1,164 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Estados de entrega de un mensaje enviado, en orden de avance
+const (
+	DeliveryServerAck = "server_ack"
+	DeliveryDelivered = "delivered"
+	DeliveryRead      = "read"
+	DeliveryPlayed    = "played"
+)
+
+var deliveryRank = map[string]int{
+	DeliveryServerAck: 1,
+	DeliveryDelivered: 2,
+	DeliveryRead:      3,
+	DeliveryPlayed:    4,
+}
+
+// Rango del estado de message_logs en SQL, generado a partir de deliveryRank
+// para que ambos no se desincronicen
+var deliveryRankSQL = func() string {
+	statuses := make([]string, 0, len(deliveryRank))
+	for status := range deliveryRank {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+
+	var expr strings.Builder
+	expr.WriteString("CASE COALESCE(status, '')")
+	for _, status := range statuses {
+		fmt.Fprintf(&expr, " WHEN '%s' THEN %d", status, deliveryRank[status])
+	}
+	expr.WriteString(" ELSE 0 END")
+	return expr.String()
+}()
+
+// Estado de entrega y marcas de tiempo de un mensaje enviado
+type DeliveryInfo struct {
+	Status      string     `json:"delivery_status,omitempty"`
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+	ReadAt      *time.Time `json:"read_at,omitempty"`
+	PlayedAt    *time.Time `json:"played_at,omitempty"`
+}
+
+// Traducir el tipo de recibo de WhatsApp a un estado de entrega
+func receiptDeliveryStatus(receiptType types.ReceiptType) string {
+	switch receiptType {
+	case types.ReceiptTypeDelivered:
+		return DeliveryDelivered
+	case types.ReceiptTypeRead:
+		return DeliveryRead
+	case types.ReceiptTypePlayed:
+		return DeliveryPlayed
+	}
+	return ""
+}
+
+// Actualizar el estado de un mensaje enviado sin retroceder (un recibo
+// "delivered" tardío no reemplaza a "read", pero sí completa delivered_at).
+// Devuelve false si el mensaje no fue enviado por WhatsGO.
+func updateDeliveryStatus(lineID string, messageID types.MessageID, status string, ts time.Time) (bool, error) {
+	column := ""
+	switch status {
+	case DeliveryDelivered:
+		column = "delivered_at"
+	case DeliveryRead:
+		column = "read_at"
+	case DeliveryPlayed:
+		column = "played_at"
+	default:
+		return false, nil
+	}
+
+	res, err := configDB.Exec(`
+		UPDATE message_logs
+		SET `+column+` = COALESCE(`+column+`, ?),
+			status = CASE WHEN `+deliveryRankSQL+` < ? THEN ? ELSE status END
+		WHERE line_id = ? AND message_id = ? AND direction = 'sent'
+	`, ts.UTC(), deliveryRank[status], status, lineID, string(messageID))
+	if err != nil {
+		return false, err
+	}
+
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// Procesar un recibo de entrega/lectura de WhatsApp
+func handleReceipt(line *Line, evt *events.Receipt) {
+	status := receiptDeliveryStatus(evt.Type)
+	if status == "" {
+		return
+	}
+
+	ts := evt.Timestamp
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+
+	updated := false
+	for _, id := range evt.MessageIDs {
+		ok, err := updateDeliveryStatus(line.ID, id, status, ts)
+		if err != nil {
+			log.Printf("Error al actualizar estado de mensaje %s: %v", id, err)
+			continue
+		}
+		updated = updated || ok
+	}
+
+	// Solo se notifican recibos de mensajes enviados por WhatsGO
+	if !updated {
+		return
+	}
+
+	log.Printf("Recibo %s en línea %s para %d mensaje(s)", status, line.ID, len(evt.MessageIDs))
+
+	emitWebhookEvent(line, EventMessageReceipt, ReceiptEventData{
+		Status:     status,
+		Chat:       evt.Chat.String(),
+		From:       evt.Sender.String(),
+		MessageIDs: evt.MessageIDs,
+		Timestamp:  ts,
+	})
+}
+
+// Obtener el estado de entrega de un mensaje enviado
+func getDeliveryInfo(lineID, messageID string) (*DeliveryInfo, error) {
+	var info DeliveryInfo
+	var status sql.NullString
+	var deliveredAt, readAt, playedAt sql.NullTime
+
+	err := configDB.QueryRow(`
+		SELECT status, delivered_at, read_at, played_at
+		FROM message_logs
+		WHERE line_id = ? AND message_id = ? AND direction = 'sent'
+		ORDER BY id DESC LIMIT 1
+	`, lineID, messageID).Scan(&status, &deliveredAt, &readAt, &playedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	info.Status = status.String
+	if deliveredAt.Valid {
+		info.DeliveredAt = &deliveredAt.Time
+	}
+	if readAt.Valid {
+		info.ReadAt = &readAt.Time
+	}
+	if playedAt.Valid {
+		info.PlayedAt = &playedAt.Time
+	}
+	return &info, nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Mensaje al que se responde
+type ReplyTo struct {
+	MessageID string `json:"message_id"`
+	Chat      string `json:"chat,omitempty"` // Vacío = el mismo chat del destinatario
+}
+
+// Validar reply_to y mentions de una solicitud
+func validateReplyAndMentions(req MessageRequest) error {
+	if req.ReplyTo != nil {
+		if req.ReplyTo.MessageID == "" {
+			return fmt.Errorf("reply_to.message_id es requerido")
+		}
+		if req.ReplyTo.Chat != "" {
+			if _, err := parseJID(req.ReplyTo.Chat); err != nil {
+				return fmt.Errorf("reply_to.chat inválido")
+			}
+		}
+	}
+
+	for _, mention := range req.Mentions {
+		if _, err := parseJID(mention); err != nil {
+			return fmt.Errorf("Mención inválida: %s", mention)
+		}
+	}
+
+	return nil
+}
+
+// Construir el ContextInfo de una respuesta y/o menciones. Devuelve nil si
+// la solicitud no cita ni menciona a nadie
+func buildContextInfo(lineID string, recipient types.JID, req MessageRequest) (*waProto.ContextInfo, error) {
+	if req.ReplyTo == nil && len(req.Mentions) == 0 {
+		return nil, nil
+	}
+
+	ctxInfo := &waProto.ContextInfo{}
+
+	for _, mention := range req.Mentions {
+		jid, err := parseJID(mention)
+		if err != nil {
+			return nil, fmt.Errorf("mención inválida: %s", mention)
+		}
+		ctxInfo.MentionedJID = append(ctxInfo.MentionedJID, jid.String())
+	}
+
+	if req.ReplyTo != nil {
+		chat := recipient
+		if req.ReplyTo.Chat != "" {
+			var err error
+			if chat, err = parseJID(req.ReplyTo.Chat); err != nil {
+				return nil, fmt.Errorf("reply_to.chat inválido")
+			}
+		}
+
+		quoted, err := findQuotedMessage(lineID, chat.String(), req.ReplyTo.MessageID)
+		if err != nil {
+			return nil, err
+		}
+
+		stanzaID := req.ReplyTo.MessageID
+		ctxInfo.StanzaID = &stanzaID
+		// Sin texto conocido no se envía una cita vacía: WhatsApp la muestra
+		// a partir del StanzaID
+		if quoted.Text != "" {
+			ctxInfo.QuotedMessage = &waProto.Message{Conversation: &quoted.Text}
+		}
+
+		// Autor del mensaje citado, sin dispositivo; sin historial, en un
+		// chat individual solo puede ser el contacto
+		var participant types.JID
+		switch {
+		case quoted.Sender != "":
+			if sender, err := parseJID(quoted.Sender); err == nil {
+				participant = sender
+			}
+		case chat.Server != types.GroupServer:
+			participant = chat
+		}
+		if !participant.IsEmpty() {
+			value := participant.ToNonAD().String()
+			ctxInfo.Participant = &value
+		}
+
+		if chat != recipient {
+			remoteJID := chat.String()
+			ctxInfo.RemoteJID = &remoteJID
+		}
+	}
+
+	return ctxInfo, nil
+}
+
+// Buscar el mensaje citado en el historial de la línea. No se buscan
+// mensajes de otras líneas: su contenido no debe filtrarse entre líneas
+func findQuotedMessage(lineID, chat, messageID string) (StoredMessage, error) {
+	row := configDB.QueryRow(`
+		SELECT `+storedMessageColumns+` FROM message_logs
+		WHERE message_id = ? AND chat_jid = ? AND line_id = ?
+		ORDER BY id DESC LIMIT 1
+	`, messageID, chat, lineID)
+
+	quoted, err := scanStoredMessage(row)
+	if err == sql.ErrNoRows {
+		return StoredMessage{MessageID: messageID, Chat: chat}, nil
+	} else if err != nil {
+		return quoted, fmt.Errorf("error al buscar mensaje citado: %v", err)
+	}
+	return quoted, nil
+}
+
+// Anteponer "@numero" al texto para las menciones que no lo incluyan, ya
+// que WhatsApp solo resalta la mención si aparece en el texto
+func mentionText(text string, mentions []string) string {
+	var missing []string
+	for _, mention := range mentions {
+		jid, err := parseJID(mention)
+		if err != nil {
+			continue
+		}
+		if tag := "@" + jid.User; !strings.Contains(text, tag) {
+			missing = append(missing, tag)
+		}
+	}
+	if len(missing) == 0 {
+		return text
+	}
+	return strings.TrimSpace(strings.Join(missing, " ") + " " + text)
+}
+
+// Adjuntar el ContextInfo al mensaje; un texto simple pasa a ser
+// ExtendedTextMessage porque Conversation no admite contexto
+func attachContextInfo(msg *waProto.Message, ctxInfo *waProto.ContextInfo) {
+	switch {
+	case msg.Conversation != nil:
+		msg.ExtendedTextMessage = &waProto.ExtendedTextMessage{
+			Text:        msg.Conversation,
+			ContextInfo: ctxInfo,
+		}
+		msg.Conversation = nil
+	case msg.ExtendedTextMessage != nil:
+		msg.ExtendedTextMessage.ContextInfo = ctxInfo
+	case msg.ImageMessage != nil:
+		msg.ImageMessage.ContextInfo = ctxInfo
+	case msg.AudioMessage != nil:
+		msg.AudioMessage.ContextInfo = ctxInfo
+	case msg.VideoMessage != nil:
+		msg.VideoMessage.ContextInfo = ctxInfo
+	case msg.DocumentMessage != nil:
+		msg.DocumentMessage.ContextInfo = ctxInfo
+	case msg.StickerMessage != nil:
+		msg.StickerMessage.ContextInfo = ctxInfo
+	case msg.LocationMessage != nil:
+		msg.LocationMessage.ContextInfo = ctxInfo
+	case msg.LiveLocationMessage != nil:
+		msg.LiveLocationMessage.ContextInfo = ctxInfo
+	case msg.ContactMessage != nil:
+		msg.ContactMessage.ContextInfo = ctxInfo
+	case msg.ContactsArrayMessage != nil:
+		msg.ContactsArrayMessage.ContextInfo = ctxInfo
+	case msg.PollCreationMessage != nil:
+		msg.PollCreationMessage.ContextInfo = ctxInfo
+	}
+}
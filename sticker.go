@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"log"
+
+	"github.com/HugoSmits86/nativewebp"
+	_ "golang.org/x/image/webp" // Para decodificar WebP
+)
+
+const (
+	// WhatsApp exige stickers WebP de exactamente 512x512
+	stickerSize = 512
+	// Tamaño máximo aceptado por WhatsApp para stickers estáticos
+	stickerMaxBytes = 100 * 1024
+)
+
+// Convertir una imagen PNG/JPEG/WebP en un sticker WebP de 512x512. La
+// imagen se orienta según su EXIF, se escala para caber completa y se
+// centra sobre fondo transparente
+func processStickerForWhatsApp(imageBytes []byte) ([]byte, error) {
+	img, format, err := decodeOrientedImage(imageBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	log.Printf("Sticker detectado: formato=%s, dimensiones=%dx%d, tamaño=%d bytes", format, width, height, len(imageBytes))
+
+	// Calcular dimensiones manteniendo aspect ratio
+	newWidth, newHeight := stickerSize, stickerSize
+	if width > height {
+		newHeight = max(1, (height*stickerSize)/width)
+	} else if height > width {
+		newWidth = max(1, (width*stickerSize)/height)
+	}
+
+	canvas := image.NewNRGBA(image.Rect(0, 0, stickerSize, stickerSize))
+	offsetX := (stickerSize - newWidth) / 2
+	offsetY := (stickerSize - newHeight) / 2
+	target := image.Rect(offsetX, offsetY, offsetX+newWidth, offsetY+newHeight)
+
+	if newWidth == width && newHeight == height {
+		draw.Draw(canvas, target, img, bounds.Min, draw.Src)
+	} else {
+		scaleInto(canvas, target, img)
+	}
+
+	// WebP sin pérdida; si excede el límite se reduce la precisión de color,
+	// lo que hace la imagen más comprimible
+	for dropBits := 0; dropBits <= 4; dropBits++ {
+		encoded, err := encodeStickerWebP(canvas, dropBits)
+		if err != nil {
+			return nil, fmt.Errorf("error al codificar WebP: %v", err)
+		}
+		if len(encoded) <= stickerMaxBytes {
+			log.Printf("Sticker procesado: %d bytes -> %d bytes (WebP 512x512, bits descartados=%d)", len(imageBytes), len(encoded), dropBits)
+			return encoded, nil
+		}
+	}
+
+	return nil, fmt.Errorf("el sticker excede %d bytes aun reduciendo colores; usa una imagen más simple", stickerMaxBytes)
+}
+
+// Codificar el lienzo en WebP descartando los bits menos significativos de
+// cada canal de color
+func encodeStickerWebP(canvas *image.NRGBA, dropBits int) ([]byte, error) {
+	img := canvas
+	if dropBits > 0 {
+		img = image.NewNRGBA(canvas.Rect)
+		mask := byte(0xFF << dropBits)
+		for i := 0; i < len(canvas.Pix); i += 4 {
+			img.Pix[i] = canvas.Pix[i] & mask
+			img.Pix[i+1] = canvas.Pix[i+1] & mask
+			img.Pix[i+2] = canvas.Pix[i+2] & mask
+			img.Pix[i+3] = canvas.Pix[i+3]
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := nativewebp.Encode(&buf, img, nil); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
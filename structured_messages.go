@@ -0,0 +1,349 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// Ubicación enviada o recibida. Con Live se envía como ubicación en tiempo
+// real (solo la posición indicada: WhatsGO no envía actualizaciones);
+// Caption, AccuracyMeters, SpeedMps y Sequence solo aplican a ellas
+type LocationData struct {
+	Lat            *float64 `json:"lat"`
+	Lng            *float64 `json:"lng"`
+	Name           string   `json:"name,omitempty"`
+	Address        string   `json:"address,omitempty"`
+	URL            string   `json:"url,omitempty"`
+	Live           bool     `json:"live,omitempty"`
+	Caption        string   `json:"caption,omitempty"`
+	AccuracyMeters uint32   `json:"accuracy_meters,omitempty"`
+	SpeedMps       float32  `json:"speed_mps,omitempty"`
+	Sequence       int64    `json:"sequence,omitempty"`
+}
+
+// Tarjeta de contacto. Al enviar, la vCard se genera a partir de los campos
+// estructurados salvo que se indique VCard directamente
+type ContactCard struct {
+	Name         string         `json:"name"`
+	Organization string         `json:"organization,omitempty"`
+	Title        string         `json:"title,omitempty"`
+	Phones       []ContactPhone `json:"phones,omitempty"`
+	Emails       []string       `json:"emails,omitempty"`
+	URL          string         `json:"url,omitempty"`
+	VCard        string         `json:"vcard,omitempty"`
+}
+
+type ContactPhone struct {
+	Number string `json:"number"`
+	Label  string `json:"label,omitempty"` // p.ej. "CELL", "WORK", "HOME"
+	WaID   string `json:"wa_id,omitempty"` // Número de WhatsApp, solo dígitos
+}
+
+// Validar una solicitud de tipo location o contact
+func validateStructuredRequest(req MessageRequest) error {
+	switch req.MediaType {
+	case "location":
+		loc := req.Location
+		if loc == nil {
+			return fmt.Errorf("location es requerido para mensajes de ubicación")
+		}
+		// Punteros: sin ellos una coordenada omitida valdría 0
+		if loc.Lat == nil || loc.Lng == nil {
+			return fmt.Errorf("location.lat y location.lng son requeridos")
+		}
+		if *loc.Lat < -90 || *loc.Lat > 90 || *loc.Lng < -180 || *loc.Lng > 180 {
+			return fmt.Errorf("Coordenadas inválidas: lat debe estar entre -90 y 90, lng entre -180 y 180")
+		}
+	case "contact":
+		if len(req.Contacts) == 0 {
+			return fmt.Errorf("contacts es requerido para mensajes de contacto")
+		}
+		for i, contact := range req.Contacts {
+			if contact.VCard != "" {
+				continue
+			}
+			if strings.TrimSpace(contact.Name) == "" {
+				return fmt.Errorf("contacts[%d].name es requerido", i)
+			}
+			if len(contact.Phones) == 0 {
+				return fmt.Errorf("contacts[%d] debe tener al menos un teléfono", i)
+			}
+			// label y wa_id van como parámetros de TEL, donde no se pueden escapar
+			for j, phone := range contact.Phones {
+				if phone.WaID != "" && onlyDigits(phone.WaID) != phone.WaID {
+					return fmt.Errorf("contacts[%d].phones[%d].wa_id debe contener solo dígitos", i, j)
+				}
+				if !validVCardLabel(phone.Label) {
+					return fmt.Errorf("contacts[%d].phones[%d].label solo admite letras, números y guiones", i, j)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Construir un mensaje de ubicación o de contacto(s)
+func createStructuredMessage(req MessageRequest) (*waProto.Message, error) {
+	switch req.MediaType {
+	case "location":
+		loc := req.Location
+		if loc.Live {
+			return &waProto.Message{LiveLocationMessage: liveLocationMessage(loc)}, nil
+		}
+		msg := &waProto.LocationMessage{
+			DegreesLatitude:  loc.Lat,
+			DegreesLongitude: loc.Lng,
+		}
+		if loc.Name != "" {
+			msg.Name = &loc.Name
+		}
+		if loc.Address != "" {
+			msg.Address = &loc.Address
+		}
+		if loc.URL != "" {
+			msg.URL = &loc.URL
+		}
+		return &waProto.Message{LocationMessage: msg}, nil
+
+	case "contact":
+		contacts := make([]*waProto.ContactMessage, 0, len(req.Contacts))
+		for _, contact := range req.Contacts {
+			vcard := contact.VCard
+			if vcard == "" {
+				vcard = buildVCard(contact)
+			}
+			name := contact.Name
+			if name == "" {
+				name = parseVCard(vcard).Name
+			}
+			contacts = append(contacts, &waProto.ContactMessage{DisplayName: &name, Vcard: &vcard})
+		}
+
+		if len(contacts) == 1 {
+			return &waProto.Message{ContactMessage: contacts[0]}, nil
+		}
+
+		displayName := fmt.Sprintf("%d contactos", len(contacts))
+		return &waProto.Message{
+			ContactsArrayMessage: &waProto.ContactsArrayMessage{
+				DisplayName: &displayName,
+				Contacts:    contacts,
+			},
+		}, nil
+	}
+
+	return nil, fmt.Errorf("tipo de mensaje no soportado: %s", req.MediaType)
+}
+
+// Construir una ubicación en tiempo real
+func liveLocationMessage(loc *LocationData) *waProto.LiveLocationMessage {
+	msg := &waProto.LiveLocationMessage{
+		DegreesLatitude:  loc.Lat,
+		DegreesLongitude: loc.Lng,
+	}
+	if loc.Caption != "" {
+		msg.Caption = &loc.Caption
+	}
+	if loc.AccuracyMeters > 0 {
+		msg.AccuracyInMeters = &loc.AccuracyMeters
+	}
+	if loc.SpeedMps > 0 {
+		msg.SpeedInMps = &loc.SpeedMps
+	}
+	if loc.Sequence > 0 {
+		msg.SequenceNumber = &loc.Sequence
+	}
+	return msg
+}
+
+// Generar una vCard 3.0 con el formato que usa WhatsApp (waid en TEL)
+func buildVCard(contact ContactCard) string {
+	var b strings.Builder
+	b.WriteString("BEGIN:VCARD\nVERSION:3.0\n")
+	fmt.Fprintf(&b, "N:;%s;;;\n", escapeVCard(contact.Name))
+	fmt.Fprintf(&b, "FN:%s\n", escapeVCard(contact.Name))
+	if contact.Organization != "" {
+		fmt.Fprintf(&b, "ORG:%s\n", escapeVCard(contact.Organization))
+	}
+	if contact.Title != "" {
+		fmt.Fprintf(&b, "TITLE:%s\n", escapeVCard(contact.Title))
+	}
+	for _, phone := range contact.Phones {
+		waID := onlyDigits(phone.WaID)
+		if waID == "" {
+			waID = onlyDigits(phone.Number)
+		}
+		label := strings.ToUpper(phone.Label)
+		if label == "" || !validVCardLabel(label) {
+			label = "CELL"
+		}
+		fmt.Fprintf(&b, "TEL;type=%s;type=VOICE;waid=%s:%s\n", label, waID, escapeVCard(phone.Number))
+	}
+	for _, email := range contact.Emails {
+		fmt.Fprintf(&b, "EMAIL:%s\n", escapeVCard(email))
+	}
+	if contact.URL != "" {
+		fmt.Fprintf(&b, "URL:%s\n", escapeVCard(contact.URL))
+	}
+	b.WriteString("END:VCARD")
+	return b.String()
+}
+
+// Etiqueta de teléfono admitida en el parámetro type de TEL
+func validVCardLabel(label string) bool {
+	for _, c := range label {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+func escapeVCard(value string) string {
+	return strings.NewReplacer(`\`, `\\`, ",", `\,`, ";", `\;`, "\n", `\n`).Replace(value)
+}
+
+func unescapeVCard(value string) string {
+	return strings.NewReplacer(`\\`, `\`, `\,`, ",", `\;`, ";", `\n`, "\n", `\N`, "\n").Replace(value)
+}
+
+func onlyDigits(value string) string {
+	var b strings.Builder
+	for _, c := range value {
+		if c >= '0' && c <= '9' {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// Extraer los campos principales de una vCard recibida
+func parseVCard(vcard string) ContactCard {
+	contact := ContactCard{VCard: vcard}
+
+	// Las líneas que empiezan con espacio continúan la anterior
+	unfolded := strings.NewReplacer("\r\n ", "", "\r\n\t", "", "\n ", "", "\n\t", "").Replace(vcard)
+
+	for _, line := range strings.Split(unfolded, "\n") {
+		line = strings.TrimRight(line, "\r")
+		colon := strings.Index(line, ":")
+		if colon < 0 {
+			continue
+		}
+		params := strings.Split(line[:colon], ";")
+		value := line[colon+1:]
+
+		// Los campos pueden venir agrupados (p.ej. "item1.TEL")
+		key := strings.ToUpper(params[0])
+		if dot := strings.LastIndex(key, "."); dot >= 0 {
+			key = key[dot+1:]
+		}
+
+		switch key {
+		case "FN":
+			contact.Name = unescapeVCard(value)
+		case "ORG":
+			contact.Organization = strings.TrimRight(unescapeVCard(strings.ReplaceAll(value, ";", " ")), " ")
+		case "TITLE":
+			contact.Title = unescapeVCard(value)
+		case "EMAIL":
+			contact.Emails = append(contact.Emails, unescapeVCard(value))
+		case "URL":
+			contact.URL = unescapeVCard(value)
+		case "TEL":
+			phone := ContactPhone{Number: unescapeVCard(value)}
+			for _, param := range params[1:] {
+				name, val, _ := strings.Cut(param, "=")
+				switch strings.ToLower(name) {
+				case "waid":
+					phone.WaID = val
+				case "type":
+					if phone.Label == "" && !strings.EqualFold(val, "VOICE") {
+						phone.Label = strings.ToUpper(val)
+					}
+				}
+			}
+			contact.Phones = append(contact.Phones, phone)
+		}
+	}
+
+	return contact
+}
+
+// Extraer la ubicación de un mensaje, normal o en tiempo real
+func locationOf(msg *waProto.Message) *LocationData {
+	if loc := msg.GetLocationMessage(); loc != nil {
+		return &LocationData{
+			Lat:     proto.Float64(loc.GetDegreesLatitude()),
+			Lng:     proto.Float64(loc.GetDegreesLongitude()),
+			Name:    loc.GetName(),
+			Address: loc.GetAddress(),
+			URL:     loc.GetURL(),
+			Live:    loc.GetIsLive(),
+			Caption: loc.GetComment(),
+		}
+	}
+	if loc := msg.GetLiveLocationMessage(); loc != nil {
+		return &LocationData{
+			Lat:            proto.Float64(loc.GetDegreesLatitude()),
+			Lng:            proto.Float64(loc.GetDegreesLongitude()),
+			Live:           true,
+			Caption:        loc.GetCaption(),
+			AccuracyMeters: loc.GetAccuracyInMeters(),
+			SpeedMps:       loc.GetSpeedInMps(),
+			Sequence:       loc.GetSequenceNumber(),
+		}
+	}
+	return nil
+}
+
+// Extraer los contactos de un mensaje de uno o varios contactos
+func contactsOf(msg *waProto.Message) []ContactCard {
+	var messages []*waProto.ContactMessage
+	if contact := msg.GetContactMessage(); contact != nil {
+		messages = append(messages, contact)
+	} else if array := msg.GetContactsArrayMessage(); array != nil {
+		messages = array.GetContacts()
+	}
+
+	var contacts []ContactCard
+	for _, m := range messages {
+		contact := parseVCard(m.GetVcard())
+		if contact.Name == "" {
+			contact.Name = m.GetDisplayName()
+		}
+		contacts = append(contacts, contact)
+	}
+	return contacts
+}
+
+// Texto legible de una ubicación, contacto o encuesta para el historial
+func structuredTextOf(msg *waProto.Message) string {
+	if text := pollTextOf(msg); text != "" {
+		return text
+	}
+
+	if loc := locationOf(msg); loc != nil {
+		parts := []string{}
+		for _, part := range []string{loc.Name, loc.Address, loc.Caption} {
+			if part != "" {
+				parts = append(parts, part)
+			}
+		}
+		parts = append(parts, fmt.Sprintf("%.6f,%.6f", *loc.Lat, *loc.Lng))
+		return strings.Join(parts, " - ")
+	}
+
+	if contacts := contactsOf(msg); len(contacts) > 0 {
+		names := make([]string, 0, len(contacts))
+		for _, contact := range contacts {
+			names = append(names, contact.Name)
+		}
+		return strings.Join(names, ", ")
+	}
+
+	return ""
+}
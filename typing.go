@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+const (
+	// Tiempo de escritura simulado por carácter del mensaje
+	typingPerCharacter = 60 * time.Millisecond
+	typingMinDuration  = time.Second
+	// WhatsApp deja de mostrar "escribiendo..." a los ~25s sin renovarlo
+	typingMaxDuration = 20 * time.Second
+	// Una nota de voz Opus ocupa unos 2KB por segundo de audio
+	voiceBytesPerSecond = 2000
+	// Envíos con escritura simulada en curso a la vez por línea
+	typingSendsPerLine = 4
+)
+
+// Escrituras simuladas de cada línea: los turnos limitan cuántas hay en
+// curso y online cuenta las que necesitan la línea en línea
+type typingState struct {
+	slots  chan struct{}
+	mu     sync.Mutex
+	online int
+}
+
+var (
+	typingStates      = make(map[string]*typingState)
+	typingStatesMutex sync.Mutex
+)
+
+func typingStateFor(lineID string) *typingState {
+	typingStatesMutex.Lock()
+	defer typingStatesMutex.Unlock()
+	state, ok := typingStates[lineID]
+	if !ok {
+		state = &typingState{slots: make(chan struct{}, typingSendsPerLine)}
+		typingStates[lineID] = state
+	}
+	return state
+}
+
+// Esperar un turno de escritura de la línea; false si se detuvieron los workers
+func (state *typingState) acquire(ctx context.Context) bool {
+	select {
+	case state.slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (state *typingState) release() {
+	<-state.slots
+}
+
+// Poner la línea en línea mientras alguna escritura lo necesite: la primera
+// la conecta y la última la desconecta
+func (state *typingState) goOnline(ctx context.Context, line *Line) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if state.online == 0 {
+		line.Client.SendPresence(ctx, types.PresenceAvailable)
+	}
+	state.online++
+}
+
+func (state *typingState) goOffline(line *Line) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.online--
+	if state.online == 0 && !line.Config.AlwaysOnline {
+		line.Client.SendPresence(context.Background(), types.PresenceUnavailable)
+	}
+}
+
+// Indica si hay que simular escritura antes de enviar: la solicitud
+// decide y, si no lo indica, la configuración de la línea
+func shouldSimulateTyping(line *Line, req MessageRequest) bool {
+	if req.SimulateTyping != nil {
+		return *req.SimulateTyping
+	}
+	return line.Config.SimulateTyping
+}
+
+// Duración de la escritura o grabación simulada: proporcional al texto o,
+// para notas de voz, a la duración estimada del audio. Se varía un ±20%
+// para que no todos los mensajes tarden lo mismo
+func typingDuration(req MessageRequest) (time.Duration, types.ChatPresenceMedia) {
+	var duration time.Duration
+	media := types.ChatPresenceMediaText
+
+	if req.MediaType == "voice" {
+		media = types.ChatPresenceMediaAudio
+		duration = time.Duration(voiceSize(req)/voiceBytesPerSecond) * time.Second
+	} else {
+		text := req.Message
+		if text == "" {
+			text = req.Caption
+		}
+		if req.Poll != nil {
+			text = req.Poll.Question
+		}
+		duration = time.Duration(utf8.RuneCountInString(text)) * typingPerCharacter
+	}
+
+	duration = time.Duration(float64(duration) * (0.8 + 0.4*rand.Float64()))
+	return min(max(duration, typingMinDuration), typingMaxDuration), media
+}
+
+// Tamaño de la nota de voz, en disco o en base64
+func voiceSize(req MessageRequest) int64 {
+	if req.mediaFile != "" {
+		if info, err := os.Stat(req.mediaFile); err == nil {
+			return info.Size()
+		}
+		return 0
+	}
+	return int64(len(req.MediaData)) * 3 / 4
+}
+
+// Mostrar "escribiendo..." (o "grabando audio...") al destinatario,
+// esperar, marcar la pausa y enviar el mensaje. Se ejecuta en su propia
+// goroutine para no ocupar al worker mientras tanto, con un turno de
+// escritura ya tomado que se libera al terminar. Los errores de presencia
+// no impiden el envío
+func sendWithTyping(ctx context.Context, line *Line, item *QueuedMessage, state *typingState) {
+	defer state.release()
+
+	recipient, err := parseJID(item.request.To)
+	if err != nil {
+		// El envío fallará y registrará el error
+		processQueuedMessage(line, item)
+		return
+	}
+
+	duration, media := typingDuration(item.request)
+
+	// Los estados de chat solo se muestran si la línea aparece en línea
+	if !line.Config.AlwaysOnline {
+		state.goOnline(ctx, line)
+		defer state.goOffline(line)
+	}
+
+	if err := line.Client.SendChatPresence(ctx, recipient, types.ChatPresenceComposing, media); err != nil {
+		log.Printf("Error al enviar estado de escritura a %s: %v", recipient, err)
+	}
+
+	select {
+	case <-time.After(duration):
+	case <-ctx.Done():
+		return
+	}
+
+	if err := line.Client.SendChatPresence(ctx, recipient, types.ChatPresencePaused, ""); err != nil {
+		log.Printf("Error al enviar pausa de escritura a %s: %v", recipient, err)
+	}
+
+	processQueuedMessage(line, item)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Perfil de calentamiento sin límites
+const WarmupProfileNone = "none"
+
+// Mensajes permitidos en cada día de calentamiento de un número recién
+// vinculado; pasado el último día la línea queda sin este límite
+var warmupProfiles = map[string][]int{
+	"conservative": {10, 15, 20, 30, 40, 50, 65, 80, 100, 120, 150, 180, 220, 260},
+	"standard":     {20, 30, 45, 65, 90, 120, 160, 200, 250, 300},
+	"fast":         {50, 100, 200, 400},
+}
+
+// Perfil asignado a las líneas nuevas que no indican uno
+var defaultWarmupProfile = envOrDefault("WHATSGO_WARMUP_PROFILE", "standard")
+
+// Calentamiento de una línea. Los límites se copian del perfil al asignarlo,
+// así cambiar un perfil no altera las líneas que ya lo usan
+type LineWarmup struct {
+	Profile     string     `json:"profile"`
+	DailyLimits []int      `json:"daily_limits"`
+	StartedAt   *time.Time `json:"started_at,omitempty"` // Primera conexión tras vincular; nil = aún no empieza
+
+	// Estado actual, al mostrar las líneas
+	Day       int   `json:"day,omitempty"`
+	Allowance int   `json:"allowance,omitempty"` // Mensajes permitidos hoy
+	SentToday *int  `json:"sent_today,omitempty"`
+	Remaining *int  `json:"remaining,omitempty"`
+	Completed *bool `json:"completed,omitempty"`
+}
+
+// Solicitud para asignar un perfil: por nombre o con límites propios
+type WarmupRequest struct {
+	Profile     string `json:"profile,omitempty"`
+	DailyLimits []int  `json:"daily_limits,omitempty"`
+	Restart     bool   `json:"restart,omitempty"` // Volver a empezar desde el día 1
+}
+
+// Resolver el calentamiento de una solicitud; nil = sin calentamiento
+func warmupFromRequest(req WarmupRequest) (*LineWarmup, error) {
+	if len(req.DailyLimits) > 0 {
+		for _, limit := range req.DailyLimits {
+			if limit < 1 {
+				return nil, fmt.Errorf("daily_limits debe contener números positivos")
+			}
+		}
+		profile := req.Profile
+		if profile == "" {
+			profile = "custom"
+		}
+		return &LineWarmup{Profile: profile, DailyLimits: req.DailyLimits}, nil
+	}
+
+	if req.Profile == WarmupProfileNone {
+		return nil, nil
+	}
+	limits, ok := warmupProfiles[req.Profile]
+	if !ok {
+		return nil, fmt.Errorf("Perfil de calentamiento desconocido: %s", req.Profile)
+	}
+	return &LineWarmup{Profile: req.Profile, DailyLimits: append([]int(nil), limits...)}, nil
+}
+
+// Validar WHATSGO_WARMUP_PROFILE al arrancar
+func initWarmupProfile() {
+	if _, ok := warmupProfiles[defaultWarmupProfile]; !ok && defaultWarmupProfile != WarmupProfileNone {
+		log.Printf("WHATSGO_WARMUP_PROFILE desconocido (%s), usando standard", defaultWarmupProfile)
+		defaultWarmupProfile = "standard"
+	}
+}
+
+// Día de calentamiento (1 = el de la primera conexión) según el calendario
+// local; 0 si todavía no empezó
+func (warmup *LineWarmup) currentDay() int {
+	if warmup == nil || warmup.StartedAt == nil {
+		return 0
+	}
+	started := warmup.StartedAt.Local()
+	startDay := time.Date(started.Year(), started.Month(), started.Day(), 0, 0, 0, 0, started.Location())
+	return int(startOfToday().Sub(startDay).Hours()/24+0.5) + 1
+}
+
+// Mensajes permitidos hoy por el calentamiento; 0 = sin límite
+func (warmup *LineWarmup) dailyLimit() int {
+	day := warmup.currentDay()
+	if day < 1 || day > len(warmup.DailyLimits) {
+		return 0
+	}
+	return warmup.DailyLimits[day-1]
+}
+
+// Marcar el comienzo del calentamiento en la primera conexión
+func startWarmup(line *Line) {
+	if line.Warmup != nil && line.Warmup.StartedAt == nil {
+		now := time.Now().UTC()
+		line.Warmup.StartedAt = &now
+		log.Printf("Línea %s: comienza el calentamiento %s", line.ID, line.Warmup.Profile)
+	}
+}
+
+// Copia del calentamiento con el estado del día, para mostrar la línea
+func warmupStatusOf(line *Line) *LineWarmup {
+	if line.Warmup == nil {
+		return nil
+	}
+	status := *line.Warmup
+	if status.StartedAt == nil {
+		return &status
+	}
+
+	status.Day = status.currentDay()
+	completed := status.Day > len(status.DailyLimits)
+	status.Completed = &completed
+	if completed {
+		return &status
+	}
+
+	sent, _, err := sentSince(line.ID, startOfToday())
+	if err != nil {
+		log.Printf("Error al contar envíos de línea %s: %v", line.ID, err)
+	}
+	remaining := max(0, status.dailyLimit()-sent)
+	status.Allowance = status.dailyLimit()
+	status.SentToday = &sent
+	status.Remaining = &remaining
+	return &status
+}
+
+// Columnas de la tabla lines: límites separados por comas
+func warmupToColumns(warmup *LineWarmup) (string, string, interface{}) {
+	if warmup == nil {
+		return "", "", nil
+	}
+	limits := make([]string, len(warmup.DailyLimits))
+	for i, limit := range warmup.DailyLimits {
+		limits[i] = strconv.Itoa(limit)
+	}
+	var startedAt interface{}
+	if warmup.StartedAt != nil {
+		startedAt = *warmup.StartedAt
+	}
+	return warmup.Profile, strings.Join(limits, ","), startedAt
+}
+
+func warmupFromColumns(profile, limits string, startedAt sql.NullTime) *LineWarmup {
+	if profile == "" {
+		return nil
+	}
+	warmup := &LineWarmup{Profile: profile}
+	if startedAt.Valid {
+		warmup.StartedAt = &startedAt.Time
+	}
+	for _, value := range splitList(limits) {
+		if limit, err := strconv.Atoi(value); err == nil {
+			warmup.DailyLimits = append(warmup.DailyLimits, limit)
+		}
+	}
+	return warmup
+}
+
+// Cambiar el calentamiento de una línea. Conserva el día en curso salvo que
+// se pida empezar de nuevo; "none" lo elimina
+func setLineWarmup(w http.ResponseWriter, r *http.Request) {
+	lineID := mux.Vars(r)["id"]
+
+	var req WarmupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	warmup, err := warmupFromRequest(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	linesMutex.Lock()
+	defer linesMutex.Unlock()
+
+	line, exists := lines[lineID]
+	if !exists {
+		http.Error(w, "Línea no encontrada", http.StatusNotFound)
+		return
+	}
+
+	if warmup != nil && line.Warmup != nil && !req.Restart {
+		warmup.StartedAt = line.Warmup.StartedAt
+	}
+	line.Warmup = warmup
+	if line.Status == "connected" {
+		startWarmup(line)
+	}
+
+	if err := saveLineToDB(line); err != nil {
+		log.Printf("Error al guardar línea en DB: %v", err)
+	}
+
+	// Los mensajes diferidos se reevalúan con el nuevo límite
+	line.releaseDeferredMessages()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Calentamiento actualizado",
+		"warmup":  warmupStatusOf(line),
+	})
+}
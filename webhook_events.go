@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Versión del esquema de los webhooks; cambia solo con cambios incompatibles
+const webhookSchemaVersion = 2
+
+// Tipos de evento que se envían a los webhooks
+const (
+	EventMessageReceived     = "message.received"
+	EventMessageReceipt      = "message.receipt"
+	EventMessageReaction     = "message.reaction"
+	EventMessageEdited       = "message.edited"
+	EventMessageRevoked      = "message.revoked"
+	EventPollVote            = "poll.vote"
+	EventConnectionConnected = "connection.connected"
+	EventConnectionLoggedOut = "connection.logged_out"
+	EventConnectionQR        = "connection.qr"
+	EventCallOffer           = "call.offer"
+	EventGroupParticipants   = "group.participants"
+	EventPresence            = "presence.update"
+	EventChatPresence        = "chat.presence"
+)
+
+var webhookEventTypes = map[string]bool{
+	EventMessageReceived:     true,
+	EventMessageReceipt:      true,
+	EventMessageReaction:     true,
+	EventMessageEdited:       true,
+	EventMessageRevoked:      true,
+	EventPollVote:            true,
+	EventConnectionConnected: true,
+	EventConnectionLoggedOut: true,
+	EventConnectionQR:        true,
+	EventCallOffer:           true,
+	EventGroupParticipants:   true,
+	EventPresence:            true,
+	EventChatPresence:        true,
+}
+
+// Sobre común a todos los eventos de webhook
+type WebhookEnvelope struct {
+	Event     string      `json:"event"`
+	Version   int         `json:"version"`
+	LineID    string      `json:"line_id"`
+	Timestamp time.Time   `json:"timestamp"`
+	Data      interface{} `json:"data"`
+}
+
+type QuotedMessage struct {
+	ID          string `json:"id"`
+	Participant string `json:"participant,omitempty"`
+	Type        string `json:"type,omitempty"`
+	Text        string `json:"text,omitempty"`
+}
+
+type GroupSummary struct {
+	JID  string `json:"jid"`
+	Name string `json:"name,omitempty"`
+}
+
+type MessageEventData struct {
+	ID        string         `json:"id"`
+	Chat      string         `json:"chat"`
+	Sender    string         `json:"sender"`
+	PushName  string         `json:"push_name,omitempty"`
+	Type      string         `json:"type"`
+	Text      string         `json:"text,omitempty"`
+	Caption   string         `json:"caption,omitempty"`
+	FileName  string         `json:"file_name,omitempty"`
+	MimeType  string         `json:"mime_type,omitempty"`
+	Media     *MediaFile     `json:"media,omitempty"`
+	Location  *LocationData  `json:"location,omitempty"`
+	Contacts  []ContactCard  `json:"contacts,omitempty"`
+	Quoted    *QuotedMessage `json:"quoted,omitempty"`
+	IsGroup   bool           `json:"is_group"`
+	Group     *GroupSummary  `json:"group,omitempty"`
+	FromMe    bool           `json:"from_me"`
+	Timestamp time.Time      `json:"timestamp"`
+}
+
+type ReceiptEventData struct {
+	Status     string            `json:"status"`
+	Chat       string            `json:"chat"`
+	From       string            `json:"from"`
+	MessageIDs []types.MessageID `json:"message_ids"`
+	Timestamp  time.Time         `json:"timestamp"`
+}
+
+// Datos de message.reaction, message.edited y message.revoked; ID es el
+// mensaje afectado
+type MessageActionEventData struct {
+	ID        string    `json:"id"`
+	Chat      string    `json:"chat"`
+	Sender    string    `json:"sender"`
+	Emoji     string    `json:"emoji,omitempty"` // Vacío en una reacción = reacción retirada
+	Text      string    `json:"text,omitempty"`  // Nuevo texto de un mensaje editado
+	IsGroup   bool      `json:"is_group"`
+	FromMe    bool      `json:"from_me"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type CallEventData struct {
+	CallID    string    `json:"call_id"`
+	From      string    `json:"from"`
+	IsVideo   bool      `json:"is_video"`
+	IsGroup   bool      `json:"is_group"`
+	Platform  string    `json:"platform,omitempty"`
+	Rejected  bool      `json:"rejected"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type GroupParticipantsEventData struct {
+	Group     string    `json:"group"`
+	Sender    string    `json:"sender,omitempty"`
+	Join      []string  `json:"join,omitempty"`
+	Leave     []string  `json:"leave,omitempty"`
+	Promote   []string  `json:"promote,omitempty"`
+	Demote    []string  `json:"demote,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Verificar si la línea está suscrita al evento. Sin suscripciones se
+// envían todos; "message.*" suscribe a todos los eventos de mensaje.
+func webhookSubscribed(line *Line, event string) bool {
+	if len(line.WebhookEvents) == 0 {
+		return true
+	}
+	for _, sub := range line.WebhookEvents {
+		if sub == event || sub == "*" {
+			return true
+		}
+		if strings.HasSuffix(sub, ".*") && strings.HasPrefix(event, strings.TrimSuffix(sub, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validar una suscripción de eventos
+func validWebhookSubscription(sub string) bool {
+	if sub == "*" || webhookEventTypes[sub] {
+		return true
+	}
+	if strings.HasSuffix(sub, ".*") {
+		prefix := strings.TrimSuffix(sub, "*")
+		for event := range webhookEventTypes {
+			if strings.HasPrefix(event, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Emitir un evento al webhook de la línea si está suscrita
+func emitWebhookEvent(line *Line, event string, data interface{}) {
+	if line.WebhookURL == "" || !webhookSubscribed(line, event) {
+		return
+	}
+
+	postWebhook(line, event, WebhookEnvelope{
+		Event:     event,
+		Version:   webhookSchemaVersion,
+		LineID:    line.ID,
+		Timestamp: time.Now().UTC(),
+		Data:      data,
+	})
+}
+
+// Determinar el tipo de un mensaje entrante
+func messageTypeOf(msg *waProto.Message) string {
+	switch {
+	case msg.GetImageMessage() != nil:
+		return "image"
+	case msg.GetStickerMessage() != nil:
+		return "sticker"
+	case msg.GetAudioMessage() != nil:
+		if msg.GetAudioMessage().GetPTT() {
+			return "voice"
+		}
+		return "audio"
+	case msg.GetVideoMessage() != nil:
+		return "video"
+	case msg.GetDocumentMessage() != nil:
+		return "document"
+	case msg.GetLocationMessage() != nil:
+		if msg.GetLocationMessage().GetIsLive() {
+			return "live_location"
+		}
+		return "location"
+	case msg.GetLiveLocationMessage() != nil:
+		return "live_location"
+	case msg.GetContactMessage() != nil, msg.GetContactsArrayMessage() != nil:
+		return "contact"
+	case pollCreationOf(msg) != nil:
+		return "poll"
+	}
+	return "text"
+}
+
+// Obtener el texto de un mensaje (conversación o texto extendido)
+func messageTextOf(msg *waProto.Message) string {
+	if text := msg.GetConversation(); text != "" {
+		return text
+	}
+	return msg.GetExtendedTextMessage().GetText()
+}
+
+// Obtener el caption de un mensaje multimedia
+func messageCaptionOf(msg *waProto.Message) string {
+	switch {
+	case msg.GetImageMessage() != nil:
+		return msg.GetImageMessage().GetCaption()
+	case msg.GetVideoMessage() != nil:
+		return msg.GetVideoMessage().GetCaption()
+	case msg.GetDocumentMessage() != nil:
+		return msg.GetDocumentMessage().GetCaption()
+	}
+	return ""
+}
+
+// Obtener el ContextInfo (respuestas, menciones) de cualquier tipo de mensaje
+func messageContextInfo(msg *waProto.Message) *waProto.ContextInfo {
+	switch {
+	case msg.GetExtendedTextMessage() != nil:
+		return msg.GetExtendedTextMessage().GetContextInfo()
+	case msg.GetImageMessage() != nil:
+		return msg.GetImageMessage().GetContextInfo()
+	case msg.GetAudioMessage() != nil:
+		return msg.GetAudioMessage().GetContextInfo()
+	case msg.GetVideoMessage() != nil:
+		return msg.GetVideoMessage().GetContextInfo()
+	case msg.GetDocumentMessage() != nil:
+		return msg.GetDocumentMessage().GetContextInfo()
+	case msg.GetStickerMessage() != nil:
+		return msg.GetStickerMessage().GetContextInfo()
+	case msg.GetLocationMessage() != nil:
+		return msg.GetLocationMessage().GetContextInfo()
+	case msg.GetLiveLocationMessage() != nil:
+		return msg.GetLiveLocationMessage().GetContextInfo()
+	case msg.GetContactMessage() != nil:
+		return msg.GetContactMessage().GetContextInfo()
+	case msg.GetContactsArrayMessage() != nil:
+		return msg.GetContactsArrayMessage().GetContextInfo()
+	case pollCreationOf(msg) != nil:
+		return pollCreationOf(msg).GetContextInfo()
+	}
+	return nil
+}
+
+// Extraer el mensaje citado, si lo hay
+func quotedMessageOf(msg *waProto.Message) *QuotedMessage {
+	ctxInfo := messageContextInfo(msg)
+	if ctxInfo == nil || ctxInfo.GetStanzaID() == "" {
+		return nil
+	}
+
+	quoted := &QuotedMessage{
+		ID:          ctxInfo.GetStanzaID(),
+		Participant: ctxInfo.GetParticipant(),
+	}
+	if qm := ctxInfo.GetQuotedMessage(); qm != nil {
+		quoted.Type = messageTypeOf(qm)
+		quoted.Text = messageTextOf(qm)
+		if quoted.Text == "" {
+			quoted.Text = messageCaptionOf(qm)
+		}
+	}
+	return quoted
+}
+
+var (
+	// Caché de nombres de grupo para no consultar WhatsApp en cada mensaje
+	groupNames      = make(map[string]string)
+	groupNamesMutex sync.RWMutex
+)
+
+// Obtener el nombre de un grupo, consultándolo una sola vez
+func groupName(line *Line, jid types.JID) string {
+	key := jid.String()
+
+	groupNamesMutex.RLock()
+	name, ok := groupNames[key]
+	groupNamesMutex.RUnlock()
+	if ok {
+		return name
+	}
+
+	info, err := line.Client.GetGroupInfo(context.Background(), jid)
+	if err != nil {
+		return ""
+	}
+
+	groupNamesMutex.Lock()
+	groupNames[key] = info.Name
+	groupNamesMutex.Unlock()
+	return info.Name
+}
+
+// Construir los datos del evento message.received
+func buildMessageEventData(line *Line, evt *events.Message) MessageEventData {
+	msg := evt.Message
+	data := MessageEventData{
+		ID:        evt.Info.ID,
+		Chat:      evt.Info.Chat.String(),
+		Sender:    evt.Info.Sender.String(),
+		PushName:  evt.Info.PushName,
+		Type:      messageTypeOf(msg),
+		Text:      messageTextOf(msg),
+		Caption:   messageCaptionOf(msg),
+		Quoted:    quotedMessageOf(msg),
+		Location:  locationOf(msg),
+		Contacts:  contactsOf(msg),
+		IsGroup:   evt.Info.IsGroup,
+		FromMe:    evt.Info.IsFromMe,
+		Timestamp: evt.Info.Timestamp,
+	}
+
+	switch {
+	case msg.GetImageMessage() != nil:
+		data.MimeType = msg.GetImageMessage().GetMimetype()
+	case msg.GetAudioMessage() != nil:
+		data.MimeType = msg.GetAudioMessage().GetMimetype()
+	case msg.GetVideoMessage() != nil:
+		data.MimeType = msg.GetVideoMessage().GetMimetype()
+	case msg.GetStickerMessage() != nil:
+		data.MimeType = msg.GetStickerMessage().GetMimetype()
+	case msg.GetDocumentMessage() != nil:
+		data.MimeType = msg.GetDocumentMessage().GetMimetype()
+		data.FileName = msg.GetDocumentMessage().GetFileName()
+	}
+
+	if evt.Info.IsGroup {
+		data.Group = &GroupSummary{
+			JID:  evt.Info.Chat.String(),
+			Name: groupName(line, evt.Info.Chat),
+		}
+	}
+
+	return data
+}
+
+// Construir los datos del evento call.offer
+func buildCallEventData(evt *events.CallOffer) CallEventData {
+	data := CallEventData{
+		CallID:    evt.CallID,
+		From:      evt.From.String(),
+		IsGroup:   !evt.GroupJID.IsEmpty(),
+		Platform:  evt.RemotePlatform,
+		Timestamp: evt.Timestamp,
+	}
+	if evt.Data != nil {
+		_, data.IsVideo = evt.Data.GetOptionalChildByTag("video")
+	}
+	return data
+}
+
+func jidStrings(jids []types.JID) []string {
+	if len(jids) == 0 {
+		return nil
+	}
+	result := make([]string, len(jids))
+	for i, jid := range jids {
+		result[i] = jid.String()
+	}
+	return result
+}
+
+// Construir los datos del evento group.participants; nil si el cambio
+// no afecta a participantes (nombre, descripción, etc.)
+func buildGroupParticipantsEventData(evt *events.GroupInfo) *GroupParticipantsEventData {
+	if len(evt.Join)+len(evt.Leave)+len(evt.Promote)+len(evt.Demote) == 0 {
+		return nil
+	}
+
+	data := &GroupParticipantsEventData{
+		Group:     evt.JID.String(),
+		Join:      jidStrings(evt.Join),
+		Leave:     jidStrings(evt.Leave),
+		Promote:   jidStrings(evt.Promote),
+		Demote:    jidStrings(evt.Demote),
+		Reason:    evt.JoinReason,
+		Timestamp: evt.Timestamp,
+	}
+	if evt.Sender != nil {
+		data.Sender = evt.Sender.String()
+	}
+	return data
+}
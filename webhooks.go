@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultWebhookTimeout     = 10 // Segundos
+	defaultWebhookMaxAttempts = 5
+	webhookBaseBackoff        = time.Second
+	webhookMaxBackoff         = time.Minute
+	// Máximo de bytes de la respuesta del webhook que se guardan en el log
+	webhookResponseLogLimit = 1024
+)
+
+// Días que se conserva el registro de entregas de webhooks; 0 lo conserva
+// indefinidamente
+var webhookRetentionDays = envIntOrDefault("WHATSGO_WEBHOOK_RETENTION_DAYS", 30)
+
+// Un intento de entrega registrado en webhook_deliveries
+type WebhookDeliveryAttempt struct {
+	ID            int64      `json:"id"`
+	DeliveryID    string     `json:"delivery_id"`
+	LineID        string     `json:"line_id"`
+	Event         string     `json:"event"`
+	URL           string     `json:"url"`
+	Attempt       int        `json:"attempt"`
+	StatusCode    int        `json:"status_code,omitempty"`
+	Error         string     `json:"error,omitempty"`
+	ResponseBody  string     `json:"response_body,omitempty"`
+	DurationMs    int64      `json:"duration_ms"`
+	Success       bool       `json:"success"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"` // Reintento programado tras este intento
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+// Generar un secreto para firmar webhooks
+func generateWebhookSecret() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return "whsec_" + hex.EncodeToString(b)
+}
+
+// Firma HMAC-SHA256 del cuerpo con el secreto de la línea
+func signWebhookPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Calcular el backoff exponencial entre intentos de webhook
+func webhookBackoff(attempt int) time.Duration {
+	backoff := webhookBaseBackoff
+	for i := 1; i < attempt; i++ {
+		backoff *= 2
+		if backoff >= webhookMaxBackoff {
+			return webhookMaxBackoff
+		}
+	}
+	return backoff
+}
+
+// Enviar un evento al webhook de la línea en segundo plano, con reintentos
+func postWebhook(line *Line, event string, payload interface{}) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Error al serializar webhook: %v", err)
+		return
+	}
+
+	deliveryID := fmt.Sprintf("whd_%d", time.Now().UnixNano())
+	go deliverWebhook(line, deliveryID, event, body, 0)
+}
+
+// Entregar un payload reintentando con backoff ante errores de red o
+// respuestas que no sean 2xx. previousAttempts permite retomar una entrega
+// interrumpida por un reinicio. Cada reintento queda programado en
+// next_attempt_at del último intento para que recoverWebhookDeliveries lo
+// retome
+func deliverWebhook(line *Line, deliveryID, event string, body []byte, previousAttempts int) bool {
+	maxAttempts := line.WebhookMaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultWebhookMaxAttempts
+	}
+
+	for attempt := previousAttempts + 1; attempt <= maxAttempts; attempt++ {
+		clearWebhookRetry(deliveryID)
+
+		// La URL puede haber cambiado o eliminado entre intentos
+		url := line.WebhookURL
+		if url == "" {
+			return false
+		}
+
+		if attemptWebhook(line, url, deliveryID, event, body, attempt) {
+			log.Printf("Webhook %s enviado para línea %s", event, line.ID)
+			return true
+		}
+
+		if attempt < maxAttempts {
+			backoff := webhookBackoff(attempt)
+			scheduleWebhookRetry(deliveryID, attempt, time.Now().Add(backoff))
+			time.Sleep(backoff)
+		}
+	}
+
+	log.Printf("Webhook %s para línea %s falló tras %d intentos", event, line.ID, maxAttempts)
+	return false
+}
+
+// Registrar cuándo se hará el siguiente intento de una entrega
+func scheduleWebhookRetry(deliveryID string, attempt int, at time.Time) {
+	_, err := configDB.Exec(`
+		UPDATE webhook_deliveries SET next_attempt_at = ? WHERE delivery_id = ? AND attempt = ?
+	`, at.UTC(), deliveryID, attempt)
+	if err != nil {
+		log.Printf("Error al programar reintento de webhook %s: %v", deliveryID, err)
+	}
+}
+
+// Marcar que la entrega ya no tiene un reintento pendiente
+func clearWebhookRetry(deliveryID string) {
+	_, err := configDB.Exec(`
+		UPDATE webhook_deliveries SET next_attempt_at = NULL
+		WHERE delivery_id = ? AND next_attempt_at IS NOT NULL
+	`, deliveryID)
+	if err != nil {
+		log.Printf("Error al actualizar reintento de webhook %s: %v", deliveryID, err)
+	}
+}
+
+// Retomar al arrancar las entregas con reintentos pendientes, en el momento
+// en que estaban programados. Se llama después de cargar las líneas
+func recoverWebhookDeliveries() error {
+	rows, err := configDB.Query(`
+		SELECT d.delivery_id, d.line_id, d.event, d.payload, d.attempt, d.next_attempt_at
+		FROM webhook_deliveries d
+		WHERE d.next_attempt_at IS NOT NULL AND d.success = 0
+		  AND d.attempt = (SELECT MAX(attempt) FROM webhook_deliveries WHERE delivery_id = d.delivery_id)
+	`)
+	if err != nil {
+		return err
+	}
+
+	type pending struct {
+		deliveryID, lineID, event, payload string
+		attempt                            int
+		nextAttempt                        time.Time
+	}
+	var deliveries []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.deliveryID, &p.lineID, &p.event, &p.payload, &p.attempt, &p.nextAttempt); err != nil {
+			rows.Close()
+			return err
+		}
+		deliveries = append(deliveries, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, p := range deliveries {
+		linesMutex.RLock()
+		line, exists := lines[p.lineID]
+		linesMutex.RUnlock()
+
+		if !exists {
+			clearWebhookRetry(p.deliveryID)
+			continue
+		}
+
+		go func() {
+			time.Sleep(time.Until(p.nextAttempt))
+			deliverWebhook(line, p.deliveryID, p.event, []byte(p.payload), p.attempt)
+		}()
+	}
+
+	if len(deliveries) > 0 {
+		log.Printf("Entregas de webhook retomadas: %d", len(deliveries))
+	}
+	return nil
+}
+
+// Eliminar el registro de entregas más antiguo que el período de retención,
+// salvo los intentos con un reintento pendiente
+func purgeWebhookDeliveries() {
+	if webhookRetentionDays <= 0 {
+		return
+	}
+
+	cutoff := time.Now().UTC().AddDate(0, 0, -webhookRetentionDays)
+	result, err := configDB.Exec(`
+		DELETE FROM webhook_deliveries WHERE created_at < ? AND next_attempt_at IS NULL
+	`, cutoff)
+	if err != nil {
+		log.Printf("Error al eliminar entregas de webhook antiguas: %v", err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		log.Printf("Entregas de webhook antiguas eliminadas: %d", n)
+	}
+}
+
+// Ejecutar la limpieza del registro de entregas periódicamente
+func startWebhookRetention() {
+	go func() {
+		for {
+			purgeWebhookDeliveries()
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+// Realizar un único intento de entrega y registrarlo
+func attemptWebhook(line *Line, url, deliveryID, event string, body []byte, attempt int) bool {
+	timeout := line.WebhookTimeout
+	if timeout <= 0 {
+		timeout = defaultWebhookTimeout
+	}
+	client := &http.Client{Timeout: time.Duration(timeout) * time.Second}
+
+	record := WebhookDeliveryAttempt{
+		DeliveryID: deliveryID,
+		LineID:     line.ID,
+		Event:      event,
+		URL:        url,
+		Attempt:    attempt,
+	}
+
+	start := time.Now()
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err == nil {
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "WhatsGO-Webhook")
+		req.Header.Set("X-WhatsGO-Event", event)
+		req.Header.Set("X-WhatsGO-Delivery", deliveryID)
+		if line.WebhookSecret != "" {
+			req.Header.Set("X-WhatsGO-Signature", signWebhookPayload(line.WebhookSecret, body))
+		}
+
+		var resp *http.Response
+		resp, err = client.Do(req)
+		if err == nil {
+			respBody, _ := io.ReadAll(io.LimitReader(resp.Body, webhookResponseLogLimit))
+			resp.Body.Close()
+			record.StatusCode = resp.StatusCode
+			record.ResponseBody = string(respBody)
+			record.Success = resp.StatusCode >= 200 && resp.StatusCode < 300
+			if !record.Success {
+				record.Error = fmt.Sprintf("respuesta HTTP %d", resp.StatusCode)
+			}
+		}
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	record.DurationMs = time.Since(start).Milliseconds()
+
+	_, dbErr := configDB.Exec(`
+		INSERT INTO webhook_deliveries
+		(delivery_id, line_id, event, url, payload, attempt, status_code, error, response_body, duration_ms, success, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, record.DeliveryID, record.LineID, record.Event, record.URL, string(body), record.Attempt,
+		record.StatusCode, record.Error, record.ResponseBody, record.DurationMs, record.Success, time.Now().UTC())
+	if dbErr != nil {
+		log.Printf("Error al registrar entrega de webhook: %v", dbErr)
+	}
+
+	return record.Success
+}
+
+// Listar intentos de entrega del webhook de una línea
+func getWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	lineID := mux.Vars(r)["id"]
+
+	limit := 50
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= 500 {
+		limit = l
+	}
+
+	query := `
+		SELECT id, delivery_id, line_id, event, url, attempt, status_code, error,
+		       response_body, duration_ms, success, next_attempt_at, created_at
+		FROM webhook_deliveries
+		WHERE line_id = ?
+	`
+	args := []interface{}{lineID}
+
+	if event := r.URL.Query().Get("event"); event != "" {
+		query += " AND event = ?"
+		args = append(args, event)
+	}
+	if success := r.URL.Query().Get("success"); success != "" {
+		query += " AND success = ?"
+		args = append(args, success == "true")
+	}
+
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := configDB.Query(query, args...)
+	if err != nil {
+		log.Printf("Error al obtener entregas de webhook: %v", err)
+		http.Error(w, "Error al obtener entregas", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	result := []WebhookDeliveryAttempt{}
+	for rows.Next() {
+		var a WebhookDeliveryAttempt
+		var errText, respBody sql.NullString
+		var nextAttempt sql.NullTime
+		if err := rows.Scan(&a.ID, &a.DeliveryID, &a.LineID, &a.Event, &a.URL, &a.Attempt, &a.StatusCode,
+			&errText, &respBody, &a.DurationMs, &a.Success, &nextAttempt, &a.CreatedAt); err != nil {
+			log.Printf("Error al leer entrega de webhook: %v", err)
+			continue
+		}
+		a.Error = errText.String
+		a.ResponseBody = respBody.String
+		if nextAttempt.Valid {
+			a.NextAttemptAt = &nextAttempt.Time
+		}
+		result = append(result, a)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// Reenviar una entrega existente al webhook actual de la línea
+func redeliverWebhook(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	lineID := vars["id"]
+	deliveryID := vars["delivery_id"]
+
+	linesMutex.RLock()
+	line, exists := lines[lineID]
+	linesMutex.RUnlock()
+
+	if !exists {
+		http.Error(w, "Línea no encontrada", http.StatusNotFound)
+		return
+	}
+
+	if line.WebhookURL == "" {
+		http.Error(w, "La línea no tiene webhook configurado", http.StatusBadRequest)
+		return
+	}
+
+	var event, payload string
+	var attempts int
+	err := configDB.QueryRow(`
+		SELECT event, payload, (SELECT MAX(attempt) FROM webhook_deliveries WHERE delivery_id = ?)
+		FROM webhook_deliveries
+		WHERE delivery_id = ? AND line_id = ?
+		ORDER BY id DESC LIMIT 1
+	`, deliveryID, deliveryID, lineID).Scan(&event, &payload, &attempts)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Entrega no encontrada", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error al obtener entrega de webhook: %v", err)
+		http.Error(w, "Error al obtener entrega", http.StatusInternalServerError)
+		return
+	}
+
+	// Un único intento inmediato para informar el resultado en la respuesta
+	success := attemptWebhook(line, line.WebhookURL, deliveryID, event, []byte(payload), attempts+1)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"delivery_id": deliveryID,
+		"attempt":     attempts + 1,
+		"success":     success,
+	})
+}